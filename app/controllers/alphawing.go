@@ -198,9 +198,14 @@ func (c *AlphaWingController) isPermittedEmail(email string) bool {
 }
 
 func (c *AlphaWingController) createAudit(resource int, resourceId int, action int) error {
+	return createAudit(c.LoginUserId, resource, resourceId, action)
+}
+
+// createAudit records the operation of the user out of the request.
+func createAudit(userId int, resource int, resourceId int, action int) error {
 	err := Transact(func(txn gorp.SqlExecutor) error {
 		audit := &models.Audit{
-			UserId:     c.LoginUserId,
+			UserId:     userId,
 			Resource:   resource,
 			ResourceId: resourceId,
 			Action:     action,
@@ -213,6 +218,48 @@ func (c *AlphaWingController) createAudit(resource int, resourceId int, action i
 	return nil
 }
 
+// notifyNewPermissions notifies the webhook of the permissions added by the bundle.
+// The webhook is called in background, and it does nothing unless the webhook is configured.
+// The errors are only logged, since the bundle is already stored and the upload must not fail.
+func (c *AlphaWingController) notifyNewPermissions(app *models.App, bundle *models.Bundle) {
+	if Conf.PermissionWebhookUrl == "" {
+		return
+	}
+
+	baseUrl, err := c.UriFor("")
+	if err != nil {
+		revel.ERROR.Printf("failed to notify the new permissions of the bundle %d: %s", bundle.Id, err)
+		return
+	}
+	notifyNewBundlePermissions(baseUrl, app, bundle)
+}
+
+// notifyNewBundlePermissions notifies the webhook as notifyNewPermissions out of the request.
+// The URL of the bundle is resolved from the base URL of the site.
+func notifyNewBundlePermissions(baseUrl *url.URL, app *models.App, bundle *models.Bundle) {
+	if Conf.PermissionWebhookUrl == "" {
+		return
+	}
+
+	permissions, err := bundle.NewPermissions(Dbm)
+	if err != nil {
+		revel.ERROR.Printf("failed to find the new permissions of the bundle %d: %s", bundle.Id, err)
+		return
+	}
+	if len(permissions) == 0 {
+		return
+	}
+
+	bundleUrl := baseUrl.ResolveReference(&url.URL{Path: fmt.Sprintf("bundle/%d", bundle.Id)})
+
+	go func() {
+		err := models.NotifyNewPermissions(Conf.PermissionWebhookUrl, app, bundle, bundleUrl.String(), permissions)
+		if err != nil {
+			revel.ERROR.Printf("failed to notify the new permissions of the bundle %d: %s", bundle.Id, err)
+		}
+	}()
+}
+
 func (c *AlphaWingController) SetLoginInfo() revel.Result {
 	c.RenderArgs["islogin"] = c.isLogin()
 	if c.isLogin() {
@@ -260,12 +307,7 @@ func (c *AlphaWingController) InitGoogleService() revel.Result {
 		Scope:       []string{drive.DriveScope},
 	}
 
-	token, err := models.GetServiceAccountToken(config)
-	if err != nil {
-		panic(err)
-	}
-
-	s, err := models.NewGoogleService(token)
+	s, err := models.NewServiceAccountGoogleService(config)
 	if err != nil {
 		panic(err)
 	}
@@ -1,10 +1,17 @@
 package controllers
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/url"
 	"os"
-	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/coopernurse/gorp"
 	"github.com/kayac/alphawing/app/models"
@@ -27,6 +34,11 @@ type JsonResponseListBundle struct {
 	Content *models.BundlesJsonResponse `json:"content"`
 }
 
+type JsonResponseCompareBundle struct {
+	*JsonResponse
+	Content *models.BundleComparisonJsonResponse `json:"content"`
+}
+
 type ApiController struct {
 	AlphaWingController
 }
@@ -45,6 +57,10 @@ func (c ApiController) NewJsonResponseUploadBundle(stat int, mes []string, conte
 	}
 }
 
+func (c ApiController) NewJsonResponseUpdateBundle(stat int, mes []string, content *models.BundleJsonResponse) *JsonResponseUploadBundle {
+	return c.NewJsonResponseUploadBundle(stat, mes, content)
+}
+
 func (c ApiController) NewJsonResponseDeleteBundle(stat int, mes []string) *JsonResponse {
 	return c.NewJsonResponse(stat, mes)
 }
@@ -56,127 +72,722 @@ func (c ApiController) NewJsonResponseListBundle(stat int, mes []string, content
 	}
 }
 
+func (c ApiController) NewJsonResponseCompareBundle(stat int, mes []string, content *models.BundleComparisonJsonResponse) *JsonResponseCompareBundle {
+	return &JsonResponseCompareBundle{
+		c.NewJsonResponse(stat, mes),
+		content,
+	}
+}
+
+// v1Status returns the status which the v1 API used for the error.
+func (c ApiController) v1Status(aerr *ApiError) int {
+	if aerr.Code == ApiErrorCodeBundleParseError {
+		return http.StatusInternalServerError
+	}
+	return aerr.Status
+}
+
 func (c ApiController) GetDocument() revel.Result {
 	return c.Render()
 }
 
-func (c ApiController) PostUploadBundle(token string, description string, file *os.File) revel.Result {
-	app, err := models.GetAppByApiToken(Dbm, token)
-	if err != nil {
-		c.Response.Status = http.StatusUnauthorized
-		return c.RenderJson(c.NewJsonResponseUploadBundle(c.Response.Status, []string{"Token is invalid."}, nil))
+func (c ApiController) PostUploadBundle(token string, description string, version string, file *os.File) revel.Result {
+	app, aerr := c.appByToken(token, models.ApiTokenScopeUpload)
+	if aerr != nil {
+		c.Response.Status = c.v1Status(aerr)
+		return c.RenderJson(c.NewJsonResponseUploadBundle(c.Response.Status, aerr.Messages(), nil))
 	}
 
-	var filename string
-	if _, ok := c.Params.Files["file"]; ok {
-		filename = c.Params.Files["file"][0].Filename
+	content, _, messages, aerr := c.createBundleIdempotently(app, c.uploadedFileName("file"), description, version, file)
+	if aerr != nil {
+		c.Response.Status = c.v1Status(aerr)
+		return c.RenderJson(c.NewJsonResponseUploadBundle(c.Response.Status, aerr.Messages(), nil))
 	}
-	extStr := filepath.Ext(filename)
-	ext := models.BundleFileExtension(extStr)
-	isValidExt := ext.IsValid()
 
-	c.Validation.Required(file != nil).Message("File is required.")
-	c.Validation.Required(isValidExt).Message("File extension is not valid.")
-	if c.Validation.HasErrors() {
-		var errors []string
-		for _, err := range c.Validation.Errors {
-			errors = append(errors, err.String())
-		}
-		c.Response.Status = http.StatusBadRequest
-		return c.RenderJson(c.NewJsonResponseUploadBundle(c.Response.Status, errors, nil))
+	c.Response.Status = http.StatusOK
+	return c.RenderJson(c.NewJsonResponseUploadBundle(c.Response.Status, messages, content))
+}
+
+func (c ApiController) PostUpdateBundle(token string, file_id string) revel.Result {
+	app, aerr := c.appByToken(token, models.ApiTokenScopeUpload)
+	if aerr != nil {
+		c.Response.Status = c.v1Status(aerr)
+		return c.RenderJson(c.NewJsonResponseUpdateBundle(c.Response.Status, aerr.Messages(), nil))
 	}
 
-	bundle := &models.Bundle{
-		PlatformType: ext.PlatformType(),
-		Description:  description,
-		File:         file,
+	c.Validation.Required(file_id).Message("file_id is required.")
+	if aerr := c.validationError(); aerr != nil {
+		c.Response.Status = c.v1Status(aerr)
+		return c.RenderJson(c.NewJsonResponseUpdateBundle(c.Response.Status, aerr.Messages(), nil))
 	}
 
-	if err := app.CreateBundle(Dbm, c.GoogleService, bundle); err != nil {
-		if bperr, ok := err.(*models.BundleParseError); ok {
-			c.Response.Status = http.StatusInternalServerError
-			return c.RenderJson(c.NewJsonResponseUploadBundle(c.Response.Status, []string{bperr.Error()}, nil))
-		}
-		c.Response.Status = http.StatusInternalServerError
-		return c.RenderJson(c.NewJsonResponseUploadBundle(c.Response.Status, []string{err.Error()}, nil))
+	bundle, aerr := c.bundleByFileId(app, file_id)
+	if aerr != nil {
+		c.Response.Status = c.v1Status(aerr)
+		return c.RenderJson(c.NewJsonResponseUpdateBundle(c.Response.Status, aerr.Messages(), nil))
+	}
+
+	if aerr := c.updateBundle(bundle); aerr != nil {
+		c.Response.Status = c.v1Status(aerr)
+		return c.RenderJson(c.NewJsonResponseUpdateBundle(c.Response.Status, aerr.Messages(), nil))
 	}
 
 	content, err := bundle.JsonResponse(&c)
 	if err != nil {
 		c.Response.Status = http.StatusInternalServerError
-		return c.RenderJson(c.NewJsonResponseUploadBundle(c.Response.Status, []string{err.Error()}, nil))
+		return c.RenderJson(c.NewJsonResponseUpdateBundle(c.Response.Status, []string{err.Error()}, nil))
 	}
 
 	c.Response.Status = http.StatusOK
-	return c.RenderJson(c.NewJsonResponseUploadBundle(c.Response.Status, []string{"Bundle is created!"}, content))
+	return c.RenderJson(c.NewJsonResponseUpdateBundle(c.Response.Status, []string{"Bundle is updated!"}, content))
 }
 
 func (c ApiController) PostDeleteBundle(token string, file_id string) revel.Result {
-	_, err := models.GetAppByApiToken(Dbm, token)
-	if err != nil {
-		c.Response.Status = http.StatusUnauthorized
-		return c.RenderJson(c.NewJsonResponseDeleteBundle(c.Response.Status, []string{"Token is invalid."}))
+	app, aerr := c.appByToken(token, models.ApiTokenScopeDelete)
+	if aerr != nil {
+		c.Response.Status = c.v1Status(aerr)
+		return c.RenderJson(c.NewJsonResponseDeleteBundle(c.Response.Status, aerr.Messages()))
 	}
 
 	c.Validation.Required(file_id).Message("file_id is required.")
-	if c.Validation.HasErrors() {
-		var errors []string
-		for _, err := range c.Validation.Errors {
-			errors = append(errors, err.String())
+	if aerr := c.validationError(); aerr != nil {
+		c.Response.Status = c.v1Status(aerr)
+		return c.RenderJson(c.NewJsonResponseDeleteBundle(c.Response.Status, aerr.Messages()))
+	}
+
+	bundle, aerr := c.bundleByFileId(app, file_id)
+	if aerr != nil {
+		c.Response.Status = c.v1Status(aerr)
+		return c.RenderJson(c.NewJsonResponseDeleteBundle(c.Response.Status, aerr.Messages()))
+	}
+
+	if aerr := c.deleteBundle(bundle); aerr != nil {
+		c.Response.Status = c.v1Status(aerr)
+		return c.RenderJson(c.NewJsonResponseDeleteBundle(c.Response.Status, aerr.Messages()))
+	}
+
+	c.Response.Status = http.StatusOK
+	return c.RenderJson(c.NewJsonResponseDeleteBundle(c.Response.Status, []string{"Bundle is deleted!"}))
+}
+
+func (c ApiController) GetListBundle(token string, page int) revel.Result {
+	app, aerr := c.appByToken(token, models.ApiTokenScopeRead)
+	if aerr != nil {
+		c.Response.Status = c.v1Status(aerr)
+		return c.RenderJson(c.NewJsonResponseListBundle(c.Response.Status, aerr.Messages(), nil))
+	}
+
+	content, aerr := c.listBundles(app, page)
+	if aerr != nil {
+		c.Response.Status = c.v1Status(aerr)
+		return c.RenderJson(c.NewJsonResponseListBundle(c.Response.Status, aerr.Messages(), nil))
+	}
+
+	c.Response.Status = http.StatusOK
+
+	return c.RenderJson(c.NewJsonResponseListBundle(c.Response.Status, []string{"Bundle List"}, content))
+}
+
+func (c ApiController) GetCompareBundle(token string, base_file_id string, target_file_id string) revel.Result {
+	app, aerr := c.appByToken(token, models.ApiTokenScopeRead)
+	if aerr != nil {
+		c.Response.Status = c.v1Status(aerr)
+		return c.RenderJson(c.NewJsonResponseCompareBundle(c.Response.Status, aerr.Messages(), nil))
+	}
+
+	c.Validation.Required(base_file_id).Message("base_file_id is required.")
+	c.Validation.Required(target_file_id).Message("target_file_id is required.")
+	if aerr := c.validationError(); aerr != nil {
+		c.Response.Status = c.v1Status(aerr)
+		return c.RenderJson(c.NewJsonResponseCompareBundle(c.Response.Status, aerr.Messages(), nil))
+	}
+
+	var bundles []*models.Bundle
+	for _, fileId := range []string{base_file_id, target_file_id} {
+		bundle, aerr := c.bundleByFileId(app, fileId)
+		if aerr != nil {
+			c.Response.Status = c.v1Status(aerr)
+			return c.RenderJson(c.NewJsonResponseCompareBundle(c.Response.Status, aerr.Messages(), nil))
 		}
-		c.Response.Status = http.StatusBadRequest
-		return c.RenderJson(c.NewJsonResponseDeleteBundle(c.Response.Status, errors))
+		bundles = append(bundles, bundle)
 	}
 
-	bundle, err := models.GetBundleByFileId(Dbm, file_id)
+	comparison, err := models.CompareBundles(c.GoogleService, bundles[0], bundles[1])
 	if err != nil {
-		if err == sql.ErrNoRows {
-			c.Response.Status = http.StatusNotFound
-			return c.RenderJson(c.NewJsonResponseDeleteBundle(c.Response.Status, []string{"Bundle not found."}))
-		}
 		c.Response.Status = http.StatusInternalServerError
-		return c.RenderJson(c.NewJsonResponseDeleteBundle(c.Response.Status, []string{err.Error()}))
+		return c.RenderJson(c.NewJsonResponseCompareBundle(c.Response.Status, []string{err.Error()}, nil))
 	}
 
-	err = Transact(func(txn gorp.SqlExecutor) error {
-		return bundle.Delete(txn, c.GoogleService)
-	})
+	content, err := comparison.JsonResponse(&c)
 	if err != nil {
 		c.Response.Status = http.StatusInternalServerError
-		return c.RenderJson(c.NewJsonResponseDeleteBundle(c.Response.Status, []string{err.Error()}))
+		return c.RenderJson(c.NewJsonResponseCompareBundle(c.Response.Status, []string{err.Error()}, nil))
 	}
 
 	c.Response.Status = http.StatusOK
-	return c.RenderJson(c.NewJsonResponseDeleteBundle(c.Response.Status, []string{"Bundle is deleted!"}))
+	return c.RenderJson(c.NewJsonResponseCompareBundle(c.Response.Status, []string{"Bundle Comparison"}, content))
 }
 
-func (c ApiController) GetListBundle(token string, page int) revel.Result {
-	app, err := models.GetAppByApiToken(Dbm, token)
+// ------------------------------------------------------
+// shared by the API versions
+
+// requestToken returns the token in the Authorization header, or the token parameter.
+func (c *ApiController) requestToken(param string) string {
+	authorization := c.Request.Header.Get("Authorization")
+	if strings.HasPrefix(authorization, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer "))
+	}
+	return param
+}
+
+// appByToken returns the app of the token if the token has the scope.
+// The token of the app itself has all scopes.
+func (c *ApiController) appByToken(param string, scope string) (*models.App, *ApiError) {
+	token := c.requestToken(param)
+	if token == "" {
+		return nil, NewApiError(http.StatusUnauthorized, ApiErrorCodeInvalidToken, "Token is invalid.")
+	}
+
+	apiToken, err := models.GetApiTokenByToken(Dbm, token)
+	if err == models.ErrApiTokenExpired {
+		return nil, NewApiError(http.StatusUnauthorized, ApiErrorCodeInvalidToken, "Token is expired.")
+	}
+	if err == sql.ErrNoRows {
+		// the deprecated project API token
+		if len(models.ProjectApiTokenScopes) == 0 {
+			return nil, NewApiError(http.StatusUnauthorized, ApiErrorCodeInvalidToken, "Token is invalid.")
+		}
+		app, err := models.GetAppByApiToken(Dbm, token)
+		if err != nil {
+			return nil, NewApiError(http.StatusUnauthorized, ApiErrorCodeInvalidToken, "Token is invalid.")
+		}
+		if !models.ProjectApiTokenHasScope(scope) {
+			return nil, NewApiError(http.StatusForbidden, ApiErrorCodeForbidden, fmt.Sprintf("The project API token doesn't have the %s scope. Use a named token instead.", scope))
+		}
+		return app, nil
+	}
 	if err != nil {
-		c.Response.Status = http.StatusUnauthorized
-		return c.RenderJson(c.NewJsonResponseListBundle(c.Response.Status, []string{"Token is invalid."}, nil))
+		return nil, NewInternalApiError(err)
 	}
 
-	bundles, totalCount, err := app.BundlesWithPager(Dbm, page, Conf.PagerDefaultLimit)
+	if !apiToken.HasScope(scope) {
+		return nil, NewApiError(http.StatusForbidden, ApiErrorCodeForbidden, fmt.Sprintf("Token doesn't have the %s scope.", scope))
+	}
+	if err := apiToken.Touch(Dbm); err != nil {
+		return nil, NewInternalApiError(err)
+	}
+
+	app, err := models.GetApp(Dbm, apiToken.AppId)
 	if err != nil {
-		c.Response.Status = http.StatusInternalServerError
-		return c.RenderJson(c.NewJsonResponseListBundle(c.Response.Status, []string{err.Error()}, nil))
+		return nil, NewInternalApiError(err)
 	}
+	return app, nil
+}
+
+// an apiClient is the client authenticated by the API token.
+// It is either the app of an app token, or the user of a personal access token.
+type apiClient struct {
+	App  *models.App
+	User *models.User
+}
+
+// authenticate returns the client of the token.
+// The scope is checked for app tokens, while personal access tokens act with the authorities of the user.
+// The user is recorded as the actor of the audits.
+func (c *ApiController) authenticate(param string, scope string) (*apiClient, *ApiError) {
+	token := c.requestToken(param)
 
-	bundlesJsonResponse, err := bundles.JsonResponse(&c)
+	personalAccessToken, err := models.GetPersonalAccessTokenByToken(Dbm, token)
+	if err == models.ErrApiTokenExpired {
+		return nil, NewApiError(http.StatusUnauthorized, ApiErrorCodeInvalidToken, "Token is expired.")
+	}
+	if err == sql.ErrNoRows {
+		app, aerr := c.appByToken(param, scope)
+		if aerr != nil {
+			return nil, aerr
+		}
+		return &apiClient{App: app}, nil
+	}
 	if err != nil {
-		c.Response.Status = http.StatusInternalServerError
-		return c.RenderJson(c.NewJsonResponseListBundle(c.Response.Status, []string{err.Error()}, nil))
+		return nil, NewInternalApiError(err)
 	}
 
-	content := &models.BundlesJsonResponse{
-		totalCount,
-		page,
-		Conf.PagerDefaultLimit,
-		bundlesJsonResponse,
+	user, err := models.GetUser(Dbm, personalAccessToken.UserId)
+	if err != nil {
+		return nil, NewInternalApiError(err)
+	}
+	if err := personalAccessToken.Touch(Dbm); err != nil {
+		return nil, NewInternalApiError(err)
 	}
+	c.LoginUserId = user.Id
 
-	c.Response.Status = http.StatusOK
+	return &apiClient{User: user}, nil
+}
 
-	return c.RenderJson(c.NewJsonResponseListBundle(c.Response.Status, []string{"Bundle List"}, content))
+// clientApp returns the app if the client can access it.
+func (c *ApiController) clientApp(client *apiClient, appId int) (*models.App, *ApiError) {
+	if client.App != nil {
+		if client.App.Id != appId {
+			return nil, NewApiError(http.StatusNotFound, ApiErrorCodeNotFound, "App is not found.")
+		}
+		return client.App, nil
+	}
+
+	app, err := models.GetApp(Dbm, appId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, NewApiError(http.StatusNotFound, ApiErrorCodeNotFound, "App is not found.")
+		}
+		return nil, NewInternalApiError(err)
+	}
+
+	permitted, err := client.User.CanAccessApp(Dbm, app)
+	if err != nil {
+		return nil, NewInternalApiError(err)
+	}
+	if !permitted {
+		return nil, NewApiError(http.StatusNotFound, ApiErrorCodeNotFound, "App is not found.")
+	}
+	return app, nil
+}
+
+// audit records the operation if the client is a user.
+func (c *ApiController) audit(resource int, resourceId int, action int) *ApiError {
+	if c.LoginUserId == 0 {
+		return nil
+	}
+	if err := c.createAudit(resource, resourceId, action); err != nil {
+		return NewInternalApiError(err)
+	}
+	return nil
+}
+
+func (c *ApiController) validationError() *ApiError {
+	if !c.Validation.HasErrors() {
+		return nil
+	}
+
+	aerr := NewApiError(http.StatusBadRequest, ApiErrorCodeValidationFailed, "Parameters are invalid.")
+	for _, err := range c.Validation.Errors {
+		aerr.Details = append(aerr.Details, err.String())
+	}
+	return aerr
+}
+
+// uploadedFileName returns the name of the file uploaded as the param, or empty if it is not uploaded.
+func (c *ApiController) uploadedFileName(param string) string {
+	if _, ok := c.Params.Files[param]; ok {
+		return c.Params.Files[param][0].Filename
+	}
+	return ""
+}
+
+// createBundle uploads the file as a bundle of the app, and returns the messages for the client.
+// The filename is used to detect the platform by the extension.
+// The existing bundle is returned with created false if the file is deduplicated.
+func (c *ApiController) createBundle(app *models.App, filename string, description string, version string, file *os.File) (bundle *models.Bundle, created bool, messages []string, aerr *ApiError) {
+	c.Validation.Required(file != nil).Message("File is required.")
+	bundle, aerr = c.requestBundle(filename, description, version)
+	if aerr != nil {
+		return nil, false, nil, aerr
+	}
+	bundle.File = file
+
+	return c.saveBundle(app, bundle)
+}
+
+// an idempotentBundleResponse is the result of creating a bundle remembered with the idempotency key.
+type idempotentBundleResponse struct {
+	Bundle   *models.BundleJsonResponse `json:"bundle"`
+	Created  bool                       `json:"created"`
+	Messages []string                   `json:"messages"`
+}
+
+// createBundleIdempotently creates the bundle as createBundle, and returns the JSON response of it.
+// If the request has the Idempotency-Key header, the result is remembered with the key in the window,
+// and the retried request gets the same result without creating the bundle again.
+// The key used by a request of other parameters or another file is rejected.
+func (c *ApiController) createBundleIdempotently(app *models.App, filename string, description string, version string, file *os.File) (*models.BundleJsonResponse, bool, []string, *ApiError) {
+	key := c.Request.Header.Get("Idempotency-Key")
+	if key == "" {
+		return c.createBundleJson(app, filename, description, version, file)
+	}
+
+	c.Validation.Required(len(key) <= models.MaxIdempotencyKeyLength).Message(fmt.Sprintf("Idempotency-Key must be at most %d characters.", models.MaxIdempotencyKeyLength))
+	if aerr := c.validationError(); aerr != nil {
+		return nil, false, nil, aerr
+	}
+
+	fingerprint, err := c.requestFingerprint(file)
+	if err != nil {
+		return nil, false, nil, NewInternalApiError(err)
+	}
+
+	idempotencyKey, reserved, err := models.ReserveIdempotencyKey(Dbm, app.Id, key, fingerprint)
+	if err != nil {
+		return nil, false, nil, NewInternalApiError(err)
+	}
+	if !reserved {
+		if idempotencyKey.Fingerprint != fingerprint {
+			return nil, false, nil, NewApiError(http.StatusUnprocessableEntity, ApiErrorCodeIdempotencyKeyReused, "Idempotency-Key is already used for another request.")
+		}
+		if !idempotencyKey.Completed {
+			return nil, false, nil, NewApiError(http.StatusConflict, ApiErrorCodeIdempotencyKeyInProgress, "The request of the Idempotency-Key is in progress.")
+		}
+
+		var response idempotentBundleResponse
+		if err := json.Unmarshal([]byte(idempotencyKey.Response), &response); err != nil {
+			return nil, false, nil, NewInternalApiError(err)
+		}
+		c.Response.Out.Header().Set("Idempotent-Replayed", "true")
+		return response.Bundle, response.Created, response.Messages, nil
+	}
+
+	// the key is released if the bundle isn't created, so the client can retry it
+	bundleCreated := false
+	defer func() {
+		if bundleCreated {
+			return
+		}
+		if err := idempotencyKey.Release(Dbm); err != nil {
+			revel.ERROR.Printf("failed to release the idempotency key %d: %s", idempotencyKey.Id, err)
+		}
+	}()
+
+	content, created, messages, aerr := c.createBundleJson(app, filename, description, version, file)
+	if aerr != nil {
+		return nil, false, nil, aerr
+	}
+	bundleCreated = true
+
+	// the key is left pending if the response can't be stored, so the retry gets a conflict instead of another bundle
+	response, err := json.Marshal(&idempotentBundleResponse{content, created, messages})
+	if err != nil {
+		revel.ERROR.Printf("failed to complete the idempotency key %d: %s", idempotencyKey.Id, err)
+	} else if err := idempotencyKey.Complete(Dbm, string(response)); err != nil {
+		revel.ERROR.Printf("failed to complete the idempotency key %d: %s", idempotencyKey.Id, err)
+	}
+	return content, created, messages, nil
+}
+
+// createBundleJson creates the bundle as createBundle, and returns the JSON response of it.
+func (c *ApiController) createBundleJson(app *models.App, filename string, description string, version string, file *os.File) (*models.BundleJsonResponse, bool, []string, *ApiError) {
+	bundle, created, messages, aerr := c.createBundle(app, filename, description, version, file)
+	if aerr != nil {
+		return nil, false, nil, aerr
+	}
+
+	content, err := bundle.JsonResponse(c)
+	if err != nil {
+		return nil, false, nil, NewInternalApiError(err)
+	}
+	return content, created, messages, nil
+}
+
+// requestFingerprint returns the hash of the parameters except the token and the file,
+// which tells whether the requests with the same idempotency key are the same.
+func (c *ApiController) requestFingerprint(file *os.File) (string, error) {
+	params := map[string][]string{}
+	for name, values := range c.Params.Values {
+		if name != "token" {
+			params[name] = values
+		}
+	}
+	// the keys of maps are sorted by encoding/json
+	b, err := json.Marshal(params)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	h.Write(b)
+	if file != nil {
+		fileSha256, err := models.FileSha256(file)
+		if err != nil {
+			return "", err
+		}
+		h.Write([]byte(fileSha256))
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// requestBundle returns the bundle to create with the parameters except the file.
+func (c *ApiController) requestBundle(filename string, description string, version string) (*models.Bundle, *ApiError) {
+	ext := models.NewBundleFileExtension(filename)
+	isValidExt := ext.IsValid()
+
+	c.Validation.Required(isValidExt).Message("File extension is not valid.")
+	if ext.PlatformType().UserSuppliedVersion() {
+		c.Validation.Required(version).Message("version is required for the file.")
+	}
+	if aerr := c.validationError(); aerr != nil {
+		return nil, aerr
+	}
+
+	build := c.requestBuild()
+	metadata := c.requestMetadata()
+	if aerr := c.validationError(); aerr != nil {
+		return nil, aerr
+	}
+
+	return &models.Bundle{
+		PlatformType:  ext.PlatformType(),
+		BundleVersion: version,
+		Description:   description,
+		FileExtension: ext,
+		Build:         build,
+		Metadata:      metadata,
+	}, nil
+}
+
+// saveBundle creates the bundle with the file, and returns the messages for the client.
+func (c *ApiController) saveBundle(app *models.App, bundle *models.Bundle) (*models.Bundle, bool, []string, *ApiError) {
+	// the file is uploaded to Google Drive after responding if async is given
+	async, _ := strconv.ParseBool(c.Params.Get("async"))
+	bundle, created, messages, aerr := createBundleWith(c.GoogleService, app, bundle, async)
+	if aerr != nil || !created {
+		return bundle, created, messages, aerr
+	}
+
+	c.notifyNewPermissions(app, bundle)
+
+	if aerr := c.audit(models.ResourceBundle, bundle.Id, models.ActionCreate); aerr != nil {
+		return nil, false, nil, aerr
+	}
+
+	if err := loadBundleAttributes(bundle); err != nil {
+		return nil, false, nil, NewInternalApiError(err)
+	}
+	return bundle, true, createdBundleMessages(bundle), nil
+}
+
+// createBundleWith creates the bundle with the service, and converts the errors to the API errors.
+// It returns the existing bundle and the messages without creating a bundle if the duplicate is deduplicated.
+func createBundleWith(s *models.GoogleService, app *models.App, bundle *models.Bundle, async bool) (*models.Bundle, bool, []string, *ApiError) {
+	create := app.CreateBundle
+	if async {
+		create = app.CreateBundleInBackground
+	}
+
+	if err := create(Dbm, s, bundle); err != nil {
+		switch err := err.(type) {
+		case *models.BundleDuplicateError:
+			if err.Rejected {
+				return nil, false, nil, NewApiError(http.StatusConflict, ApiErrorCodeDuplicateBundle, err.Error())
+			}
+			return err.Existing, false, []string{"Bundle already exists.", err.Error()}, nil
+		case *models.BundleParseError:
+			return nil, false, nil, NewApiError(http.StatusUnprocessableEntity, ApiErrorCodeBundleParseError, err.Error())
+		case *models.BundleIdentifierMismatchError:
+			return nil, false, nil, NewApiError(http.StatusBadRequest, ApiErrorCodeIdentifierMismatch, err.Error())
+		case *models.BundleScanRejectedError:
+			return nil, false, nil, NewApiError(http.StatusBadRequest, ApiErrorCodeScanRejected, err.Error())
+		}
+		return nil, false, nil, NewInternalApiError(err)
+	}
+	return bundle, true, nil, nil
+}
+
+// createdBundleMessages returns the messages for the client about the created bundle.
+func createdBundleMessages(bundle *models.Bundle) []string {
+	messages := []string{"Bundle is created!"}
+	if bundle.Status == models.BundleStatusUploading {
+		messages = []string{"Bundle is created, and the file is being uploaded."}
+	}
+	for _, finding := range bundle.Findings {
+		messages = append(messages, "Warning: "+finding.String())
+	}
+	return messages
+}
+
+// bundleByFileId returns the bundle of the app which has the file id.
+func (c *ApiController) bundleByFileId(app *models.App, fileId string) (*models.Bundle, *ApiError) {
+	bundle, err := models.GetBundleByFileId(Dbm, fileId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, NewApiError(http.StatusNotFound, ApiErrorCodeNotFound, "Bundle is not found.")
+		}
+		return nil, NewInternalApiError(err)
+	}
+	if bundle.AppId != app.Id {
+		return nil, NewApiError(http.StatusNotFound, ApiErrorCodeNotFound, "Bundle is not found.")
+	}
+	return bundle, nil
+}
+
+// requestMetadata returns the metadata given as metadata[key].
+func (c *ApiController) requestMetadata() map[string]string {
+	metadata := map[string]string{}
+	for name, values := range c.Params.Values {
+		if !strings.HasPrefix(name, "metadata[") || !strings.HasSuffix(name, "]") || len(values) == 0 {
+			continue
+		}
+		key := name[len("metadata[") : len(name)-1]
+		c.Validation.Required(models.IsValidBundleMetadataKey(key)).Message(fmt.Sprintf("metadata key %q is invalid.", key))
+		metadata[key] = values[0]
+	}
+	return metadata
+}
+
+// requestBuild returns the CI context given as the parameters.
+func (c *ApiController) requestBuild() *models.BundleBuild {
+	build := &models.BundleBuild{
+		CommitSha:   c.Params.Get("commit_sha"),
+		Branch:      c.Params.Get("branch"),
+		BuildNumber: c.Params.Get("build_number"),
+		JobUrl:      c.Params.Get("job_url"),
+	}
+	if build.JobUrl != "" {
+		c.Validation.Required(isHttpUrl(build.JobUrl)).Message("job_url is invalid.")
+	}
+	return build
+}
+
+func isHttpUrl(str string) bool {
+	u, err := url.Parse(str)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// loadBundleAttributes loads the metadata and the CI context of the bundle for the JSON response.
+func loadBundleAttributes(bundle *models.Bundle) error {
+	if err := bundle.LoadMetadata(Dbm); err != nil {
+		return err
+	}
+	return bundle.LoadBuild(Dbm)
+}
+
+// updateBundle updates the description and the metadata of the bundle given as the parameters.
+// The description is kept unless it is given, and each metadata is given as metadata[key].
+func (c *ApiController) updateBundle(bundle *models.Bundle) *ApiError {
+	metadata := c.requestMetadata()
+	if aerr := c.validationError(); aerr != nil {
+		return aerr
+	}
+
+	if values, ok := c.Params.Values["description"]; ok && len(values) > 0 {
+		bundle.Description = values[0]
+	}
+
+	err := Transact(func(txn gorp.SqlExecutor) error {
+		if err := bundle.Update(txn); err != nil {
+			return err
+		}
+		return bundle.UpdateMetadata(txn, metadata)
+	})
+	if err != nil {
+		return NewInternalApiError(err)
+	}
+
+	if err := loadBundleAttributes(bundle); err != nil {
+		return NewInternalApiError(err)
+	}
+
+	return c.audit(models.ResourceBundle, bundle.Id, models.ActionUpdate)
+}
+
+func (c *ApiController) deleteBundle(bundle *models.Bundle) *ApiError {
+	err := Transact(func(txn gorp.SqlExecutor) error {
+		return bundle.Delete(txn, c.GoogleService)
+	})
+	if err != nil {
+		return NewInternalApiError(err)
+	}
+
+	return c.audit(models.ResourceBundle, bundle.Id, models.ActionDelete)
+}
+
+// bundleQuery returns the query to list bundles given as the parameters.
+func (c *ApiController) bundleQuery(page int) (*models.BundleQuery, *ApiError) {
+	if page < 1 {
+		page = 1
+	}
+	query := &models.BundleQuery{
+		Version:     c.Params.Get("version"),
+		Identifier:  c.Params.Get("identifier"),
+		Channel:     c.Params.Get("channel"),
+		CommitSha:   c.Params.Get("commit_sha"),
+		Branch:      c.Params.Get("branch"),
+		BuildNumber: c.Params.Get("build_number"),
+		Search:      c.Params.Get("q"),
+		Cursor:      c.Params.Get("cursor"),
+		Page:        page,
+		Limit:       Conf.PagerDefaultLimit,
+	}
+
+	if name := c.Params.Get("platform"); name != "" {
+		platform := models.BundlePlatformByName(name)
+		c.Validation.Required(platform != nil).Message("platform is invalid.")
+		if platform != nil {
+			query.PlatformType = platform.Type
+		}
+	}
+
+	sort, err := models.ParseBundleSort(c.Params.Get("sort"))
+	c.Validation.Required(err == nil).Message("sort is invalid.")
+	query.Sort = sort
+
+	for name, t := range map[string]*time.Time{"since": &query.Since, "until": &query.Until} {
+		if value := c.Params.Get(name); value != "" {
+			parsed, ok := parseQueryTime(value)
+			c.Validation.Required(ok).Message(name + " is invalid.")
+			*t = parsed
+		}
+	}
+
+	if value := c.Params.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		c.Validation.Required(err == nil && limit > 0).Message("limit is invalid.")
+		if limit > Conf.PagerMaxLimit {
+			limit = Conf.PagerMaxLimit
+		}
+		query.Limit = limit
+	}
+
+	if aerr := c.validationError(); aerr != nil {
+		return nil, aerr
+	}
+	return query, nil
+}
+
+// parseQueryTime parses the time in RFC 3339 or the date such as "2006-01-02".
+func parseQueryTime(value string) (time.Time, bool) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func (c *ApiController) listBundles(app *models.App, page int) (*models.BundlesJsonResponse, *ApiError) {
+	query, aerr := c.bundleQuery(page)
+	if aerr != nil {
+		return nil, aerr
+	}
+
+	bundles, totalCount, next, err := app.QueryBundles(Dbm, query)
+	if err != nil {
+		if err == models.ErrInvalidBundleCursor {
+			return nil, NewApiError(http.StatusBadRequest, ApiErrorCodeValidationFailed, "cursor is invalid.")
+		}
+		return nil, NewInternalApiError(err)
+	}
+	for _, bundle := range bundles {
+		if err := loadBundleAttributes(bundle); err != nil {
+			return nil, NewInternalApiError(err)
+		}
+	}
+
+	bundlesJsonResponse, err := bundles.JsonResponse(c)
+	if err != nil {
+		return nil, NewInternalApiError(err)
+	}
+
+	return &models.BundlesJsonResponse{
+		TotalCount: totalCount,
+		Page:       query.Page,
+		Limit:      query.Limit,
+		NextCursor: next,
+		Bundles:    bundlesJsonResponse,
+	}, nil
 }
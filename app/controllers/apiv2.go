@@ -0,0 +1,1184 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.google.com/p/google-api-go-client/drive/v2"
+
+	"github.com/kayac/alphawing/app/models"
+
+	"github.com/coopernurse/gorp"
+	"github.com/revel/revel"
+)
+
+// the machine-readable codes of ApiError
+const (
+	ApiErrorCodeInvalidToken             = "invalid_token"
+	ApiErrorCodeForbidden                = "forbidden"
+	ApiErrorCodeNotFound                 = "not_found"
+	ApiErrorCodeValidationFailed         = "validation_failed"
+	ApiErrorCodeBundleParseError         = "bundle_parse_error"
+	ApiErrorCodeIdentifierMismatch       = "identifier_mismatch"
+	ApiErrorCodeScanRejected             = "scan_rejected"
+	ApiErrorCodeDuplicateBundle          = "duplicate_bundle"
+	ApiErrorCodeRangeNotSatisfiable      = "range_not_satisfiable"
+	ApiErrorCodeUploadIncomplete         = "upload_incomplete"
+	ApiErrorCodeChecksumMismatch         = "checksum_mismatch"
+	ApiErrorCodeUploadFinalizing         = "upload_finalizing"
+	ApiErrorCodeBundleNotReady           = "bundle_not_ready"
+	ApiErrorCodeFetchFailed              = "fetch_failed"
+	ApiErrorCodeIdempotencyKeyReused     = "idempotency_key_reused"
+	ApiErrorCodeIdempotencyKeyInProgress = "idempotency_key_in_progress"
+	ApiErrorCodeInternalError            = "internal_error"
+)
+
+// an ApiError is an error of the API with the HTTP status and the machine-readable code.
+type ApiError struct {
+	Status  int      `json:"-"`
+	Code    string   `json:"code"`
+	Message string   `json:"message"`
+	Details []string `json:"details,omitempty"`
+}
+
+type ApiErrorJsonResponse struct {
+	Error *ApiError `json:"error"`
+}
+
+func NewApiError(status int, code string, message string) *ApiError {
+	return &ApiError{
+		Status:  status,
+		Code:    code,
+		Message: message,
+	}
+}
+
+func NewInternalApiError(err error) *ApiError {
+	return NewApiError(http.StatusInternalServerError, ApiErrorCodeInternalError, err.Error())
+}
+
+func (e *ApiError) Error() string {
+	return e.Message
+}
+
+// Messages returns the messages in the format of the v1 API.
+func (e *ApiError) Messages() []string {
+	if len(e.Details) > 0 {
+		return e.Details
+	}
+	return []string{e.Message}
+}
+
+// an ETagJsonResult renders the JSON with the ETag,
+// or responds 304 Not Modified if the client already has it.
+type ETagJsonResult struct {
+	Body []byte
+}
+
+func NewETagJsonResult(v interface{}) (*ETagJsonResult, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return &ETagJsonResult{Body: body}, nil
+}
+
+func (r *ETagJsonResult) ETag() string {
+	sum := sha256.Sum256(r.Body)
+	return fmt.Sprintf(`"%s"`, hex.EncodeToString(sum[:16]))
+}
+
+func (r *ETagJsonResult) Apply(req *revel.Request, resp *revel.Response) {
+	etag := r.ETag()
+	resp.Out.Header().Set("ETag", etag)
+
+	if req.Header.Get("If-None-Match") == etag {
+		resp.WriteHeader(http.StatusNotModified, "")
+		return
+	}
+
+	resp.WriteHeader(http.StatusOK, "application/json; charset=utf-8")
+	resp.Out.Write(r.Body)
+}
+
+// a BundleDownloadResult responds the file of the bundle verified with the checksum.
+// The Range header of the request is served from the verified file.
+type BundleDownloadResult struct {
+	Bundle    *models.Bundle
+	File      *os.File
+	DriveFile *drive.File
+}
+
+func (r *BundleDownloadResult) Apply(req *revel.Request, resp *revel.Response) {
+	defer r.File.Close()
+
+	modtime, err := time.Parse(time.RFC3339, r.DriveFile.ModifiedDate)
+	if err != nil {
+		modtime = r.Bundle.CreatedAt
+	}
+
+	header := resp.Out.Header()
+	header.Set("Content-Disposition", attachmentContentDisposition(r.DriveFile.OriginalFilename))
+	header.Set("Content-Type", r.Bundle.PlatformType.ContentType())
+	if r.Bundle.Sha256 != "" {
+		header.Set("X-Checksum-Sha256", r.Bundle.Sha256)
+		if sum, err := hex.DecodeString(r.Bundle.Sha256); err == nil {
+			header.Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(sum))
+		}
+	}
+
+	http.ServeContent(resp.Out, req.Request, r.DriveFile.OriginalFilename, modtime, r.File)
+}
+
+// attachmentContentDisposition returns the Content-Disposition of the file name.
+// The name is given as filename* of RFC 5987, and as filename with the characters other than printable ASCII replaced.
+func attachmentContentDisposition(name string) string {
+	fallback := strings.Map(func(r rune) rune {
+		if r < 0x20 || r >= 0x7f || r == '"' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, name)
+
+	var encoded []byte
+	for i := 0; i < len(name); i++ {
+		b := name[i]
+		if 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9' || strings.IndexByte("!#$&+-.^_`|~", b) >= 0 {
+			encoded = append(encoded, b)
+		} else {
+			encoded = append(encoded, fmt.Sprintf("%%%02X", b)...)
+		}
+	}
+
+	return fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`, fallback, encoded)
+}
+
+// isRangeSatisfiable returns false if no range of the Range header overlaps the file of the size.
+// It is checked before http.ServeContent to respond the error as JSON.
+func isRangeSatisfiable(byteRange string, size int64) bool {
+	if byteRange == "" {
+		return true
+	}
+	if !strings.HasPrefix(byteRange, "bytes=") {
+		return false
+	}
+	for _, spec := range strings.Split(byteRange[len("bytes="):], ",") {
+		spec = strings.TrimSpace(spec)
+		i := strings.Index(spec, "-")
+		if i < 0 {
+			return false
+		}
+		start, end := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+		if start == "" {
+			// the suffix of the length
+			n, err := strconv.ParseInt(end, 10, 64)
+			if err != nil || n < 0 {
+				return false
+			}
+			if n > 0 && size > 0 {
+				return true
+			}
+			continue
+		}
+		first, err := strconv.ParseInt(start, 10, 64)
+		if err != nil || first < 0 {
+			return false
+		}
+		if end != "" {
+			last, err := strconv.ParseInt(end, 10, 64)
+			if err != nil || last < first {
+				return false
+			}
+		}
+		if first < size {
+			return true
+		}
+	}
+	return false
+}
+
+type ApiV2Controller struct {
+	ApiController
+}
+
+type AppsJsonResponse struct {
+	Apps []*models.AppJsonResponse `json:"apps"`
+}
+
+// a LatestBundlesJsonResponse has the latest bundle of each platform by the platform name.
+type LatestBundlesJsonResponse struct {
+	Bundles map[string]*models.BundleJsonResponse `json:"bundles"`
+}
+
+type TestersJsonResponse struct {
+	Testers []*models.TesterJsonResponse `json:"testers"`
+}
+
+// the statuses of TesterResultJsonResponse
+const (
+	TesterResultAdded             = "added"
+	TesterResultRemoved           = "removed"
+	TesterResultAlreadyRegistered = "already_registered"
+	TesterResultNotFound          = "not_found"
+	TesterResultInvalidEmail      = "invalid_email"
+	TesterResultFailed            = "failed"
+)
+
+// a TesterResultJsonResponse is the result of adding or removing the tester of the email.
+type TesterResultJsonResponse struct {
+	Email   string                     `json:"email"`
+	Status  string                     `json:"status"`
+	Tester  *models.TesterJsonResponse `json:"tester,omitempty"`
+	Message string                     `json:"message,omitempty"`
+}
+
+type TesterResultsJsonResponse struct {
+	Results []*TesterResultJsonResponse `json:"results"`
+}
+
+type BundleCreatedJsonResponse struct {
+	Bundle   *models.BundleJsonResponse `json:"bundle"`
+	Messages []string                   `json:"messages"`
+}
+
+func (c *ApiV2Controller) renderError(aerr *ApiError) revel.Result {
+	c.Response.Status = aerr.Status
+	return c.RenderJson(&ApiErrorJsonResponse{aerr})
+}
+
+// renderResource renders the resource for GET requests with the ETag.
+func (c *ApiV2Controller) renderResource(v interface{}) revel.Result {
+	result, err := NewETagJsonResult(v)
+	if err != nil {
+		return c.renderError(NewInternalApiError(err))
+	}
+	return result
+}
+
+// authenticatedUser returns the user of the personal access token.
+// The app management requires a personal access token.
+func (c *ApiV2Controller) authenticatedUser() (*models.User, *apiClient, *ApiError) {
+	client, aerr := c.authenticate(c.Params.Get("token"), models.ApiTokenScopeRead)
+	if aerr != nil {
+		return nil, nil, aerr
+	}
+	if client.User == nil {
+		return nil, nil, NewApiError(http.StatusForbidden, ApiErrorCodeForbidden, "Personal access token is required.")
+	}
+	return client.User, client, nil
+}
+
+// authorizedApp returns the app if the client can access it with the scope.
+func (c *ApiV2Controller) authorizedApp(appId int, scope string) (*models.App, *ApiError) {
+	client, aerr := c.authenticate(c.Params.Get("token"), scope)
+	if aerr != nil {
+		return nil, aerr
+	}
+	return c.clientApp(client, appId)
+}
+
+// authorizedBundle returns the bundle if the client can access it with the scope.
+func (c *ApiV2Controller) authorizedBundle(bundleId int, scope string) (*models.Bundle, *ApiError) {
+	client, aerr := c.authenticate(c.Params.Get("token"), scope)
+	if aerr != nil {
+		return nil, aerr
+	}
+
+	bundle, err := models.GetBundle(Dbm, bundleId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, NewApiError(http.StatusNotFound, ApiErrorCodeNotFound, "Bundle is not found.")
+		}
+		return nil, NewInternalApiError(err)
+	}
+	if _, aerr := c.clientApp(client, bundle.AppId); aerr != nil {
+		if aerr.Code == ApiErrorCodeNotFound {
+			return nil, NewApiError(http.StatusNotFound, ApiErrorCodeNotFound, "Bundle is not found.")
+		}
+		return nil, aerr
+	}
+	return bundle, nil
+}
+
+func (c ApiV2Controller) GetApps() revel.Result {
+	user, _, aerr := c.authenticatedUser()
+	if aerr != nil {
+		return c.renderError(aerr)
+	}
+
+	apps, err := user.Apps(Dbm)
+	if err != nil {
+		return c.renderError(NewInternalApiError(err))
+	}
+
+	content := []*models.AppJsonResponse{}
+	for _, app := range apps {
+		content = append(content, app.JsonResponse())
+	}
+
+	return c.renderResource(&AppsJsonResponse{content})
+}
+
+func (c ApiV2Controller) PostApp(title string, description string) revel.Result {
+	user, _, aerr := c.authenticatedUser()
+	if aerr != nil {
+		return c.renderError(aerr)
+	}
+
+	c.Validation.Required(title).Message("title is required.")
+	if aerr := c.validationError(); aerr != nil {
+		return c.renderError(aerr)
+	}
+
+	app := &models.App{
+		Title:       title,
+		Description: description,
+	}
+	err := Transact(func(txn gorp.SqlExecutor) error {
+		if err := models.CreateApp(txn, c.GoogleService, app); err != nil {
+			return err
+		}
+
+		authority := &models.Authority{
+			Email: user.Email,
+		}
+		return app.CreateAuthority(txn, c.GoogleService, authority)
+	})
+	if err != nil {
+		return c.renderError(NewInternalApiError(err))
+	}
+
+	if aerr := c.audit(models.ResourceApp, app.Id, models.ActionCreate); aerr != nil {
+		return c.renderError(aerr)
+	}
+
+	c.Response.Status = http.StatusCreated
+	return c.RenderJson(app.JsonResponse())
+}
+
+// PutApp updates the app with the given parameters.
+// The parameters not given are kept.
+func (c ApiV2Controller) PutApp(appId int) revel.Result {
+	_, client, aerr := c.authenticatedUser()
+	if aerr != nil {
+		return c.renderError(aerr)
+	}
+
+	app, aerr := c.clientApp(client, appId)
+	if aerr != nil {
+		return c.renderError(aerr)
+	}
+	title := app.Title
+
+	fields := map[string]*string{
+		"title":                   &app.Title,
+		"description":             &app.Description,
+		"android_identifier":      &app.AndroidIdentifier,
+		"ios_identifier":          &app.IOSIdentifier,
+		"repository_url_template": &app.RepositoryUrlTemplate,
+	}
+	for name, field := range fields {
+		if values, ok := c.Params.Values[name]; ok && len(values) > 0 {
+			*field = values[0]
+		}
+	}
+
+	c.Validation.Required(app.Title).Message("title is required.")
+	c.Validation.Required(models.IsValidRepositoryUrlTemplate(app.RepositoryUrlTemplate)).Message("repository_url_template must be an http or https URL.")
+	if aerr := c.validationError(); aerr != nil {
+		return c.renderError(aerr)
+	}
+
+	err := Transact(func(txn gorp.SqlExecutor) error {
+		return app.Update(txn)
+	})
+	if err != nil {
+		return c.renderError(NewInternalApiError(err))
+	}
+
+	if app.Title != title {
+		if err := c.GoogleService.UpdateFileTitle(app.FileId, app.Title); err != nil {
+			return c.renderError(NewInternalApiError(err))
+		}
+	}
+
+	if aerr := c.audit(models.ResourceApp, app.Id, models.ActionUpdate); aerr != nil {
+		return c.renderError(aerr)
+	}
+
+	app, err = models.GetApp(Dbm, app.Id)
+	if err != nil {
+		return c.renderError(NewInternalApiError(err))
+	}
+
+	return c.RenderJson(app.JsonResponse())
+}
+
+func (c ApiV2Controller) DeleteApp(appId int) revel.Result {
+	_, client, aerr := c.authenticatedUser()
+	if aerr != nil {
+		return c.renderError(aerr)
+	}
+
+	app, aerr := c.clientApp(client, appId)
+	if aerr != nil {
+		return c.renderError(aerr)
+	}
+
+	err := Transact(func(txn gorp.SqlExecutor) error {
+		return app.Delete(txn, c.GoogleService)
+	})
+	if err != nil {
+		return c.renderError(NewInternalApiError(err))
+	}
+
+	if aerr := c.audit(models.ResourceApp, app.Id, models.ActionDelete); aerr != nil {
+		return c.renderError(aerr)
+	}
+
+	c.Response.Status = http.StatusNoContent
+	return c.RenderText("")
+}
+
+func (c ApiV2Controller) GetApp(appId int) revel.Result {
+	app, aerr := c.authorizedApp(appId, models.ApiTokenScopeRead)
+	if aerr != nil {
+		return c.renderError(aerr)
+	}
+
+	return c.renderResource(app.JsonResponse())
+}
+
+func (c ApiV2Controller) GetBundles(appId int, page int) revel.Result {
+	app, aerr := c.authorizedApp(appId, models.ApiTokenScopeRead)
+	if aerr != nil {
+		return c.renderError(aerr)
+	}
+
+	content, aerr := c.listBundles(app, page)
+	if aerr != nil {
+		return c.renderError(aerr)
+	}
+
+	return c.renderResource(content)
+}
+
+func (c ApiV2Controller) GetLatestBundles(appId int) revel.Result {
+	app, aerr := c.authorizedApp(appId, models.ApiTokenScopeRead)
+	if aerr != nil {
+		return c.renderError(aerr)
+	}
+
+	bundles, err := app.LatestBundles(Dbm)
+	if err != nil {
+		return c.renderError(NewInternalApiError(err))
+	}
+
+	content := map[string]*models.BundleJsonResponse{}
+	for _, bundle := range bundles {
+		if err := loadBundleAttributes(bundle); err != nil {
+			return c.renderError(NewInternalApiError(err))
+		}
+		bundleJsonResponse, err := bundle.JsonResponse(&c)
+		if err != nil {
+			return c.renderError(NewInternalApiError(err))
+		}
+		content[bundle.PlatformType.String()] = bundleJsonResponse
+	}
+
+	return c.renderResource(&LatestBundlesJsonResponse{content})
+}
+
+func (c ApiV2Controller) PostBundle(appId int, description string, version string, file *os.File) revel.Result {
+	app, aerr := c.authorizedApp(appId, models.ApiTokenScopeUpload)
+	if aerr != nil {
+		return c.renderError(aerr)
+	}
+
+	content, created, messages, aerr := c.createBundleIdempotently(app, c.uploadedFileName("file"), description, version, file)
+	if aerr != nil {
+		return c.renderError(aerr)
+	}
+
+	return c.renderCreatedBundle(content, created, messages)
+}
+
+// renderCreatedBundle renders the bundle with 201, or 200 if the existing bundle is returned.
+// It is 202 if the file is being uploaded in the background.
+func (c *ApiV2Controller) renderCreatedBundle(content *models.BundleJsonResponse, created bool, messages []string) revel.Result {
+	c.Response.Status = http.StatusOK
+	if created {
+		c.Response.Status = http.StatusCreated
+		if content.Status == models.BundleStatusUploading.String() {
+			c.Response.Status = http.StatusAccepted
+		}
+	}
+	return c.RenderJson(&BundleCreatedJsonResponse{content, messages})
+}
+
+func (c ApiV2Controller) GetBundle(bundleId int) revel.Result {
+	bundle, aerr := c.authorizedBundle(bundleId, models.ApiTokenScopeRead)
+	if aerr != nil {
+		return c.renderError(aerr)
+	}
+
+	if err := loadBundleAttributes(bundle); err != nil {
+		return c.renderError(NewInternalApiError(err))
+	}
+
+	content, err := bundle.JsonResponse(&c)
+	if err != nil {
+		return c.renderError(NewInternalApiError(err))
+	}
+
+	return c.renderResource(content)
+}
+
+// PutBundle updates the description and the metadata of the bundle.
+func (c ApiV2Controller) PutBundle(bundleId int) revel.Result {
+	bundle, aerr := c.authorizedBundle(bundleId, models.ApiTokenScopeUpload)
+	if aerr != nil {
+		return c.renderError(aerr)
+	}
+
+	if aerr := c.updateBundle(bundle); aerr != nil {
+		return c.renderError(aerr)
+	}
+
+	content, err := bundle.JsonResponse(&c)
+	if err != nil {
+		return c.renderError(NewInternalApiError(err))
+	}
+
+	return c.RenderJson(content)
+}
+
+func (c ApiV2Controller) DeleteBundle(bundleId int) revel.Result {
+	bundle, aerr := c.authorizedBundle(bundleId, models.ApiTokenScopeDelete)
+	if aerr != nil {
+		return c.renderError(aerr)
+	}
+
+	if aerr := c.deleteBundle(bundle); aerr != nil {
+		return c.renderError(aerr)
+	}
+
+	c.Response.Status = http.StatusNoContent
+	return c.RenderText("")
+}
+
+// downloadBundle responds the file of the bundle for the Range header of the request.
+func (c *ApiV2Controller) downloadBundle(bundle *models.Bundle) revel.Result {
+	if !bundle.IsReady() {
+		return c.renderError(NewApiError(http.StatusConflict, ApiErrorCodeBundleNotReady, fmt.Sprintf("The file of the bundle is %s.", bundle.Status)))
+	}
+
+	file, driveFile, err := bundle.OpenFile(c.GoogleService)
+	if err != nil {
+		return c.renderError(NewInternalApiError(err))
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return c.renderError(NewInternalApiError(err))
+	}
+	if !isRangeSatisfiable(c.Request.Header.Get("Range"), info.Size()) {
+		file.Close()
+		return c.renderError(NewApiError(http.StatusRequestedRangeNotSatisfiable, ApiErrorCodeRangeNotSatisfiable, "Range is not satisfiable."))
+	}
+
+	if aerr := c.audit(models.ResourceBundle, bundle.Id, models.ActionDownload); aerr != nil {
+		file.Close()
+		return c.renderError(aerr)
+	}
+
+	return &BundleDownloadResult{
+		Bundle:    bundle,
+		File:      file,
+		DriveFile: driveFile,
+	}
+}
+
+func (c ApiV2Controller) GetBundleFile(bundleId int) revel.Result {
+	bundle, aerr := c.authorizedBundle(bundleId, models.ApiTokenScopeRead)
+	if aerr != nil {
+		return c.renderError(aerr)
+	}
+
+	return c.downloadBundle(bundle)
+}
+
+// GetAppFile downloads the bundle of the file id, or the latest bundle of the platform in the channel.
+func (c ApiV2Controller) GetAppFile(appId int, file_id string, platform string, channel string) revel.Result {
+	app, aerr := c.authorizedApp(appId, models.ApiTokenScopeRead)
+	if aerr != nil {
+		return c.renderError(aerr)
+	}
+
+	c.Validation.Required(file_id != "" || platform != "").Message("file_id or platform is required.")
+	if platform != "" {
+		c.Validation.Required(models.BundlePlatformByName(platform) != nil).Message("platform is invalid.")
+	}
+	if aerr := c.validationError(); aerr != nil {
+		return c.renderError(aerr)
+	}
+
+	if file_id != "" {
+		bundle, aerr := c.bundleByFileId(app, file_id)
+		if aerr != nil {
+			return c.renderError(aerr)
+		}
+		return c.downloadBundle(bundle)
+	}
+
+	bundle, err := app.LatestBundleInChannel(Dbm, models.BundlePlatformByName(platform).Type, channel)
+	if err != nil {
+		return c.renderError(NewInternalApiError(err))
+	}
+	if bundle == nil {
+		return c.renderError(NewApiError(http.StatusNotFound, ApiErrorCodeNotFound, "Bundle is not found."))
+	}
+	return c.downloadBundle(bundle)
+}
+
+func (c ApiV2Controller) GetTesters(appId int) revel.Result {
+	app, aerr := c.authorizedApp(appId, models.ApiTokenScopeRead)
+	if aerr != nil {
+		return c.renderError(aerr)
+	}
+
+	authorities, err := app.Authorities(Dbm)
+	if err != nil {
+		return c.renderError(NewInternalApiError(err))
+	}
+
+	testers := []*models.TesterJsonResponse{}
+	for _, authority := range authorities {
+		testers = append(testers, authority.JsonResponse())
+	}
+
+	return c.renderResource(&TestersJsonResponse{testers})
+}
+
+// requestEmails returns the emails given as email or emails[].
+func (c *ApiV2Controller) requestEmails() []string {
+	var emails []string
+	for _, name := range []string{"email", "emails[]"} {
+		for _, email := range c.Params.Values[name] {
+			if email = strings.TrimSpace(email); email != "" {
+				emails = append(emails, email)
+			}
+		}
+	}
+	return emails
+}
+
+// PostTesters adds the testers of the emails.
+// The result of each email is responded, and an email failed doesn't stop the others.
+func (c ApiV2Controller) PostTesters(appId int) revel.Result {
+	app, aerr := c.authorizedApp(appId, models.ApiTokenScopeTester)
+	if aerr != nil {
+		return c.renderError(aerr)
+	}
+
+	emails := c.requestEmails()
+	c.Validation.Required(len(emails) > 0).Message("email is required.")
+	if aerr := c.validationError(); aerr != nil {
+		return c.renderError(aerr)
+	}
+
+	results := []*TesterResultJsonResponse{}
+	for _, email := range emails {
+		result := &TesterResultJsonResponse{Email: email}
+		results = append(results, result)
+
+		if !revel.ValidEmail().IsSatisfied(email) {
+			result.Status = TesterResultInvalidEmail
+			continue
+		}
+
+		found, err := app.HasAuthorityForEmail(Dbm, email)
+		if err != nil {
+			result.Status, result.Message = TesterResultFailed, err.Error()
+			continue
+		}
+		if found {
+			result.Status = TesterResultAlreadyRegistered
+			continue
+		}
+
+		authority := &models.Authority{
+			Email: email,
+		}
+		err = Transact(func(txn gorp.SqlExecutor) error {
+			return app.CreateAuthority(txn, c.GoogleService, authority)
+		})
+		if err != nil {
+			result.Status, result.Message = TesterResultFailed, err.Error()
+			continue
+		}
+		if aerr := c.audit(models.ResourceAuthority, authority.Id, models.ActionCreate); aerr != nil {
+			return c.renderError(aerr)
+		}
+
+		result.Status = TesterResultAdded
+		result.Tester = authority.JsonResponse()
+	}
+
+	return c.RenderJson(&TesterResultsJsonResponse{results})
+}
+
+// DeleteTesters removes the testers of the emails.
+// The result of each email is responded, and an email failed doesn't stop the others.
+func (c ApiV2Controller) DeleteTesters(appId int) revel.Result {
+	app, aerr := c.authorizedApp(appId, models.ApiTokenScopeTester)
+	if aerr != nil {
+		return c.renderError(aerr)
+	}
+
+	emails := c.requestEmails()
+	c.Validation.Required(len(emails) > 0).Message("email is required.")
+	if aerr := c.validationError(); aerr != nil {
+		return c.renderError(aerr)
+	}
+
+	results := []*TesterResultJsonResponse{}
+	for _, email := range emails {
+		result := &TesterResultJsonResponse{Email: email}
+		results = append(results, result)
+
+		authority, err := app.AuthorityForEmail(Dbm, email)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				result.Status = TesterResultNotFound
+			} else {
+				result.Status, result.Message = TesterResultFailed, err.Error()
+			}
+			continue
+		}
+
+		err = Transact(func(txn gorp.SqlExecutor) error {
+			return app.DeleteAuthority(txn, c.GoogleService, authority)
+		})
+		if err != nil {
+			result.Status, result.Message = TesterResultFailed, err.Error()
+			continue
+		}
+		if aerr := c.audit(models.ResourceAuthority, authority.Id, models.ActionDelete); aerr != nil {
+			return c.renderError(aerr)
+		}
+
+		result.Status = TesterResultRemoved
+		result.Tester = authority.JsonResponse()
+	}
+
+	return c.RenderJson(&TesterResultsJsonResponse{results})
+}
+
+func isSha256Hex(str string) bool {
+	_, err := hex.DecodeString(str)
+	return err == nil && len(str) == 64
+}
+
+// authorizedUploadSession returns the upload session and the app if the client can access it with the scope.
+func (c *ApiV2Controller) authorizedUploadSession(uploadId string, scope string) (*models.UploadSession, *models.App, *ApiError) {
+	client, aerr := c.authenticate(c.Params.Get("token"), scope)
+	if aerr != nil {
+		return nil, nil, aerr
+	}
+
+	session, err := models.GetUploadSessionByToken(Dbm, uploadId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil, NewApiError(http.StatusNotFound, ApiErrorCodeNotFound, "Upload session is not found.")
+		}
+		return nil, nil, NewInternalApiError(err)
+	}
+	app, aerr := c.clientApp(client, session.AppId)
+	if aerr != nil {
+		if aerr.Code == ApiErrorCodeNotFound {
+			return nil, nil, NewApiError(http.StatusNotFound, ApiErrorCodeNotFound, "Upload session is not found.")
+		}
+		return nil, nil, aerr
+	}
+	return session, app, nil
+}
+
+func (c *ApiV2Controller) renderUploadSession(session *models.UploadSession) revel.Result {
+	content, err := session.JsonResponse()
+	if err != nil {
+		return c.renderError(NewInternalApiError(err))
+	}
+	return c.RenderJson(content)
+}
+
+// PostUploadSession starts uploading the file in chunks.
+func (c ApiV2Controller) PostUploadSession(appId int, file_name string, file_size int64, chunk_size int64, sha256 string) revel.Result {
+	app, aerr := c.authorizedApp(appId, models.ApiTokenScopeUpload)
+	if aerr != nil {
+		return c.renderError(aerr)
+	}
+
+	if chunk_size == 0 {
+		chunk_size = models.DefaultUploadChunkSize
+	}
+	c.Validation.Required(models.NewBundleFileExtension(file_name).IsValid()).Message("file_name must have a valid extension.")
+	c.Validation.Required(file_size > 0).Message("file_size must be positive.")
+	c.Validation.Required(file_size <= models.MaxUploadFileSize).Message(fmt.Sprintf("file_size must be at most %d.", models.MaxUploadFileSize))
+	c.Validation.Required(models.MinUploadChunkSize <= chunk_size && chunk_size <= models.MaxUploadChunkSize).
+		Message(fmt.Sprintf("chunk_size must be between %d and %d.", models.MinUploadChunkSize, models.MaxUploadChunkSize))
+	if sha256 != "" {
+		c.Validation.Required(isSha256Hex(sha256)).Message("sha256 must be a hex-encoded SHA-256.")
+	}
+	if aerr := c.validationError(); aerr != nil {
+		return c.renderError(aerr)
+	}
+
+	session := models.NewUploadSession(app.Id, file_name, file_size, chunk_size, sha256)
+	if err := session.Save(Dbm); err != nil {
+		return c.renderError(NewInternalApiError(err))
+	}
+
+	c.Response.Status = http.StatusCreated
+	return c.renderUploadSession(session)
+}
+
+func (c ApiV2Controller) GetUploadSession(uploadId string) revel.Result {
+	session, _, aerr := c.authorizedUploadSession(uploadId, models.ApiTokenScopeUpload)
+	if aerr != nil {
+		return c.renderError(aerr)
+	}
+
+	return c.renderUploadSession(session)
+}
+
+// PutUploadChunk stores the request body as the chunk of the index.
+// The chunk can be uploaded again to retry.
+func (c ApiV2Controller) PutUploadChunk(uploadId string, index int) revel.Result {
+	session, _, aerr := c.authorizedUploadSession(uploadId, models.ApiTokenScopeUpload)
+	if aerr != nil {
+		return c.renderError(aerr)
+	}
+	if session.IsFinalizing() {
+		return c.renderError(NewApiError(http.StatusConflict, ApiErrorCodeUploadFinalizing, models.ErrUploadFinalizing.Error()))
+	}
+
+	if err := session.WriteChunk(index, c.Request.Body); err != nil {
+		switch err {
+		case models.ErrUploadChunkIndex:
+			return c.renderError(NewApiError(http.StatusBadRequest, ApiErrorCodeValidationFailed, fmt.Sprintf("index must be between 0 and %d.", session.ChunkCount()-1)))
+		case models.ErrUploadChunkSize:
+			return c.renderError(NewApiError(http.StatusBadRequest, ApiErrorCodeValidationFailed, fmt.Sprintf("The size of chunk %d must be %d bytes.", index, session.ChunkLength(index))))
+		}
+		return c.renderError(NewInternalApiError(err))
+	}
+
+	if err := session.Touch(Dbm); err != nil {
+		return c.renderError(NewInternalApiError(err))
+	}
+
+	return c.renderUploadSession(session)
+}
+
+// PostFinalizeUploadSession creates the bundle from the uploaded chunks.
+// The session is kept until the bundle is created, so the client can retry it with other parameters.
+// The concurrent requests finalizing the same session get upload_finalizing except one.
+func (c ApiV2Controller) PostFinalizeUploadSession(uploadId string, description string, version string) revel.Result {
+	session, app, aerr := c.authorizedUploadSession(uploadId, models.ApiTokenScopeUpload)
+	if aerr != nil {
+		return c.renderError(aerr)
+	}
+
+	// the bundle is already created by the request which failed to delete the session
+	if session.BundleId != 0 {
+		return c.renderFinalizedBundle(session)
+	}
+
+	if err := session.BeginFinalize(Dbm); err != nil {
+		if err == models.ErrUploadFinalizing {
+			return c.renderError(NewApiError(http.StatusConflict, ApiErrorCodeUploadFinalizing, err.Error()))
+		}
+		return c.renderError(NewInternalApiError(err))
+	}
+	created := false
+	defer func() {
+		if created {
+			return
+		}
+		// to retry finalizing after the error
+		if err := session.EndFinalize(Dbm); err != nil {
+			revel.ERROR.Printf("failed to unmark the upload session %d as finalizing: %s", session.Id, err)
+		}
+	}()
+
+	file, err := session.Assemble()
+	if err != nil {
+		switch err {
+		case models.ErrUploadIncomplete:
+			return c.renderError(NewApiError(http.StatusConflict, ApiErrorCodeUploadIncomplete, err.Error()))
+		case models.ErrUploadChecksumMismatch:
+			return c.renderError(NewApiError(http.StatusUnprocessableEntity, ApiErrorCodeChecksumMismatch, err.Error()))
+		}
+		return c.renderError(NewInternalApiError(err))
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	bundle, isNew, messages, aerr := c.createBundle(app, session.FileName, description, version, file)
+	if aerr != nil {
+		return c.renderError(aerr)
+	}
+	created = true
+
+	if err := session.Complete(Dbm, bundle.Id); err != nil {
+		return c.renderError(NewInternalApiError(err))
+	}
+	if err := session.Delete(Dbm); err != nil {
+		return c.renderError(NewInternalApiError(err))
+	}
+
+	content, err := bundle.JsonResponse(&c)
+	if err != nil {
+		return c.renderError(NewInternalApiError(err))
+	}
+
+	return c.renderCreatedBundle(content, isNew, messages)
+}
+
+// renderFinalizedBundle renders the bundle created from the session as the retry of finalizing it.
+func (c *ApiV2Controller) renderFinalizedBundle(session *models.UploadSession) revel.Result {
+	bundle, err := models.GetBundle(Dbm, session.BundleId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.renderError(NewApiError(http.StatusNotFound, ApiErrorCodeNotFound, "Bundle is not found."))
+		}
+		return c.renderError(NewInternalApiError(err))
+	}
+	if err := loadBundleAttributes(bundle); err != nil {
+		return c.renderError(NewInternalApiError(err))
+	}
+
+	content, err := bundle.JsonResponse(c)
+	if err != nil {
+		return c.renderError(NewInternalApiError(err))
+	}
+
+	if err := session.Delete(Dbm); err != nil {
+		revel.ERROR.Printf("failed to delete the upload session %d: %s", session.Id, err)
+	}
+	return c.renderCreatedBundle(content, false, []string{})
+}
+
+// DeleteUploadSession abandons the session and removes the uploaded chunks.
+func (c ApiV2Controller) DeleteUploadSession(uploadId string) revel.Result {
+	session, _, aerr := c.authorizedUploadSession(uploadId, models.ApiTokenScopeUpload)
+	if aerr != nil {
+		return c.renderError(aerr)
+	}
+
+	if err := session.Delete(Dbm); err != nil {
+		return c.renderError(NewInternalApiError(err))
+	}
+
+	c.Response.Status = http.StatusNoContent
+	return c.RenderText("")
+}
+
+var reHeaderName = regexp.MustCompile(`^[A-Za-z0-9\-]+$`)
+
+// requestHeaders returns the headers given as headers[Name] to fetch the file of an upload job.
+func (c *ApiV2Controller) requestHeaders() http.Header {
+	header := http.Header{}
+	for name, values := range c.Params.Values {
+		if !strings.HasPrefix(name, "headers[") || !strings.HasSuffix(name, "]") || len(values) == 0 {
+			continue
+		}
+		key := name[len("headers[") : len(name)-1]
+		c.Validation.Required(reHeaderName.MatchString(key)).Message(fmt.Sprintf("header %q is invalid.", key))
+		header.Set(key, values[0])
+	}
+	return header
+}
+
+// PostUploadJob creates the bundle from the file fetched from the URL in the background.
+// The client polls the job to know the result.
+func (c ApiV2Controller) PostUploadJob(appId int, url string, sha256 string, file_name string, description string, version string) revel.Result {
+	app, aerr := c.authorizedApp(appId, models.ApiTokenScopeUpload)
+	if aerr != nil {
+		return c.renderError(aerr)
+	}
+
+	c.Validation.Required(models.IsAllowedUploadJobUrl(url)).Message("url must be an HTTP(S) URL of a permitted host.")
+	if sha256 != "" {
+		c.Validation.Required(isSha256Hex(sha256)).Message("sha256 must be a hex-encoded SHA-256.")
+	}
+	if file_name == "" {
+		file_name = models.UploadJobFileName(url)
+	}
+	header := c.requestHeaders()
+	bundle, aerr := c.requestBundle(file_name, description, version)
+	if aerr != nil {
+		return c.renderError(aerr)
+	}
+
+	job := models.NewUploadJob(app.Id, url, sha256)
+	if err := job.Save(Dbm); err != nil {
+		return c.renderError(NewInternalApiError(err))
+	}
+
+	baseUrl, err := c.UriFor("")
+	if err != nil {
+		return c.renderError(NewInternalApiError(err))
+	}
+	async, _ := strconv.ParseBool(c.Params.Get("async"))
+	runner := &uploadJobRunner{
+		Job:            job,
+		App:            app,
+		Bundle:         bundle,
+		Header:         header,
+		Async:          async,
+		UserId:         c.LoginUserId,
+		BaseUrl:        baseUrl,
+		ServiceAccount: c.GoogleService.ServiceAccount,
+	}
+	go runner.Run()
+
+	c.Response.Status = http.StatusAccepted
+	return c.RenderJson(job.JsonResponse())
+}
+
+// an uploadJobRunner runs the upload job after responding.
+// It has the values of the request, since the controller and its Google service are not valid after the request.
+type uploadJobRunner struct {
+	Job            *models.UploadJob
+	App            *models.App
+	Bundle         *models.Bundle
+	Header         http.Header
+	Async          bool
+	UserId         int      // the user of the personal access token, or 0
+	BaseUrl        *url.URL // the URL of the site to notify the bundle
+	ServiceAccount *models.ServiceAccountConfig
+}
+
+// Run runs the upload job, and records the error if it fails.
+func (r *uploadJobRunner) Run() {
+	job := r.Job
+	defer func() {
+		if e := recover(); e != nil {
+			revel.ERROR.Printf("upload job %d panicked: %v", job.Id, e)
+			if err := job.Fail(Dbm, ApiErrorCodeInternalError, fmt.Sprint(e)); err != nil {
+				revel.ERROR.Printf("failed to update the upload job %d: %s", job.Id, err)
+			}
+		}
+	}()
+
+	if aerr := r.process(); aerr != nil {
+		if err := job.Fail(Dbm, aerr.Code, aerr.Message); err != nil {
+			revel.ERROR.Printf("failed to update the upload job %d: %s", job.Id, err)
+		}
+	}
+}
+
+// process fetches the file and creates the bundle as uploading it.
+func (r *uploadJobRunner) process() *ApiError {
+	job := r.Job
+	if err := job.UpdateStatus(Dbm, models.UploadJobStatusFetching); err != nil {
+		return NewInternalApiError(err)
+	}
+
+	file, err := job.Fetch(r.Header)
+	if err != nil {
+		if _, ok := err.(*models.FetchError); ok {
+			return NewApiError(http.StatusBadGateway, ApiErrorCodeFetchFailed, err.Error())
+		}
+		if err == models.ErrUploadChecksumMismatch {
+			return NewApiError(http.StatusUnprocessableEntity, ApiErrorCodeChecksumMismatch, err.Error())
+		}
+		return NewInternalApiError(err)
+	}
+	defer models.RemoveTempFile(file)
+
+	if err := job.UpdateStatus(Dbm, models.UploadJobStatusProcessing); err != nil {
+		return NewInternalApiError(err)
+	}
+
+	// the token of the request may expire while fetching
+	s, err := models.NewServiceAccountGoogleService(r.ServiceAccount)
+	if err != nil {
+		return NewInternalApiError(err)
+	}
+
+	r.Bundle.File = file
+	bundle, created, messages, aerr := createBundleWith(s, r.App, r.Bundle, r.Async)
+	if aerr != nil {
+		return aerr
+	}
+	if created {
+		notifyNewBundlePermissions(r.BaseUrl, r.App, bundle)
+		if r.UserId != 0 {
+			if err := createAudit(r.UserId, models.ResourceBundle, bundle.Id, models.ActionCreate); err != nil {
+				return NewInternalApiError(err)
+			}
+		}
+		messages = createdBundleMessages(bundle)
+	}
+
+	if err := job.Complete(Dbm, bundle.Id, messages); err != nil {
+		return NewInternalApiError(err)
+	}
+	return nil
+}
+
+// GetUploadJob returns the status of the upload job, with the bundle if it is completed.
+func (c ApiV2Controller) GetUploadJob(jobId string) revel.Result {
+	client, aerr := c.authenticate(c.Params.Get("token"), models.ApiTokenScopeUpload)
+	if aerr != nil {
+		return c.renderError(aerr)
+	}
+
+	job, err := models.GetUploadJobByToken(Dbm, jobId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.renderError(NewApiError(http.StatusNotFound, ApiErrorCodeNotFound, "Upload job is not found."))
+		}
+		return c.renderError(NewInternalApiError(err))
+	}
+	if _, aerr := c.clientApp(client, job.AppId); aerr != nil {
+		if aerr.Code == ApiErrorCodeNotFound {
+			return c.renderError(NewApiError(http.StatusNotFound, ApiErrorCodeNotFound, "Upload job is not found."))
+		}
+		return c.renderError(aerr)
+	}
+
+	content := job.JsonResponse()
+	if job.BundleId != 0 {
+		bundle, err := models.GetBundle(Dbm, job.BundleId)
+		if err != nil && err != sql.ErrNoRows {
+			return c.renderError(NewInternalApiError(err))
+		}
+		// the bundle may be deleted after the job is completed
+		if bundle != nil {
+			if err := loadBundleAttributes(bundle); err != nil {
+				return c.renderError(NewInternalApiError(err))
+			}
+			content.Bundle, err = bundle.JsonResponse(&c)
+			if err != nil {
+				return c.renderError(NewInternalApiError(err))
+			}
+		}
+	}
+
+	return c.renderResource(content)
+}
@@ -2,9 +2,10 @@ package controllers
 
 import (
 	"database/sql"
+	"fmt"
 	"os"
-	"path/filepath"
 	"strconv"
+	"time"
 
 	"github.com/kayac/alphawing/app/models"
 	"github.com/kayac/alphawing/app/routes"
@@ -74,17 +75,28 @@ func (c AppControllerWithValidation) GetApp(appId int) revel.Result {
 		panic(err)
 	}
 
-	apkBundles, err := app.BundlesByPlatformType(Dbm, models.BundlePlatformTypeAndroid)
+	platformBundles, err := app.BundlesGroupedByPlatform(Dbm)
 	if err != nil {
 		panic(err)
 	}
 
-	ipaBundles, err := app.BundlesByPlatformType(Dbm, models.BundlePlatformTypeIOS)
+	apiTokens, err := app.ApiTokens(Dbm)
 	if err != nil {
 		panic(err)
 	}
 
-	return c.Render(app, authorities, apkBundles, ipaBundles)
+	return c.Render(app, authorities, platformBundles, apiTokens)
+}
+
+func (c AppControllerWithValidation) GetSdkHistory(appId int) revel.Result {
+	app := c.App
+
+	history, err := app.SdkHistory(Dbm)
+	if err != nil {
+		panic(err)
+	}
+
+	return c.Render(app, history)
 }
 
 func (c AppControllerWithValidation) GetUpdateApp(appId int) revel.Result {
@@ -99,6 +111,7 @@ func (c AppControllerWithValidation) PostUpdateApp(appId int, app models.App) re
 	}
 
 	c.Validation.Required(app.Title).Message("Title is required.")
+	c.Validation.Required(models.IsValidRepositoryUrlTemplate(app.RepositoryUrlTemplate)).Message("Repository URL template must be an http or https URL.").Key("app.RepositoryUrlTemplate")
 	if c.Validation.HasErrors() {
 		c.Validation.Keep()
 		c.FlashParams()
@@ -137,6 +150,66 @@ func (c AppControllerWithValidation) PostRefreshToken(appId int, app models.App)
 	return c.Redirect(routes.AppControllerWithValidation.GetApp(app.Id))
 }
 
+func (c AppControllerWithValidation) PostCreateApiToken(appId int, name string, scopes []string, expiresInDays int) revel.Result {
+	app := c.App
+
+	c.Validation.Required(name).Message("Name is required.")
+	c.Validation.Required(len(scopes) > 0).Message("Scope is required.")
+	for _, scope := range scopes {
+		c.Validation.Required(models.IsApiTokenScope(scope)).Message("Scope is invalid.")
+	}
+	c.Validation.Min(expiresInDays, 0).Message("Expiry is invalid.")
+	if c.Validation.HasErrors() {
+		c.Validation.Keep()
+		c.FlashParams()
+		return c.Redirect(routes.AppControllerWithValidation.GetApp(appId))
+	}
+
+	apiToken := models.NewApiToken(app.Id, name, scopes, time.Duration(expiresInDays)*24*time.Hour)
+	err := Transact(func(txn gorp.SqlExecutor) error {
+		return apiToken.Save(txn)
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	if err := c.createAudit(models.ResourceApiToken, apiToken.Id, models.ActionCreate); err != nil {
+		panic(err)
+	}
+
+	// the raw token is shown only here
+	return c.Render(app, apiToken)
+}
+
+func (c AppControllerWithValidation) PostRevokeApiToken(appId, apiTokenId int) revel.Result {
+	apiToken, err := models.GetApiToken(Dbm, apiTokenId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.NotFound("API token is not found.")
+		}
+		panic(err)
+	}
+
+	if appId != apiToken.AppId {
+		c.Flash.Error("Parameter is invalid.")
+		return c.Redirect(routes.AppControllerWithValidation.GetApp(appId))
+	}
+
+	err = Transact(func(txn gorp.SqlExecutor) error {
+		return apiToken.Delete(txn)
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	if err := c.createAudit(models.ResourceApiToken, apiToken.Id, models.ActionDelete); err != nil {
+		panic(err)
+	}
+
+	c.Flash.Success("Revoked!")
+	return c.Redirect(routes.AppControllerWithValidation.GetApp(appId))
+}
+
 func (c AppControllerWithValidation) PostDeleteApp(appId int) revel.Result {
 	app := c.App
 
@@ -161,7 +234,7 @@ func (c AppControllerWithValidation) GetCreateBundle(appId int) revel.Result {
 	return c.Render(app, bundle)
 }
 
-func (c AppControllerWithValidation) PostCreateBundle(appId int, bundle models.Bundle, file *os.File) revel.Result {
+func (c AppControllerWithValidation) PostCreateBundle(appId int, bundle models.Bundle, build models.BundleBuild, metadata string, file *os.File) revel.Result {
 	if appId != bundle.AppId {
 		c.Flash.Error("Parameter is invalid.")
 		c.Redirect(routes.AppControllerWithValidation.GetApp(appId))
@@ -171,23 +244,42 @@ func (c AppControllerWithValidation) PostCreateBundle(appId int, bundle models.B
 	if _, ok := c.Params.Files["file"]; ok {
 		filename = c.Params.Files["file"][0].Filename
 	}
-	extStr := filepath.Ext(filename)
-	ext := models.BundleFileExtension(extStr)
+	ext := models.NewBundleFileExtension(filename)
 	isValidExt := ext.IsValid()
 
 	c.Validation.Required(file != nil).Message("File is required.")
 	c.Validation.Required(isValidExt).Message("File extension is not valid.")
+	if ext.PlatformType().UserSuppliedVersion() {
+		c.Validation.Required(bundle.BundleVersion).Message("Version is required for the file.")
+	}
+	if build.JobUrl != "" {
+		c.Validation.Required(isHttpUrl(build.JobUrl)).Message("CI job URL is invalid.")
+	}
+	metadataValues, err := models.ParseBundleMetadataLines(metadata)
+	c.Validation.Required(err == nil).Message("Metadata is invalid.")
 	if c.Validation.HasErrors() {
 		c.Validation.Keep()
 		c.FlashParams()
 		return c.Redirect(routes.AppControllerWithValidation.GetCreateBundle(appId))
 	}
 
+	bundle.Build = &build
+	bundle.Metadata = metadataValues
 	bundle.File = file
 	bundle.PlatformType = ext.PlatformType()
+	bundle.FileExtension = ext
 	if err := c.App.CreateBundle(Dbm, c.GoogleService, &bundle); err != nil {
-		if bperr, ok := err.(*models.BundleParseError); ok {
-			c.Flash.Error(bperr.Error())
+		if bderr, ok := err.(*models.BundleDuplicateError); ok {
+			if bderr.Rejected {
+				c.Flash.Error(bderr.Error())
+				return c.Redirect(routes.AppControllerWithValidation.GetCreateBundle(appId))
+			}
+			c.Flash.Success(bderr.Error())
+			return c.Redirect(routes.BundleControllerWithValidation.GetBundle(bderr.Existing.Id))
+		}
+		switch err.(type) {
+		case *models.BundleParseError, *models.BundleIdentifierMismatchError, *models.BundleScanRejectedError:
+			c.Flash.Error(err.Error())
 			return c.Redirect(routes.AppControllerWithValidation.GetCreateBundle(appId))
 		}
 		panic(err)
@@ -197,6 +289,13 @@ func (c AppControllerWithValidation) PostCreateBundle(appId int, bundle models.B
 		panic(err)
 	}
 
+	c.notifyNewPermissions(c.App, &bundle)
+
+	if len(bundle.Findings) > 0 {
+		c.Flash.Success(fmt.Sprintf("Created! But %d issue(s) were found by the scanner.", len(bundle.Findings)))
+		return c.Redirect(routes.BundleControllerWithValidation.GetBundle(bundle.Id))
+	}
+
 	c.Flash.Success("Created!")
 	return c.Redirect(routes.BundleControllerWithValidation.GetBundle(bundle.Id))
 }
@@ -1,8 +1,10 @@
 package controllers
 
 import (
+	"archive/zip"
 	"database/sql"
 	"fmt"
+	pathpkg "path"
 	"strconv"
 	"time"
 
@@ -43,7 +45,48 @@ func (c BundleControllerWithValidation) GetBundle(bundleId int) revel.Result {
 		panic(err)
 	}
 
-	return c.Render(bundle, app, installUrl)
+	splits, err := bundle.Splits(Dbm)
+	if err != nil {
+		panic(err)
+	}
+
+	sizes, err := bundle.Sizes(Dbm)
+	if err != nil {
+		panic(err)
+	}
+
+	permissions, err := bundle.Permissions(Dbm)
+	if err != nil {
+		panic(err)
+	}
+	previous, err := bundle.PreviousBundle(Dbm)
+	if err != nil {
+		panic(err)
+	}
+	if _, err := models.MarkNewPermissions(Dbm, permissions, previous); err != nil {
+		panic(err)
+	}
+
+	sdks, err := bundle.DetectedSdks(Dbm)
+	if err != nil {
+		panic(err)
+	}
+
+	findings, err := bundle.ScanFindings(Dbm)
+	if err != nil {
+		panic(err)
+	}
+
+	metadataList, err := bundle.MetadataList(Dbm)
+	if err != nil {
+		panic(err)
+	}
+
+	if err := bundle.LoadBuild(Dbm); err != nil {
+		panic(err)
+	}
+
+	return c.Render(bundle, app, installUrl, splits, sizes, permissions, sdks, findings, metadataList)
 }
 
 func (c BundleControllerWithValidation) GetUpdateBundle(bundleId int) revel.Result {
@@ -83,6 +126,10 @@ func (c BundleControllerWithValidation) PostDeleteBundle(bundleId int) revel.Res
 }
 
 func (c BundleControllerWithValidation) GetDownloadBundle(bundleId int) revel.Result {
+	if result := c.redirectUnlessReady(c.Bundle); result != nil {
+		return result
+	}
+
 	bundle := c.Bundle
 
 	plistUrl, err := c.UriFor(fmt.Sprintf("bundle/%d/download_plist", bundle.Id))
@@ -98,24 +145,164 @@ func (c BundleControllerWithValidation) GetDownloadBundle(bundleId int) revel.Re
 	return c.Render(plistUrl)
 }
 
+// GetDownloadApk is kept for the links to apk files issued before GetDownloadFile.
 func (c BundleControllerWithValidation) GetDownloadApk(bundleId int) revel.Result {
-	resp, file, err := c.GoogleService.DownloadFile(c.Bundle.FileId)
+	return c.GetDownloadFile(bundleId)
+}
+
+func (c BundleControllerWithValidation) GetDownloadFile(bundleId int) revel.Result {
+	if result := c.redirectUnlessReady(c.Bundle); result != nil {
+		return result
+	}
+
+	file, driveFile, err := c.Bundle.OpenFile(c.GoogleService)
 	if err != nil {
 		panic(err)
 	}
 
-	modtime, err := time.Parse(time.RFC3339, file.ModifiedDate)
+	modtime, err := time.Parse(time.RFC3339, driveFile.ModifiedDate)
 	if err != nil {
+		file.Close()
 		panic(err)
 	}
 
 	err = c.createAudit(models.ResourceBundle, bundleId, models.ActionDownload)
 	if err != nil {
+		file.Close()
+		panic(err)
+	}
+
+	c.Response.ContentType = c.Bundle.PlatformType.ContentType()
+	return c.RenderBinary(file, driveFile.OriginalFilename, revel.Attachment, modtime)
+}
+
+func (c BundleControllerWithValidation) GetBundleContents(bundleId int, path string) revel.Result {
+	if result := c.redirectUnlessReady(c.Bundle); result != nil {
+		return result
+	}
+
+	bundle := c.Bundle
+
+	file, err := models.OpenCachedBundleFile(c.GoogleService, bundle)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	entries, err := models.NewBundleEntries(file)
+	if err != nil {
+		if err == zip.ErrFormat {
+			c.Flash.Error("Can't browse the contents of the bundle.")
+			return c.Redirect(routes.BundleControllerWithValidation.GetBundle(bundleId))
+		}
 		panic(err)
 	}
 
-	c.Response.ContentType = "application/vnd.android.package-archive"
-	return c.RenderBinary(resp.Body, file.OriginalFilename, revel.Attachment, modtime)
+	var content string
+	var decoded, tooLarge bool
+	if path != "" {
+		data, err := models.ReadBundleEntry(file, path, models.MaxBundleEntryDisplaySize)
+		switch err {
+		case nil:
+			content, decoded = models.DecodeBundleEntry(data)
+		case models.ErrBundleEntryTooLarge:
+			tooLarge = true
+		case models.ErrBundleEntryNotFound:
+			return c.NotFound("Entry is not found.")
+		default:
+			panic(err)
+		}
+	}
+
+	return c.Render(bundle, entries, path, content, decoded, tooLarge)
+}
+
+func (c BundleControllerWithValidation) GetDownloadBundleEntry(bundleId int, path string) revel.Result {
+	if result := c.redirectUnlessReady(c.Bundle); result != nil {
+		return result
+	}
+
+	c.Validation.Required(path).Message("Path is required.")
+	if c.Validation.HasErrors() {
+		c.Validation.Keep()
+		c.FlashParams()
+		return c.Redirect(routes.BundleControllerWithValidation.GetBundleContents(bundleId, ""))
+	}
+
+	file, err := models.OpenCachedBundleFile(c.GoogleService, c.Bundle)
+	if err != nil {
+		panic(err)
+	}
+
+	// the entry is streamed, and the file is closed with it after the response
+	entry, err := models.OpenBundleEntry(file, path)
+	if err != nil {
+		if err == models.ErrBundleEntryNotFound || err == zip.ErrFormat {
+			return c.NotFound("Entry is not found.")
+		}
+		panic(err)
+	}
+
+	err = c.createAudit(models.ResourceBundle, bundleId, models.ActionDownload)
+	if err != nil {
+		entry.Close()
+		panic(err)
+	}
+
+	c.Response.ContentType = "application/octet-stream"
+	return c.RenderBinary(entry, pathpkg.Base(path), revel.Attachment, c.Bundle.CreatedAt)
+}
+
+// GetCompareBundle shows the changes from the base bundle to the bundle.
+// The bundles of the app are listed to choose when the base is not given.
+func (c BundleControllerWithValidation) GetCompareBundle(bundleId int, base int) revel.Result {
+	bundle := c.Bundle
+
+	app, err := bundle.App(Dbm)
+	if err != nil {
+		panic(err)
+	}
+
+	if base == 0 {
+		bundles, err := app.Bundles(Dbm)
+		if err != nil {
+			panic(err)
+		}
+		return c.Render(bundle, app, bundles)
+	}
+
+	baseBundle, err := models.GetBundle(Dbm, base)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.NotFound("Bundle is not found.")
+		}
+		panic(err)
+	}
+	if baseBundle.AppId != bundle.AppId {
+		c.Flash.Error("Can't compare bundles of different apps.")
+		return c.Redirect(routes.BundleControllerWithValidation.GetCompareBundle(bundleId, 0))
+	}
+	for _, b := range []*models.Bundle{baseBundle, bundle} {
+		if result := c.redirectUnlessReady(b); result != nil {
+			return result
+		}
+	}
+
+	comparison, err := models.CompareBundles(c.GoogleService, baseBundle, bundle)
+	if err != nil {
+		panic(err)
+	}
+
+	return c.Render(bundle, app, comparison)
+}
+
+// redirectUnlessReady redirects to the page of the bundle if the file of the bundle can't be downloaded yet.
+func (c *BundleControllerWithValidation) redirectUnlessReady(bundle *models.Bundle) revel.Result {
+	if bundle.IsReady() {
+		return nil
+	}
+	c.Flash.Error("The file of the bundle is %s.", bundle.Status)
+	return c.Redirect(routes.BundleControllerWithValidation.GetBundle(bundle.Id))
 }
 
 func (c *BundleControllerWithValidation) CheckNotFound() revel.Result {
@@ -157,7 +344,17 @@ func (c *BundleControllerWithValidation) CheckForbidden() revel.Result {
 		panic(err)
 	}
 
-	if _, err = s.GetFile(bundle.FileId); err != nil {
+	// the bundle without the file on Google Drive is checked with the folder of the app
+	fileId := bundle.FileId
+	if fileId == "" {
+		app, err := bundle.App(Dbm)
+		if err != nil {
+			panic(err)
+		}
+		fileId = app.FileId
+	}
+
+	if _, err = s.GetFile(fileId); err != nil {
 		return c.Forbidden("Can't access the bundle.")
 	}
 
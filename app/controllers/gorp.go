@@ -3,8 +3,9 @@ package controllers
 import (
 	"database/sql"
 	"fmt"
+	"strings"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 	_ "github.com/mattn/go-sqlite3"
 
 	"github.com/kayac/alphawing/app/models"
@@ -29,6 +30,39 @@ func InitDB() {
 	bundleTableMap := Dbm.AddTableWithName(models.Bundle{}, "bundle")
 	bundleTableMap.SetKeys(true, "Id")
 
+	bundleSplitTableMap := Dbm.AddTableWithName(models.BundleSplit{}, "bundle_split")
+	bundleSplitTableMap.SetKeys(true, "Id")
+
+	bundleSizeTableMap := Dbm.AddTableWithName(models.BundleSize{}, "bundle_size")
+	bundleSizeTableMap.SetKeys(true, "Id")
+
+	bundlePermissionTableMap := Dbm.AddTableWithName(models.BundlePermission{}, "bundle_permission")
+	bundlePermissionTableMap.SetKeys(true, "Id")
+	bundlePermissionTableMap.ColMap("Description").SetMaxSize(65535)
+
+	bundleSdkTableMap := Dbm.AddTableWithName(models.BundleSdk{}, "bundle_sdk")
+	bundleSdkTableMap.SetKeys(true, "Id")
+
+	bundleFindingTableMap := Dbm.AddTableWithName(models.BundleFinding{}, "bundle_finding")
+	bundleFindingTableMap.SetKeys(true, "Id")
+	bundleFindingTableMap.ColMap("Location").SetMaxSize(65535)
+	bundleFindingTableMap.ColMap("Excerpt").SetMaxSize(65535)
+
+	bundleBuildTableMap := Dbm.AddTableWithName(models.BundleBuild{}, "bundle_build")
+	bundleBuildTableMap.SetKeys(true, "Id")
+
+	bundleMetadataTableMap := Dbm.AddTableWithName(models.BundleMetadata{}, "bundle_metadata")
+	bundleMetadataTableMap.SetKeys(true, "Id")
+	bundleMetadataTableMap.ColMap("Value").SetMaxSize(65535)
+
+	apiTokenTableMap := Dbm.AddTableWithName(models.ApiToken{}, "api_token")
+	apiTokenTableMap.SetKeys(true, "Id")
+	apiTokenTableMap.ColMap("TokenHash").SetUnique(true)
+
+	personalAccessTokenTableMap := Dbm.AddTableWithName(models.PersonalAccessToken{}, "personal_access_token")
+	personalAccessTokenTableMap.SetKeys(true, "Id")
+	personalAccessTokenTableMap.ColMap("TokenHash").SetUnique(true)
+
 	authorityTableMap := Dbm.AddTableWithName(models.Authority{}, "authority")
 	authorityTableMap.SetKeys(true, "Id")
 
@@ -38,8 +72,78 @@ func InitDB() {
 	auditTableMap := Dbm.AddTableWithName(models.Audit{}, "audit")
 	auditTableMap.SetKeys(true, "Id")
 
+	uploadSessionTableMap := Dbm.AddTableWithName(models.UploadSession{}, "upload_session")
+	uploadSessionTableMap.SetKeys(true, "Id")
+	uploadSessionTableMap.ColMap("Token").SetUnique(true)
+
+	uploadJobTableMap := Dbm.AddTableWithName(models.UploadJob{}, "upload_job")
+	uploadJobTableMap.SetKeys(true, "Id")
+	uploadJobTableMap.ColMap("Token").SetUnique(true)
+	uploadJobTableMap.ColMap("Url").SetMaxSize(65535)
+	uploadJobTableMap.ColMap("Messages").SetMaxSize(65535)
+	uploadJobTableMap.ColMap("ErrorMessage").SetMaxSize(65535)
+
+	idempotencyKeyTableMap := Dbm.AddTableWithName(models.IdempotencyKey{}, "idempotency_key")
+	idempotencyKeyTableMap.SetKeys(true, "Id")
+	idempotencyKeyTableMap.ColMap("AppKey").SetUnique(true)
+	idempotencyKeyTableMap.ColMap("Response").SetMaxSize(65535)
+
 	Dbm.TraceOn("[gorp]", revel.INFO)
 	Dbm.CreateTablesIfNotExists()
+	if err := migrateDB(); err != nil {
+		panic(err)
+	}
+}
+
+// a columnMigration is a column added to a table after the table was released.
+type columnMigration struct {
+	Table      string
+	Column     string
+	Definition string
+}
+
+// the columns CreateTablesIfNotExists doesn't add to the existing tables
+var columnMigrations = []*columnMigration{
+	{"app", "android_identifier", "varchar(255) NOT NULL DEFAULT ''"},
+	{"app", "ios_identifier", "varchar(255) NOT NULL DEFAULT ''"},
+	{"app", "scan_policy", "int NOT NULL DEFAULT 0"},
+	{"app", "repository_url_template", "varchar(255) NOT NULL DEFAULT ''"},
+	{"bundle", "min_sdk_version", "varchar(255) NOT NULL DEFAULT ''"},
+	{"bundle", "target_sdk_version", "varchar(255) NOT NULL DEFAULT ''"},
+	{"bundle", "file_size", "bigint NOT NULL DEFAULT 0"},
+	{"bundle", "uncompressed_size", "bigint NOT NULL DEFAULT 0"},
+	{"bundle", "sha256", "varchar(255) NOT NULL DEFAULT ''"},
+	{"bundle", "status", "int NOT NULL DEFAULT 0"},
+}
+
+// migrateDB adds the columns which don't exist in the database.
+func migrateDB() error {
+	for _, migration := range columnMigrations {
+		_, err := Dbm.SelectInt(fmt.Sprintf("SELECT COUNT(%s) FROM %s", migration.Column, migration.Table))
+		if err == nil {
+			continue
+		}
+		if !isUnknownColumnError(err) {
+			return err
+		}
+
+		revel.INFO.Printf("add the column %s.%s", migration.Table, migration.Column)
+		_, err = Dbm.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", migration.Table, migration.Column, migration.Definition))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isUnknownColumnError reports whether the error is caused by a column which doesn't exist.
+func isUnknownColumnError(err error) bool {
+	// ER_BAD_FIELD_ERROR of MySQL
+	if mysqlErr, ok := err.(*mysql.MySQLError); ok {
+		return mysqlErr.Number == 1054
+	}
+	// SQLite returns the generic SQLITE_ERROR code with the message
+	return strings.Contains(err.Error(), "no such column")
 }
 
 func getDbm() *gorp.DbMap {
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"strings"
+	"time"
 
 	"github.com/kayac/alphawing/app/models"
 
@@ -24,6 +25,8 @@ type Config struct {
 	ServiceAccountClientEmail  string
 	ServiceAccountPrivateKey   string
 	PagerDefaultLimit          int
+	PagerMaxLimit              int
+	PermissionWebhookUrl       string
 }
 
 func init() {
@@ -33,6 +36,9 @@ func init() {
 	// gorp
 	revel.OnAppStart(InitDB)
 
+	// upload session
+	revel.OnAppStart(StartUploadSessionCleaner)
+
 	// service account
 	revel.InterceptMethod((*AlphaWingController).InitGoogleService, revel.BEFORE)
 
@@ -101,6 +107,51 @@ func LoadConfig() {
 	serviceAccountPrivateKey := keyMap["private_key"]
 
 	pagerDefaultLimit := revel.Config.IntDefault("app.pager.default.limit", 25)
+	pagerMaxLimit := revel.Config.IntDefault("app.pager.max.limit", 100)
+
+	permissionWebhookUrl, _ := revel.Config.String("app.permission.webhookurl")
+
+	duplicatePolicy := models.BundleDuplicatePolicy(revel.Config.StringDefault("app.bundle.duplicate", string(models.BundleDuplicatePolicyDedupe)))
+	if !duplicatePolicy.IsValid() {
+		panic("invalid config: app.bundle.duplicate")
+	}
+	models.DuplicatePolicy = duplicatePolicy
+
+	if secretPatternFile, found := revel.Config.String("app.scan.patternfile"); found && secretPatternFile != "" {
+		if err := models.LoadSecretPatterns(secretPatternFile); err != nil {
+			panic(err)
+		}
+	}
+
+	if sdkSignatureFile, found := revel.Config.String("app.sdk.signaturefile"); found && sdkSignatureFile != "" {
+		if err := models.LoadSdkSignatures(sdkSignatureFile); err != nil {
+			panic(err)
+		}
+	}
+
+	if uploadSessionDir, found := revel.Config.String("app.upload.dir"); found && uploadSessionDir != "" {
+		models.UploadSessionDir = uploadSessionDir
+	}
+	models.UploadSessionExpiry = time.Duration(revel.Config.IntDefault("app.upload.expiry.hours", 24)) * time.Hour
+	models.MaxUploadFileSize = int64(revel.Config.IntDefault("app.upload.max.mb", 2048)) * 1024 * 1024
+
+	if allowedHosts, found := revel.Config.String("app.upload.url.allowedhosts"); found && allowedHosts != "" {
+		models.UploadJobAllowedHosts = strings.Split(allowedHosts, ",")
+	}
+
+	if scopes, found := revel.Config.String("app.api.projecttoken.scopes"); found && scopes != "" {
+		models.ProjectApiTokenScopes = nil
+		if scopes != "none" {
+			for _, scope := range strings.Split(scopes, ",") {
+				if !models.IsApiTokenScope(scope) {
+					panic("invalid config: app.api.projecttoken.scopes")
+				}
+				models.ProjectApiTokenScopes = append(models.ProjectApiTokenScopes, scope)
+			}
+		}
+	}
+
+	models.IdempotencyKeyWindow = time.Duration(revel.Config.IntDefault("app.idempotency.window.hours", 24)) * time.Hour
 
 	Conf = &Config{
 		Secret:                     secret,
@@ -112,6 +163,8 @@ func LoadConfig() {
 		ServiceAccountClientEmail:  serviceAccountClientEmail,
 		ServiceAccountPrivateKey:   serviceAccountPrivateKey,
 		PagerDefaultLimit:          pagerDefaultLimit,
+		PagerMaxLimit:              pagerMaxLimit,
+		PermissionWebhookUrl:       permissionWebhookUrl,
 	}
 }
 
@@ -123,3 +176,56 @@ func GenerateApiDocument() {
 
 	ioutil.WriteFile(revel.AppPath+"/views/ApiController/GetDocument.html", []byte(html), 0644)
 }
+
+// StartUploadSessionCleaner removes the abandoned upload sessions, the old upload jobs and the expired idempotency keys periodically.
+// It also marks the bundles and the upload jobs as failed which were interrupted by the restart,
+// and releases the idempotency keys of the interrupted requests so the clients can retry them.
+func StartUploadSessionCleaner() {
+	go func() {
+		for {
+			count, err := models.FailInterruptedBundles(Dbm, time.Now().Add(-models.BundleUploadTimeout))
+			if err != nil {
+				revel.ERROR.Printf("failed to fail interrupted bundles: %s", err)
+			} else if count > 0 {
+				revel.INFO.Printf("%d bundles are failed to upload", count)
+			}
+
+			count, err = models.FailInterruptedUploadJobs(Dbm, ApiErrorCodeInternalError, time.Now().Add(-models.UploadJobTimeout))
+			if err != nil {
+				revel.ERROR.Printf("failed to fail interrupted upload jobs: %s", err)
+			} else if count > 0 {
+				revel.INFO.Printf("%d upload jobs are interrupted", count)
+			}
+
+			count, err = models.DeleteExpiredUploadSessions(Dbm, time.Now())
+			if err != nil {
+				revel.ERROR.Printf("failed to clean upload sessions: %s", err)
+			} else if count > 0 {
+				revel.INFO.Printf("%d upload sessions are expired", count)
+			}
+
+			count, err = models.DeleteFinishedUploadJobs(Dbm, time.Now().Add(-models.UploadSessionExpiry))
+			if err != nil {
+				revel.ERROR.Printf("failed to clean upload jobs: %s", err)
+			} else if count > 0 {
+				revel.INFO.Printf("%d upload jobs are expired", count)
+			}
+
+			count, err = models.DeleteExpiredIdempotencyKeys(Dbm, time.Now())
+			if err != nil {
+				revel.ERROR.Printf("failed to clean idempotency keys: %s", err)
+			} else if count > 0 {
+				revel.INFO.Printf("%d idempotency keys are expired", count)
+			}
+
+			count, err = models.DeletePendingIdempotencyKeys(Dbm, time.Now().Add(-models.IdempotencyKeyPendingTimeout))
+			if err != nil {
+				revel.ERROR.Printf("failed to release idempotency keys: %s", err)
+			} else if count > 0 {
+				revel.INFO.Printf("%d idempotency keys are released", count)
+			}
+
+			time.Sleep(time.Hour)
+		}
+	}()
+}
@@ -38,23 +38,29 @@ func (c *LimitedTimeController) GetDownloadPlist(bundleId int) revel.Result {
 }
 
 func (c *LimitedTimeController) GetDownloadIpa(bundleId int) revel.Result {
-	resp, file, err := c.GoogleService.DownloadFile(c.Bundle.FileId)
+	if !c.Bundle.IsReady() {
+		return c.NotFound("The file of the bundle is %s.", c.Bundle.Status)
+	}
+
+	file, driveFile, err := c.Bundle.OpenFile(c.GoogleService)
 	if err != nil {
 		panic(err)
 	}
 
-	modtime, err := time.Parse(time.RFC3339, file.ModifiedDate)
+	modtime, err := time.Parse(time.RFC3339, driveFile.ModifiedDate)
 	if err != nil {
+		file.Close()
 		panic(err)
 	}
 
 	err = c.createAudit(models.ResourceBundle, bundleId, models.ActionDownload)
 	if err != nil {
+		file.Close()
 		panic(err)
 	}
 
 	c.Response.ContentType = "application/octet-stream"
-	return c.RenderBinary(resp.Body, file.OriginalFilename, revel.Attachment, modtime)
+	return c.RenderBinary(file, driveFile.OriginalFilename, revel.Attachment, modtime)
 }
 
 func (c *LimitedTimeController) CheckValidLimitedTimeToken() revel.Result {
@@ -0,0 +1,83 @@
+package controllers
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/kayac/alphawing/app/models"
+	"github.com/kayac/alphawing/app/routes"
+
+	"github.com/coopernurse/gorp"
+	"github.com/revel/revel"
+)
+
+type UserController struct {
+	AuthController
+}
+
+func (c UserController) GetSettings() revel.Result {
+	user, err := models.GetUser(Dbm, c.LoginUserId)
+	if err != nil {
+		panic(err)
+	}
+
+	personalAccessTokens, err := user.PersonalAccessTokens(Dbm)
+	if err != nil {
+		panic(err)
+	}
+
+	return c.Render(user, personalAccessTokens)
+}
+
+func (c UserController) PostCreatePersonalAccessToken(name string, expiresInDays int) revel.Result {
+	c.Validation.Required(name).Message("Name is required.")
+	c.Validation.Min(expiresInDays, 0).Message("Expiry is invalid.")
+	if c.Validation.HasErrors() {
+		c.Validation.Keep()
+		c.FlashParams()
+		return c.Redirect(routes.UserController.GetSettings())
+	}
+
+	personalAccessToken := models.NewPersonalAccessToken(c.LoginUserId, name, time.Duration(expiresInDays)*24*time.Hour)
+	err := Transact(func(txn gorp.SqlExecutor) error {
+		return personalAccessToken.Save(txn)
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	if err := c.createAudit(models.ResourcePersonalAccessToken, personalAccessToken.Id, models.ActionCreate); err != nil {
+		panic(err)
+	}
+
+	// the raw token is shown only here
+	return c.Render(personalAccessToken)
+}
+
+func (c UserController) PostRevokePersonalAccessToken(personalAccessTokenId int) revel.Result {
+	personalAccessToken, err := models.GetPersonalAccessToken(Dbm, personalAccessTokenId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.NotFound("Personal access token is not found.")
+		}
+		panic(err)
+	}
+
+	if personalAccessToken.UserId != c.LoginUserId {
+		return c.Forbidden("Can't access the personal access token.")
+	}
+
+	err = Transact(func(txn gorp.SqlExecutor) error {
+		return personalAccessToken.Delete(txn)
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	if err := c.createAudit(models.ResourcePersonalAccessToken, personalAccessToken.Id, models.ActionDelete); err != nil {
+		panic(err)
+	}
+
+	c.Flash.Success("Revoked!")
+	return c.Redirect(routes.UserController.GetSettings())
+}
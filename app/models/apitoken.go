@@ -0,0 +1,176 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/coopernurse/gorp"
+)
+
+const (
+	ApiTokenScopeUpload = "upload"
+	ApiTokenScopeRead   = "read"
+	ApiTokenScopeDelete = "delete"
+	ApiTokenScopeTester = "tester"
+)
+
+// ApiTokenScopes are all scopes of API tokens.
+var ApiTokenScopes = []string{ApiTokenScopeUpload, ApiTokenScopeRead, ApiTokenScopeDelete, ApiTokenScopeTester}
+
+// ProjectApiTokenScopes are the scopes of the project API token.
+// The project API token is stored as it is to be shown in the project page,
+// so it is deprecated in favor of the named tokens.
+// It has all scopes by default to keep the existing clients working, and the scopes can be narrowed by the config.
+// The project API token is rejected if it is empty.
+var ProjectApiTokenScopes = ApiTokenScopes
+
+// IsApiTokenScope returns true if the scope is one of ApiTokenScopes.
+func IsApiTokenScope(scope string) bool {
+	for _, s := range ApiTokenScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// ProjectApiTokenHasScope returns true if the project API token is permitted to the scope.
+func ProjectApiTokenHasScope(scope string) bool {
+	for _, s := range ProjectApiTokenScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+var ErrApiTokenExpired = errors.New("token is expired")
+
+// an ApiToken is a named API token of an app.
+// Only the hash of the token is stored.
+type ApiToken struct {
+	Id         int        `db:"id"`
+	AppId      int        `db:"app_id"`
+	Name       string     `db:"name"`
+	TokenHash  string     `db:"token_hash"`
+	Scopes     string     `db:"scopes"` // comma separated
+	LastUsedAt *time.Time `db:"last_used_at"`
+	ExpiresAt  *time.Time `db:"expires_at"`
+	CreatedAt  time.Time  `db:"created_at"`
+	UpdatedAt  time.Time  `db:"updated_at"`
+
+	Token string `db:"-"` // the raw token, only available on creation
+}
+
+// HashApiToken returns the hash of the token stored in the database.
+func HashApiToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewApiToken generates a new token with the scopes.
+// The token expires after the duration unless it is zero.
+func NewApiToken(appId int, name string, scopes []string, expiresIn time.Duration) *ApiToken {
+	token := NewToken()
+	apiToken := &ApiToken{
+		AppId:     appId,
+		Name:      name,
+		TokenHash: HashApiToken(token),
+		Scopes:    strings.Join(scopes, ","),
+		Token:     token,
+	}
+	if expiresIn > 0 {
+		expiresAt := time.Now().Add(expiresIn)
+		apiToken.ExpiresAt = &expiresAt
+	}
+	return apiToken
+}
+
+func (apiToken *ApiToken) PreInsert(s gorp.SqlExecutor) error {
+	apiToken.CreatedAt = time.Now()
+	apiToken.UpdatedAt = apiToken.CreatedAt
+	return nil
+}
+
+func (apiToken *ApiToken) PreUpdate(s gorp.SqlExecutor) error {
+	apiToken.UpdatedAt = time.Now()
+	return nil
+}
+
+func (apiToken *ApiToken) Save(txn gorp.SqlExecutor) error {
+	return txn.Insert(apiToken)
+}
+
+func (apiToken *ApiToken) Delete(txn gorp.SqlExecutor) error {
+	_, err := txn.Delete(apiToken)
+	return err
+}
+
+func (apiToken *ApiToken) ScopeList() []string {
+	if apiToken.Scopes == "" {
+		return nil
+	}
+	return strings.Split(apiToken.Scopes, ",")
+}
+
+func (apiToken *ApiToken) HasScope(scope string) bool {
+	for _, s := range apiToken.ScopeList() {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (apiToken *ApiToken) IsExpired() bool {
+	return apiToken.ExpiresAt != nil && apiToken.ExpiresAt.Before(time.Now())
+}
+
+// Touch records the time when the token is used.
+func (apiToken *ApiToken) Touch(txn gorp.SqlExecutor) error {
+	now := time.Now()
+	_, err := txn.Exec("UPDATE api_token SET last_used_at = ? WHERE id = ?", now, apiToken.Id)
+	if err != nil {
+		return err
+	}
+	apiToken.LastUsedAt = &now
+	return nil
+}
+
+func (app *App) ApiTokens(txn gorp.SqlExecutor) ([]*ApiToken, error) {
+	var apiTokens []*ApiToken
+	_, err := txn.Select(&apiTokens, "SELECT * FROM api_token WHERE app_id = ? ORDER BY id ASC", app.Id)
+	if err != nil {
+		return nil, err
+	}
+	return apiTokens, nil
+}
+
+func (app *App) DeleteApiTokens(txn gorp.SqlExecutor) error {
+	_, err := txn.Exec("DELETE FROM api_token WHERE app_id = ?", app.Id)
+	return err
+}
+
+func GetApiToken(txn gorp.SqlExecutor, id int) (*ApiToken, error) {
+	var apiToken ApiToken
+	if err := txn.SelectOne(&apiToken, "SELECT * FROM api_token WHERE id = ?", id); err != nil {
+		return nil, err
+	}
+	return &apiToken, nil
+}
+
+// GetApiTokenByToken returns the API token of the raw token.
+// It returns ErrApiTokenExpired if the token is expired.
+func GetApiTokenByToken(txn gorp.SqlExecutor, token string) (*ApiToken, error) {
+	var apiToken ApiToken
+	if err := txn.SelectOne(&apiToken, "SELECT * FROM api_token WHERE token_hash = ?", HashApiToken(token)); err != nil {
+		return nil, err
+	}
+	if apiToken.IsExpired() {
+		return nil, ErrApiTokenExpired
+	}
+	return &apiToken, nil
+}
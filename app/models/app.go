@@ -16,13 +16,80 @@ import (
 
 // https://github.com/coopernurse/gorp#mapping-structs-to-tables
 type App struct {
-	Id          int       `db:"id"`
-	Title       string    `db:"title"`
-	FileId      string    `db:"file_id"`
-	ApiToken    string    `db:"api_token"`
-	Description string    `db:"description"`
-	CreatedAt   time.Time `db:"created_at"`
-	UpdatedAt   time.Time `db:"updated_at"`
+	Id                    int              `db:"id"`
+	Title                 string           `db:"title"`
+	FileId                string           `db:"file_id"`
+	ApiToken              string           `db:"api_token"`
+	Description           string           `db:"description"`
+	AndroidIdentifier     string           `db:"android_identifier"`
+	IOSIdentifier         string           `db:"ios_identifier"`
+	ScanPolicy            BundleScanPolicy `db:"scan_policy"`
+	RepositoryUrlTemplate string           `db:"repository_url_template"`
+	CreatedAt             time.Time        `db:"created_at"`
+	UpdatedAt             time.Time        `db:"updated_at"`
+}
+
+type AppJsonResponse struct {
+	Id                    int    `json:"id"`
+	Title                 string `json:"title"`
+	Description           string `json:"description"`
+	AndroidIdentifier     string `json:"android_identifier"`
+	IOSIdentifier         string `json:"ios_identifier"`
+	RepositoryUrlTemplate string `json:"repository_url_template"`
+	CreatedAt             string `json:"created_at"`
+	UpdatedAt             string `json:"updated_at"`
+}
+
+type BundleIdentifierMismatchError struct {
+	Expected string
+	Actual   string
+}
+
+func (e *BundleIdentifierMismatchError) Error() string {
+	return fmt.Sprintf("bundle identifier %q does not match the expected identifier %q", e.Actual, e.Expected)
+}
+
+type BundleDuplicatePolicy string
+
+const (
+	BundleDuplicatePolicyAllow  BundleDuplicatePolicy = "allow"
+	BundleDuplicatePolicyReject BundleDuplicatePolicy = "reject"
+	BundleDuplicatePolicyDedupe BundleDuplicatePolicy = "dedupe"
+)
+
+// DuplicatePolicy is how to handle an upload identical to an existing bundle of the same app.
+var DuplicatePolicy = BundleDuplicatePolicyDedupe
+
+func (policy BundleDuplicatePolicy) IsValid() bool {
+	switch policy {
+	case BundleDuplicatePolicyAllow, BundleDuplicatePolicyReject, BundleDuplicatePolicyDedupe:
+		return true
+	}
+	return false
+}
+
+// a BundleDuplicateError is returned when the uploaded file is identical to the existing bundle.
+// Rejected is false if the upload is deduplicated to the existing bundle.
+type BundleDuplicateError struct {
+	Existing *Bundle
+	Rejected bool
+}
+
+func (e *BundleDuplicateError) Error() string {
+	return fmt.Sprintf("the same file is already uploaded as %s #%d", e.Existing.BundleVersion, e.Existing.Revision)
+}
+
+func (app *App) JsonResponse() *AppJsonResponse {
+	return &AppJsonResponse{
+		Id:                    app.Id,
+		Title:                 app.Title,
+		Description:           app.Description,
+		AndroidIdentifier:     app.AndroidIdentifier,
+		IOSIdentifier:         app.IOSIdentifier,
+		RepositoryUrlTemplate: app.RepositoryUrlTemplate,
+		CreatedAt:             app.CreatedAt.Format(time.RFC3339),
+		UpdatedAt:             app.UpdatedAt.Format(time.RFC3339),
+	}
 }
 
 func (app *App) Bundles(txn gorp.SqlExecutor) ([]*Bundle, error) {
@@ -43,29 +110,123 @@ func (app *App) BundlesByPlatformType(txn gorp.SqlExecutor, platformType BundleP
 	return bundles, nil
 }
 
-func (app *App) BundlesWithPager(txn gorp.SqlExecutor, page, limit int) (Bundles, int, error) {
-	if page < 1 {
-		page = 1
+// BundleBySha256 returns the bundle of the app which has the checksum.
+// It returns nil if there is no such bundle. The bundles failed to store are ignored.
+func (app *App) BundleBySha256(txn gorp.SqlExecutor, sha256 string) (*Bundle, error) {
+	var bundles []*Bundle
+	_, err := txn.Select(&bundles, "SELECT * FROM bundle WHERE app_id = ? AND sha256 = ? AND status != ? ORDER BY id DESC LIMIT 1", app.Id, sha256, BundleStatusFailed)
+	if err != nil {
+		return nil, err
 	}
+	if len(bundles) == 0 {
+		return nil, nil
+	}
+	return bundles[0], nil
+}
 
-	count, err := txn.SelectInt("SELECT COUNT(*) FROM bundle WHERE app_id = ?", app.Id)
+// checkDuplicate returns a BundleDuplicateError if the app has the bundle of the checksum and the duplicates are not allowed.
+func (app *App) checkDuplicate(txn gorp.SqlExecutor, sha256 string) error {
+	if DuplicatePolicy == BundleDuplicatePolicyAllow {
+		return nil
+	}
+	existing, err := app.BundleBySha256(txn, sha256)
 	if err != nil {
-		return nil, 0, err
+		return err
+	}
+	if existing != nil {
+		return &BundleDuplicateError{
+			Existing: existing,
+			Rejected: DuplicatePolicy == BundleDuplicatePolicyReject,
+		}
+	}
+	return nil
+}
+
+// lock locks the row of the app until the transaction ends,
+// so that the transactions creating the bundles of the app run one by one.
+// It must be the first statement of the transaction to read the rows committed by the others.
+func (app *App) lock(txn gorp.SqlExecutor) error {
+	_, err := txn.Exec("UPDATE app SET updated_at = updated_at WHERE id = ?", app.Id)
+	return err
+}
+
+// a PlatformBundles is a list of bundles of a platform.
+type PlatformBundles struct {
+	Platform *BundlePlatform
+	Bundles  []*Bundle
+}
+
+func (platformBundles *PlatformBundles) SizeChartUrl() string {
+	return BundleSizeChartUrl(platformBundles.Bundles)
+}
+
+// BundlesGroupedByPlatform returns the bundles of each registered platform.
+// Platforms other than apk and ipa are omitted when they have no bundle.
+func (app *App) BundlesGroupedByPlatform(txn gorp.SqlExecutor) ([]*PlatformBundles, error) {
+	var groups []*PlatformBundles
+	for _, platform := range BundlePlatforms() {
+		bundles, err := app.BundlesByPlatformType(txn, platform.Type)
+		if err != nil {
+			return nil, err
+		}
+
+		isPrimary := platform.Type == BundlePlatformTypeAndroid || platform.Type == BundlePlatformTypeIOS
+		if len(bundles) == 0 && !isPrimary {
+			continue
+		}
+
+		groups = append(groups, &PlatformBundles{
+			Platform: platform,
+			Bundles:  bundles,
+		})
 	}
+	return groups, nil
+}
 
-	offset := (page - 1) * limit
-	if int(count) <= offset {
-		// 空であることが明らかなのでそのまま返す
-		return Bundles([]*Bundle{}), int(count), nil
+// LatestBundle returns the latest bundle of the platform which can be downloaded.
+// It returns nil if there is no such bundle of the platform.
+func (app *App) LatestBundle(txn gorp.SqlExecutor, platformType BundlePlatformType) (*Bundle, error) {
+	var bundles []*Bundle
+	_, err := txn.Select(&bundles, "SELECT * FROM bundle WHERE app_id = ? AND platform_type = ? AND status = ? ORDER BY id DESC LIMIT 1", app.Id, platformType, BundleStatusReady)
+	if err != nil {
+		return nil, err
+	}
+	if len(bundles) == 0 {
+		return nil, nil
 	}
+	return bundles[0], nil
+}
 
+// LatestBundleInChannel returns the latest bundle of the platform in the release channel.
+// It is the same as LatestBundle if the channel is empty.
+func (app *App) LatestBundleInChannel(txn gorp.SqlExecutor, platformType BundlePlatformType, channel string) (*Bundle, error) {
+	if channel == "" {
+		return app.LatestBundle(txn, platformType)
+	}
 	var bundles []*Bundle
-	_, err = txn.Select(&bundles, "SELECT * FROM bundle WHERE app_id = ? ORDER BY id DESC LIMIT ? OFFSET ?", app.Id, limit, offset)
+	_, err := txn.Select(&bundles, "SELECT * FROM bundle WHERE app_id = ? AND platform_type = ? AND status = ? AND id IN (SELECT bundle_id FROM bundle_metadata WHERE meta_key = ? AND meta_value = ?) ORDER BY id DESC LIMIT 1", app.Id, platformType, BundleStatusReady, BundleChannelMetadataKey, channel)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
+	}
+	if len(bundles) == 0 {
+		return nil, nil
 	}
+	return bundles[0], nil
+}
 
-	return Bundles(bundles), int(count), nil
+// LatestBundles returns the latest bundle of each platform which has bundles to be downloaded.
+func (app *App) LatestBundles(txn gorp.SqlExecutor) ([]*Bundle, error) {
+	var latestBundles []*Bundle
+	for _, platform := range BundlePlatforms() {
+		bundle, err := app.LatestBundle(txn, platform.Type)
+		if err != nil {
+			return nil, err
+		}
+		if bundle != nil {
+			latestBundles = append(latestBundles, bundle)
+		}
+	}
+	return latestBundles, nil
 }
 
 func (app *App) Authorities(txn gorp.SqlExecutor) ([]*Authority, error) {
@@ -131,11 +292,71 @@ func (app *App) Update(txn gorp.SqlExecutor) error {
 
 	current.Title = app.Title
 	current.Description = app.Description
+	current.AndroidIdentifier = app.AndroidIdentifier
+	current.IOSIdentifier = app.IOSIdentifier
+	current.ScanPolicy = app.ScanPolicy
+	current.RepositoryUrlTemplate = app.RepositoryUrlTemplate
 
 	_, err = txn.Update(current)
 	return err
 }
 
+func (app *App) ExpectedBundleIdentifier(platformType BundlePlatformType) string {
+	var identifier string
+	if platformType.IsAndroid() {
+		identifier = app.AndroidIdentifier
+	} else if platformType.IsIOS() {
+		identifier = app.IOSIdentifier
+	}
+	return identifier
+}
+
+func (app *App) VerifyBundleIdentifier(bundleInfo *BundleInfo) error {
+	expected := app.ExpectedBundleIdentifier(bundleInfo.PlatformType)
+	if expected == "" || expected == bundleInfo.Identifier {
+		return nil
+	}
+	return &BundleIdentifierMismatchError{
+		Expected: expected,
+		Actual:   bundleInfo.Identifier,
+	}
+}
+
+// PinBundleIdentifier records the identifier of the first uploaded bundle as the expected one,
+// and verifies the identifier with the app in the transaction.
+// Only one of the concurrent uploads can pin the identifier, and the others are verified with it.
+func (app *App) PinBundleIdentifier(txn gorp.SqlExecutor, bundleInfo *BundleInfo) error {
+	var column string
+	if bundleInfo.PlatformType.IsAndroid() {
+		column = "android_identifier"
+	} else if bundleInfo.PlatformType.IsIOS() {
+		column = "ios_identifier"
+	}
+
+	if column != "" && bundleInfo.Identifier != "" {
+		_, err := txn.Exec(
+			fmt.Sprintf("UPDATE app SET %s = ? WHERE id = ? AND %s = ''", column, column),
+			bundleInfo.Identifier,
+			app.Id,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	current, err := GetApp(txn, app.Id)
+	if err != nil {
+		return err
+	}
+	if err := current.VerifyBundleIdentifier(bundleInfo); err != nil {
+		return err
+	}
+
+	app.AndroidIdentifier = current.AndroidIdentifier
+	app.IOSIdentifier = current.IOSIdentifier
+	return nil
+}
+
 func (app *App) DeleteFromDB(txn gorp.SqlExecutor) error {
 	_, err := txn.Delete(app)
 	return err
@@ -152,6 +373,9 @@ func (app *App) Delete(txn gorp.SqlExecutor, s *GoogleService) error {
 	if err := app.DeleteAuthorities(txn); err != nil {
 		return err
 	}
+	if err := app.DeleteApiTokens(txn); err != nil {
+		return err
+	}
 	if err := app.DeleteFromDB(txn); err != nil {
 		return err
 	}
@@ -166,6 +390,9 @@ func (app *App) DeleteBundles(txn gorp.SqlExecutor) error {
 
 	args := make([]interface{}, len(bundles))
 	for i, bundle := range bundles {
+		if err := deleteBundleDependents(txn, bundle.Id); err != nil {
+			return err
+		}
 		args[i] = bundle
 	}
 
@@ -207,26 +434,92 @@ func (app *App) HasAuthorityForEmail(txn gorp.SqlExecutor, email string) (bool,
 	return false, nil
 }
 
+// AuthorityForEmail returns the authority of the app for the email.
+func (app *App) AuthorityForEmail(txn gorp.SqlExecutor, email string) (*Authority, error) {
+	var authority Authority
+	if err := txn.SelectOne(&authority, "SELECT * FROM authority WHERE app_id = ? AND email = ?", app.Id, email); err != nil {
+		return nil, err
+	}
+	return &authority, nil
+}
+
 func (app *App) ParentReference() *drive.ParentReference {
 	return &drive.ParentReference{
 		Id: app.FileId,
 	}
 }
 
+// CreateBundle parses the file, saves the bundle and uploads the file to Google Drive.
+// The bundle is BundleStatusUploading while uploading, and BundleStatusFailed if the upload fails.
 func (app *App) CreateBundle(dbm *gorp.DbMap, s *GoogleService, bundle *Bundle) error {
+	bundle.Status = BundleStatusUploading
+	if err := app.prepareBundle(dbm, bundle); err != nil {
+		return err
+	}
+	return app.storeBundle(dbm, s, bundle)
+}
+
+// prepareBundle parses the file and saves the bundle before the file is uploaded.
+func (app *App) prepareBundle(dbm *gorp.DbMap, bundle *Bundle) error {
 	bundle.AppId = app.Id
 
+	sha256, err := FileSha256(bundle.File)
+	if err != nil {
+		return err
+	}
+	// checked here not to parse the duplicate, and checked again in the transaction below
+	if err := app.checkDuplicate(dbm, sha256); err != nil {
+		return err
+	}
+	bundle.Sha256 = sha256
+
 	bundleInfo, err := NewBundleInfo(bundle.File, bundle.PlatformType)
 	if err != nil {
 		return err
 	}
+	if bundle.PlatformType.UserSuppliedVersion() {
+		bundleInfo.Version = bundle.BundleVersion
+	}
 	if len(bundleInfo.Version) == 0 {
 		return &BundleParseError{}
 	}
+	if err := app.VerifyBundleIdentifier(bundleInfo); err != nil {
+		return err
+	}
 	bundle.BundleInfo = bundleInfo
 
+	sizeInfo, err := NewBundleSizeInfo(bundle.File, bundleInfo.Executable)
+	if err != nil {
+		return err
+	}
+	bundle.SizeInfo = sizeInfo
+
+	sdks, err := DetectSdks(bundle.File, SdkSignatures)
+	if err != nil {
+		return err
+	}
+	bundle.Sdks = sdks
+
+	findings, err := ScanBundle(bundle.File, bundleInfo, SecretPatterns)
+	if err != nil {
+		return err
+	}
+	if len(findings) > 0 && app.ScanPolicy == BundleScanPolicyReject {
+		return &BundleScanRejectedError{Findings: findings}
+	}
+	bundle.Findings = findings
+
 	// increment revision number & save application information
 	err = Transact(dbm, func(txn gorp.SqlExecutor) error {
+		if err := app.lock(txn); err != nil {
+			return err
+		}
+		if err := app.checkDuplicate(txn, bundle.Sha256); err != nil {
+			return err
+		}
+		if err := app.PinBundleIdentifier(txn, bundleInfo); err != nil {
+			return err
+		}
 		maxRevision, err := app.GetMaxRevisionByBundleVersion(txn, bundleInfo.Version)
 		if err != nil {
 			return err
@@ -235,22 +528,7 @@ func (app *App) CreateBundle(dbm *gorp.DbMap, s *GoogleService, bundle *Bundle)
 		bundle.FileName = bundle.BuildFileName()
 		return bundle.Save(txn)
 	})
-	if err != nil {
-		panic(err)
-	}
-
-	// upload file
-	parent := app.ParentReference()
-	driveFile, err := s.InsertFile(bundle.File, bundle.FileName, parent)
-	if err != nil {
-		return err
-	}
-
-	// update FileId
-	bundle.FileId = driveFile.Id
-	return Transact(dbm, func(txn gorp.SqlExecutor) error {
-		return bundle.Update(txn)
-	})
+	return err
 }
 
 func (app *App) CreateAuthority(txn gorp.SqlExecutor, s *GoogleService, authority *Authority) error {
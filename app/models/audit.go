@@ -18,15 +18,18 @@ type Audit struct {
 }
 
 const (
-	ResourceApp       int = 1
-	ResourceBundle    int = 2
-	ResourceAuthority int = 3
+	ResourceApp                 int = 1
+	ResourceBundle              int = 2
+	ResourceAuthority           int = 3
+	ResourceApiToken            int = 4
+	ResourcePersonalAccessToken int = 5
 )
 
 const (
 	ActionCreate   int = 1
 	ActionDelete   int = 2
 	ActionDownload int = 3
+	ActionUpdate   int = 4
 )
 
 func (audit *Audit) PreInsert(s gorp.SqlExecutor) error {
@@ -15,6 +15,20 @@ type Authority struct {
 	UpdatedAt    time.Time `db:"updated_at"`
 }
 
+type TesterJsonResponse struct {
+	Id        int    `json:"id"`
+	Email     string `json:"email"`
+	CreatedAt string `json:"created_at"`
+}
+
+func (authority *Authority) JsonResponse() *TesterJsonResponse {
+	return &TesterJsonResponse{
+		Id:        authority.Id,
+		Email:     authority.Email,
+		CreatedAt: authority.CreatedAt.Format(time.RFC3339),
+	}
+}
+
 func (authority *Authority) PreInsert(s gorp.SqlExecutor) error {
 	authority.CreatedAt = time.Now()
 	authority.UpdatedAt = authority.CreatedAt
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"database/sql"
 	"fmt"
 	"io"
 	"net/http"
@@ -8,63 +9,10 @@ import (
 	"os"
 	"time"
 
+	"code.google.com/p/google-api-go-client/drive/v2"
 	"github.com/coopernurse/gorp"
 )
 
-type BundlePlatformType int
-
-const (
-	BundlePlatformTypeAndroid BundlePlatformType = 1 + iota
-	BundlePlatformTypeIOS
-)
-
-func (platformType BundlePlatformType) Extention() BundleFileExtension {
-	var ext BundleFileExtension
-	if platformType == BundlePlatformTypeAndroid {
-		ext = BundleFileExtensionAndroid
-	} else if platformType == BundlePlatformTypeIOS {
-		ext = BundleFileExtensionIOS
-	}
-	return ext
-}
-
-func (platformType BundlePlatformType) String() string {
-	var str string
-	if platformType == BundlePlatformTypeAndroid {
-		str = "android"
-	} else if platformType == BundlePlatformTypeIOS {
-		str = "ios"
-	}
-	return str
-}
-
-type BundleFileExtension string
-
-const (
-	BundleFileExtensionAndroid BundleFileExtension = ".apk"
-	BundleFileExtensionIOS     BundleFileExtension = ".ipa"
-)
-
-func (ext BundleFileExtension) IsValid() bool {
-	var ok bool
-	if ext == BundleFileExtensionAndroid {
-		ok = true
-	} else if ext == BundleFileExtensionIOS {
-		ok = true
-	}
-	return ok
-}
-
-func (ext BundleFileExtension) PlatformType() BundlePlatformType {
-	var platformType BundlePlatformType
-	if ext == BundleFileExtensionAndroid {
-		platformType = BundlePlatformTypeAndroid
-	} else if ext == BundleFileExtensionIOS {
-		platformType = BundlePlatformTypeIOS
-	}
-	return platformType
-}
-
 type Bundle struct {
 	Id               int                `db:"id"`
 	AppId            int                `db:"app_id"`
@@ -72,25 +20,50 @@ type Bundle struct {
 	PlatformType     BundlePlatformType `db:"platform_type"`
 	BundleVersion    string             `db:"bundle_version"`
 	BundleIdentifier string             `db:"bundle_identifier"`
+	MinSdkVersion    string             `db:"min_sdk_version"`
+	TargetSdkVersion string             `db:"target_sdk_version"`
+	FileSize         int64              `db:"file_size"`
+	UncompressedSize int64              `db:"uncompressed_size"`
+	Sha256           string             `db:"sha256"`
 	Revision         int                `db:"revision"`
 	Description      string             `db:"description"`
+	Status           BundleStatus       `db:"status"`
 	CreatedAt        time.Time          `db:"created_at"`
 	UpdatedAt        time.Time          `db:"updated_at"`
 
-	BundleInfo *BundleInfo `db:"-"`
-	File       *os.File    `db:"-"`
-	FileName   string      `db:"-"`
+	BundleInfo    *BundleInfo         `db:"-"`
+	SizeInfo      *BundleSizeInfo     `db:"-"`
+	Sdks          []*BundleSdk        `db:"-"`
+	Findings      []*BundleFinding    `db:"-"`
+	File          *os.File            `db:"-"`
+	FileName      string              `db:"-"`
+	FileExtension BundleFileExtension `db:"-"`
+	Metadata      map[string]string   `db:"-"` // loaded by LoadMetadata
+	Build         *BundleBuild        `db:"-"` // loaded by LoadBuild
 }
 
 type BundleJsonResponse struct {
-	FileId       string `json:"file_id"`
-	Version      string `json:"version"`
-	Revision     int    `json:"revision"`
-	InstallUrl   string `json:"install_url"`
-	QrCodeUrl    string `json:"qr_code_url"`
-	PlatformType string `json:"platform_type"`
-	CreatedAt    string `json:"created_at"`
-	UpdatedAt    string `json:"updated_at"`
+	Id               int    `json:"id"`
+	AppId            int    `json:"app_id"`
+	Identifier       string `json:"identifier"`
+	MinSdkVersion    string `json:"min_sdk_version"`
+	TargetSdkVersion string `json:"target_sdk_version"`
+	FileId           string `json:"file_id"`
+	Version          string `json:"version"`
+	Revision         int    `json:"revision"`
+	InstallUrl       string `json:"install_url"`
+	QrCodeUrl        string `json:"qr_code_url"`
+	PlatformType     string `json:"platform_type"`
+	Description      string `json:"description"`
+	FileSize         int64  `json:"file_size"`
+	UncompressedSize int64  `json:"uncompressed_size"`
+	Sha256           string `json:"sha256"`
+	Status           string `json:"status"`
+	CreatedAt        string `json:"created_at"`
+	UpdatedAt        string `json:"updated_at"`
+
+	Metadata map[string]string        `json:"metadata,omitempty"`
+	Build    *BundleBuildJsonResponse `json:"build,omitempty"`
 }
 
 type Bundles []*Bundle
@@ -114,11 +87,12 @@ type BundlesJsonResponse struct {
 	TotalCount int                   `json:"total_count"`
 	Page       int                   `json:"page"`
 	Limit      int                   `json:"limit"`
+	NextCursor string                `json:"next_cursor,omitempty"`
 	Bundles    []*BundleJsonResponse `json:"bundles"`
 }
 
 func (bundle *Bundle) JsonResponse(ub UriBuilder) (*BundleJsonResponse, error) {
-	installUrl, err := ub.UriFor(fmt.Sprintf("bundle/%d/download", bundle.Id))
+	installUrl, err := ub.UriFor(bundle.InstallPath())
 	if err != nil {
 		return nil, err
 	}
@@ -126,16 +100,32 @@ func (bundle *Bundle) JsonResponse(ub UriBuilder) (*BundleJsonResponse, error) {
 	if err != nil {
 		return nil, err
 	}
+	var build *BundleBuildJsonResponse
+	if bundle.Build != nil {
+		build = bundle.Build.JsonResponse()
+	}
 
 	return &BundleJsonResponse{
-		FileId:       bundle.FileId,
-		Version:      bundle.BundleVersion,
-		Revision:     bundle.Revision,
-		InstallUrl:   installUrl.String(),
-		QrCodeUrl:    qrCodeUrl.String(),
-		PlatformType: bundle.PlatformType.String(),
-		CreatedAt:    bundle.CreatedAt.Format(time.RFC3339),
-		UpdatedAt:    bundle.CreatedAt.Format(time.RFC3339),
+		Id:               bundle.Id,
+		AppId:            bundle.AppId,
+		Identifier:       bundle.BundleIdentifier,
+		MinSdkVersion:    bundle.MinSdkVersion,
+		TargetSdkVersion: bundle.TargetSdkVersion,
+		FileId:           bundle.FileId,
+		Version:          bundle.BundleVersion,
+		Revision:         bundle.Revision,
+		InstallUrl:       installUrl.String(),
+		QrCodeUrl:        qrCodeUrl.String(),
+		PlatformType:     bundle.PlatformType.String(),
+		Description:      bundle.Description,
+		FileSize:         bundle.FileSize,
+		UncompressedSize: bundle.UncompressedSize,
+		Sha256:           bundle.Sha256,
+		Status:           bundle.Status.String(),
+		CreatedAt:        bundle.CreatedAt.Format(time.RFC3339),
+		UpdatedAt:        bundle.UpdatedAt.Format(time.RFC3339),
+		Metadata:         bundle.Metadata,
+		Build:            build,
 	}, nil
 }
 
@@ -158,12 +148,17 @@ func (bundle *Bundle) PlistReader(txn gorp.SqlExecutor, ipaUrl *url.URL) (io.Rea
 }
 
 func (bundle *Bundle) BuildFileName() string {
+	ext := bundle.FileExtension
+	if ext == "" {
+		ext = bundle.PlatformType.Extention()
+	}
+
 	return fmt.Sprintf(
 		"app_%d_ver_%s_rev_%d%s",
 		bundle.AppId,
 		bundle.BundleInfo.Version,
 		bundle.Revision,
-		bundle.PlatformType.Extention(),
+		ext,
 	)
 }
 
@@ -183,6 +178,48 @@ func (bundle *Bundle) IsIpa() bool {
 	return ok
 }
 
+func (bundle *Bundle) IsApkSet() bool {
+	var ok bool
+	if bundle.PlatformType == BundlePlatformTypeApkSet {
+		ok = true
+	}
+	return ok
+}
+
+func (bundle *Bundle) IsIOSSimulator() bool {
+	var ok bool
+	if bundle.PlatformType == BundlePlatformTypeIOSSimulator {
+		ok = true
+	}
+	return ok
+}
+
+func (bundle *Bundle) IsAab() bool {
+	var ok bool
+	if bundle.PlatformType == BundlePlatformTypeAndroidAppBundle {
+		ok = true
+	}
+	return ok
+}
+
+// IsInstallable reports whether testers can install the bundle on their devices directly.
+func (bundle *Bundle) IsInstallable() bool {
+	return bundle.PlatformType.InstallFlow() != BundleInstallFlowArchive
+}
+
+// IsItmsServices reports whether the bundle is installed via the itms-services manifest.
+func (bundle *Bundle) IsItmsServices() bool {
+	return bundle.PlatformType.InstallFlow() == BundleInstallFlowItmsServices
+}
+
+// InstallPath returns the path for testers to get the bundle.
+func (bundle *Bundle) InstallPath() string {
+	if bundle.IsItmsServices() {
+		return fmt.Sprintf("bundle/%d/download", bundle.Id)
+	}
+	return fmt.Sprintf("bundle/%d/download_file", bundle.Id)
+}
+
 func (bundle *Bundle) App(txn gorp.SqlExecutor) (*App, error) {
 	app, err := txn.Get(App{}, bundle.AppId)
 	if err != nil {
@@ -191,9 +228,110 @@ func (bundle *Bundle) App(txn gorp.SqlExecutor) (*App, error) {
 	return app.(*App), nil
 }
 
+func (bundle *Bundle) Splits(txn gorp.SqlExecutor) ([]*BundleSplit, error) {
+	var splits []*BundleSplit
+	_, err := txn.Select(&splits, "SELECT * FROM bundle_split WHERE bundle_id = ? ORDER BY id ASC", bundle.Id)
+	if err != nil {
+		return nil, err
+	}
+	return splits, nil
+}
+
+func (bundle *Bundle) Sizes(txn gorp.SqlExecutor) ([]*BundleSize, error) {
+	var sizes []*BundleSize
+	_, err := txn.Select(&sizes, "SELECT * FROM bundle_size WHERE bundle_id = ? ORDER BY uncompressed_size DESC", bundle.Id)
+	if err != nil {
+		return nil, err
+	}
+	return sizes, nil
+}
+
+func (bundle *Bundle) Permissions(txn gorp.SqlExecutor) ([]*BundlePermission, error) {
+	var permissions []*BundlePermission
+	_, err := txn.Select(&permissions, "SELECT * FROM bundle_permission WHERE bundle_id = ? ORDER BY kind ASC, name ASC", bundle.Id)
+	if err != nil {
+		return nil, err
+	}
+	return permissions, nil
+}
+
+func (bundle *Bundle) DetectedSdks(txn gorp.SqlExecutor) ([]*BundleSdk, error) {
+	var sdks []*BundleSdk
+	_, err := txn.Select(&sdks, "SELECT * FROM bundle_sdk WHERE bundle_id = ? ORDER BY name ASC", bundle.Id)
+	if err != nil {
+		return nil, err
+	}
+	return sdks, nil
+}
+
+func (bundle *Bundle) ScanFindings(txn gorp.SqlExecutor) ([]*BundleFinding, error) {
+	var findings []*BundleFinding
+	_, err := txn.Select(&findings, "SELECT * FROM bundle_finding WHERE bundle_id = ? ORDER BY id ASC", bundle.Id)
+	if err != nil {
+		return nil, err
+	}
+	return findings, nil
+}
+
+// PreviousBundle returns the bundle uploaded before the bundle for the same platform.
+// It returns nil if the bundle is the first one.
+func (bundle *Bundle) PreviousBundle(txn gorp.SqlExecutor) (*Bundle, error) {
+	var bundles []*Bundle
+	_, err := txn.Select(&bundles, "SELECT * FROM bundle WHERE app_id = ? AND platform_type = ? AND id < ? ORDER BY id DESC LIMIT 1", bundle.AppId, bundle.PlatformType, bundle.Id)
+	if err != nil {
+		return nil, err
+	}
+	if len(bundles) == 0 {
+		return nil, nil
+	}
+	return bundles[0], nil
+}
+
+// NewPermissions returns the permissions which the previous bundle of the same platform doesn't have.
+func (bundle *Bundle) NewPermissions(txn gorp.SqlExecutor) ([]*BundlePermission, error) {
+	permissions, err := bundle.Permissions(txn)
+	if err != nil {
+		return nil, err
+	}
+	previous, err := bundle.PreviousBundle(txn)
+	if err != nil {
+		return nil, err
+	}
+	return MarkNewPermissions(txn, permissions, previous)
+}
+
+// OpenFile returns the file of the bundle and its metadata in Google Drive.
+// The file is verified with the checksum recorded on upload before it is returned,
+// so that a corrupted file is never sent to the client.
+func (bundle *Bundle) OpenFile(s *GoogleService) (*os.File, *drive.File, error) {
+	driveFile, err := s.GetFile(bundle.FileId)
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := OpenCachedBundleFile(s, bundle)
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, driveFile, nil
+}
+
+func (bundle *Bundle) HumanFileSize() string {
+	return FormatByteSize(bundle.FileSize)
+}
+
+func (bundle *Bundle) HumanUncompressedSize() string {
+	return FormatByteSize(bundle.UncompressedSize)
+}
+
 func (bundle *Bundle) PreInsert(s gorp.SqlExecutor) error {
 	bundle.BundleVersion = bundle.BundleInfo.Version
 	bundle.BundleIdentifier = bundle.BundleInfo.Identifier
+	bundle.MinSdkVersion = bundle.BundleInfo.MinSdkVersion
+	bundle.TargetSdkVersion = bundle.BundleInfo.TargetSdkVersion
+	if bundle.SizeInfo != nil {
+		bundle.FileSize = bundle.SizeInfo.FileSize
+		bundle.UncompressedSize = bundle.SizeInfo.UncompressedSize
+	}
 	bundle.CreatedAt = time.Now()
 	bundle.UpdatedAt = bundle.CreatedAt
 	return nil
@@ -205,25 +343,85 @@ func (bundle *Bundle) PreUpdate(s gorp.SqlExecutor) error {
 }
 
 func (bundle *Bundle) Save(txn gorp.SqlExecutor) error {
-	return txn.Insert(bundle)
+	if err := txn.Insert(bundle); err != nil {
+		return err
+	}
+
+	for _, split := range bundle.BundleInfo.Splits {
+		split.BundleId = bundle.Id
+		if err := split.Save(txn); err != nil {
+			return err
+		}
+	}
+
+	for _, permission := range NewBundlePermissions(bundle.BundleInfo) {
+		permission.BundleId = bundle.Id
+		if err := permission.Save(txn); err != nil {
+			return err
+		}
+	}
+
+	for _, finding := range bundle.Findings {
+		finding.BundleId = bundle.Id
+		if err := finding.Save(txn); err != nil {
+			return err
+		}
+	}
+
+	for _, sdk := range bundle.Sdks {
+		sdk.BundleId = bundle.Id
+		if err := sdk.Save(txn); err != nil {
+			return err
+		}
+	}
+
+	if bundle.SizeInfo != nil {
+		for _, size := range bundle.SizeInfo.Breakdown {
+			size.BundleId = bundle.Id
+			if err := size.Save(txn); err != nil {
+				return err
+			}
+		}
+	}
+
+	if bundle.Build != nil && !bundle.Build.IsEmpty() {
+		bundle.Build.BundleId = bundle.Id
+		if err := bundle.Build.Save(txn); err != nil {
+			return err
+		}
+	}
+
+	return bundle.UpdateMetadata(txn, bundle.Metadata)
 }
 
+// Update updates the description, and the file id if it is given.
+// Only the columns are updated not to overwrite the status updated by the background upload.
+// It returns sql.ErrNoRows if the bundle is deleted.
 func (bundle *Bundle) Update(txn gorp.SqlExecutor) error {
-	current, err := GetBundle(txn, bundle.Id)
+	var result sql.Result
+	var err error
+	if bundle.FileId != "" {
+		result, err = txn.Exec("UPDATE bundle SET description = ?, file_id = ?, updated_at = ? WHERE id = ?", bundle.Description, bundle.FileId, time.Now(), bundle.Id)
+	} else {
+		result, err = txn.Exec("UPDATE bundle SET description = ?, updated_at = ? WHERE id = ?", bundle.Description, time.Now(), bundle.Id)
+	}
 	if err != nil {
 		return err
 	}
-
-	current.Description = bundle.Description
-	if bundle.FileId != "" {
-		current.FileId = bundle.FileId
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
 	}
-
-	_, err = txn.Update(current)
-	return err
+	if count == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
 }
 
 func (bundle *Bundle) DeleteFromDB(txn gorp.SqlExecutor) error {
+	if err := deleteBundleDependents(txn, bundle.Id); err != nil {
+		return err
+	}
 	_, err := txn.Delete(bundle)
 	return err
 }
@@ -245,6 +443,29 @@ func (bundle *Bundle) Delete(txn gorp.SqlExecutor, s *GoogleService) error {
 	return bundle.DeleteFromDB(txn)
 }
 
+// deleteBundleDependents deletes the records which belong to the bundle.
+func deleteBundleDependents(txn gorp.SqlExecutor, bundleId int) error {
+	if err := DeleteBundleSplitsByBundleId(txn, bundleId); err != nil {
+		return err
+	}
+	if err := DeleteBundleSizesByBundleId(txn, bundleId); err != nil {
+		return err
+	}
+	if err := DeleteBundlePermissionsByBundleId(txn, bundleId); err != nil {
+		return err
+	}
+	if err := DeleteBundleSdksByBundleId(txn, bundleId); err != nil {
+		return err
+	}
+	if err := DeleteBundleMetadataByBundleId(txn, bundleId); err != nil {
+		return err
+	}
+	if err := DeleteBundleBuildsByBundleId(txn, bundleId); err != nil {
+		return err
+	}
+	return DeleteBundleFindingsByBundleId(txn, bundleId)
+}
+
 func CreateBundle(txn gorp.SqlExecutor, bundle *Bundle) error {
 	return txn.Insert(bundle)
 }
@@ -257,7 +478,12 @@ func GetBundle(txn gorp.SqlExecutor, id int) (*Bundle, error) {
 	return &bundle, nil
 }
 
+// GetBundleByFileId returns the bundle of the file on Google Drive.
+// The bundles which are not uploaded yet have no file id, so they can't be found.
 func GetBundleByFileId(txn gorp.SqlExecutor, fileId string) (*Bundle, error) {
+	if fileId == "" {
+		return nil, sql.ErrNoRows
+	}
 	var bundle Bundle
 	if err := txn.SelectOne(&bundle, "SELECT * FROM bundle WHERE file_id = ?", fileId); err != nil {
 		return nil, err
@@ -0,0 +1,115 @@
+package models
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/coopernurse/gorp"
+)
+
+// RepositoryUrlCommitPlaceholder is replaced with the commit SHA in the repository URL template of the app.
+const RepositoryUrlCommitPlaceholder = "{commit}"
+
+// a commit SHA is put in the URL only if it is the hex of the full or abbreviated SHA
+var reCommitSha = regexp.MustCompile(`^[0-9a-f]{7,40}$`)
+
+// IsValidRepositoryUrlTemplate reports whether the template is empty or an http(s) URL.
+func IsValidRepositoryUrlTemplate(template string) bool {
+	if template == "" {
+		return true
+	}
+	u, err := url.Parse(template)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// a BundleBuild is the CI context in which a bundle was built.
+type BundleBuild struct {
+	Id          int       `db:"id"`
+	BundleId    int       `db:"bundle_id"`
+	CommitSha   string    `db:"commit_sha"`
+	Branch      string    `db:"branch"`
+	BuildNumber string    `db:"build_number"`
+	JobUrl      string    `db:"job_url"`
+	CreatedAt   time.Time `db:"created_at"`
+	UpdatedAt   time.Time `db:"updated_at"`
+
+	CommitUrl string `db:"-"` // set by LoadBuild
+}
+
+type BundleBuildJsonResponse struct {
+	CommitSha   string `json:"commit_sha"`
+	CommitUrl   string `json:"commit_url"`
+	Branch      string `json:"branch"`
+	BuildNumber string `json:"build_number"`
+	JobUrl      string `json:"job_url"`
+}
+
+func (build *BundleBuild) JsonResponse() *BundleBuildJsonResponse {
+	return &BundleBuildJsonResponse{
+		CommitSha:   build.CommitSha,
+		CommitUrl:   build.CommitUrl,
+		Branch:      build.Branch,
+		BuildNumber: build.BuildNumber,
+		JobUrl:      build.JobUrl,
+	}
+}
+
+// IsEmpty reports whether no CI context is given.
+func (build *BundleBuild) IsEmpty() bool {
+	return build.CommitSha == "" && build.Branch == "" && build.BuildNumber == "" && build.JobUrl == ""
+}
+
+func (build *BundleBuild) PreInsert(s gorp.SqlExecutor) error {
+	build.CreatedAt = time.Now()
+	build.UpdatedAt = build.CreatedAt
+	return nil
+}
+
+func (build *BundleBuild) PreUpdate(s gorp.SqlExecutor) error {
+	build.UpdatedAt = time.Now()
+	return nil
+}
+
+func (build *BundleBuild) Save(txn gorp.SqlExecutor) error {
+	return txn.Insert(build)
+}
+
+// CommitUrl returns the URL of the commit built from the repository URL template of the app.
+// It returns empty if the app has no valid template or the commit SHA is not a hex SHA.
+func (app *App) CommitUrl(commitSha string) string {
+	if app.RepositoryUrlTemplate == "" || !IsValidRepositoryUrlTemplate(app.RepositoryUrlTemplate) || !reCommitSha.MatchString(commitSha) {
+		return ""
+	}
+	return strings.Replace(app.RepositoryUrlTemplate, RepositoryUrlCommitPlaceholder, commitSha, -1)
+}
+
+// LoadBuild sets the CI context of the bundle to Build, or nil if it has none.
+func (bundle *Bundle) LoadBuild(txn gorp.SqlExecutor) error {
+	var builds []*BundleBuild
+	_, err := txn.Select(&builds, "SELECT * FROM bundle_build WHERE bundle_id = ? ORDER BY id DESC LIMIT 1", bundle.Id)
+	if err != nil {
+		return err
+	}
+	if len(builds) == 0 {
+		bundle.Build = nil
+		return nil
+	}
+
+	app, err := bundle.App(txn)
+	if err != nil {
+		return err
+	}
+	builds[0].CommitUrl = app.CommitUrl(builds[0].CommitSha)
+	bundle.Build = builds[0]
+	return nil
+}
+
+func DeleteBundleBuildsByBundleId(txn gorp.SqlExecutor, bundleId int) error {
+	_, err := txn.Exec("DELETE FROM bundle_build WHERE bundle_id = ?", bundleId)
+	return err
+}
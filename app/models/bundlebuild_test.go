@@ -0,0 +1,30 @@
+package models
+
+import (
+	"testing"
+)
+
+func TestCommitUrl(t *testing.T) {
+	tests := []struct {
+		template  string
+		commitSha string
+		want      string
+	}{
+		{"https://github.com/example/app/commit/{commit}", "0123abc", "https://github.com/example/app/commit/0123abc"},
+		{"http://git.example.com/app/{commit}?tab={commit}", "0123456789abcdef0123456789abcdef01234567", "http://git.example.com/app/0123456789abcdef0123456789abcdef01234567?tab=0123456789abcdef0123456789abcdef01234567"},
+		{"", "0123abc", ""},
+		{"https://github.com/example/app/commit/{commit}", "", ""},
+		{"https://github.com/example/app/commit/{commit}", "0123ab", ""},
+		{"https://github.com/example/app/commit/{commit}", "0123ABC", ""},
+		{"https://github.com/example/app/commit/{commit}", "0123abc/../../evil", ""},
+		{"https://github.com/example/app/commit/{commit}", "0123456789abcdef0123456789abcdef012345678", ""},
+		{"javascript:alert(1)//{commit}", "0123abc", ""},
+		{"//github.com/example/app/commit/{commit}", "0123abc", ""},
+	}
+	for _, test := range tests {
+		app := &App{RepositoryUrlTemplate: test.template}
+		if got := app.CommitUrl(test.commitSha); got != test.want {
+			t.Errorf("%q with %q: url is %q, want %q", test.template, test.commitSha, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package models
+
+import (
+	"archive/zip"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// a BundleFieldChange is a metadata field of the two bundles.
+type BundleFieldChange struct {
+	Name   string
+	Base   string
+	Target string
+}
+
+func (change *BundleFieldChange) IsChanged() bool {
+	return change.Base != change.Target
+}
+
+// a BundleEntryChange is a file which is added, removed or changed between the two bundles.
+type BundleEntryChange struct {
+	Name       string
+	BaseSize   int64
+	TargetSize int64
+}
+
+func (change *BundleEntryChange) SizeDelta() int64 {
+	return change.TargetSize - change.BaseSize
+}
+
+func (change *BundleEntryChange) HumanSizeDelta() string {
+	return FormatByteSizeDelta(change.SizeDelta())
+}
+
+// a BundleComparison is the difference from the base bundle to the target bundle.
+type BundleComparison struct {
+	Base   *Bundle
+	Target *Bundle
+
+	Fields              []*BundleFieldChange
+	AddedPermissions    []string
+	RemovedPermissions  []string
+	AddedEntitlements   []string
+	RemovedEntitlements []string
+	AddedEntries        []*BundleEntryChange
+	RemovedEntries      []*BundleEntryChange
+	ChangedEntries      []*BundleEntryChange
+}
+
+type BundleFieldChangeJsonResponse struct {
+	Name    string `json:"name"`
+	Base    string `json:"base"`
+	Target  string `json:"target"`
+	Changed bool   `json:"changed"`
+}
+
+type BundleEntryChangeJsonResponse struct {
+	Name       string `json:"name"`
+	BaseSize   int64  `json:"base_size"`
+	TargetSize int64  `json:"target_size"`
+	SizeDelta  int64  `json:"size_delta"`
+}
+
+type BundleListChangeJsonResponse struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+}
+
+type BundleEntriesChangeJsonResponse struct {
+	Added   []*BundleEntryChangeJsonResponse `json:"added"`
+	Removed []*BundleEntryChangeJsonResponse `json:"removed"`
+	Changed []*BundleEntryChangeJsonResponse `json:"changed"`
+}
+
+type BundleComparisonJsonResponse struct {
+	Base         *BundleJsonResponse              `json:"base"`
+	Target       *BundleJsonResponse              `json:"target"`
+	Fields       []*BundleFieldChangeJsonResponse `json:"fields"`
+	Permissions  *BundleListChangeJsonResponse    `json:"permissions"`
+	Entitlements *BundleListChangeJsonResponse    `json:"entitlements"`
+	Entries      *BundleEntriesChangeJsonResponse `json:"entries"`
+	SizeDelta    int64                            `json:"size_delta"`
+}
+
+// CompareBundles compares the two bundles opened from the bundle cache.
+func CompareBundles(s *GoogleService, base, target *Bundle) (*BundleComparison, error) {
+	baseFile, err := OpenCachedBundleFile(s, base)
+	if err != nil {
+		return nil, err
+	}
+	defer baseFile.Close()
+
+	targetFile, err := OpenCachedBundleFile(s, target)
+	if err != nil {
+		return nil, err
+	}
+	defer targetFile.Close()
+
+	return NewBundleComparison(base, baseFile, target, targetFile)
+}
+
+func NewBundleComparison(base *Bundle, baseFile *os.File, target *Bundle, targetFile *os.File) (*BundleComparison, error) {
+	baseInfo, err := NewBundleInfo(baseFile, base.PlatformType)
+	if err != nil {
+		return nil, err
+	}
+	targetInfo, err := NewBundleInfo(targetFile, target.PlatformType)
+	if err != nil {
+		return nil, err
+	}
+
+	comparison := &BundleComparison{
+		Base:   base,
+		Target: target,
+		Fields: []*BundleFieldChange{
+			{"platform", base.PlatformType.String(), target.PlatformType.String()},
+			{"version", base.BundleVersion, target.BundleVersion},
+			{"revision", fmt.Sprint(base.Revision), fmt.Sprint(target.Revision)},
+			{"identifier", base.BundleIdentifier, target.BundleIdentifier},
+			{"min_sdk_version", base.MinSdkVersion, target.MinSdkVersion},
+			{"target_sdk_version", base.TargetSdkVersion, target.TargetSdkVersion},
+			{"certificate", baseInfo.CertificateFingerprint, targetInfo.CertificateFingerprint},
+			{"file_size", fmt.Sprint(base.FileSize), fmt.Sprint(target.FileSize)},
+		},
+	}
+	comparison.AddedPermissions, comparison.RemovedPermissions = diffStrings(baseInfo.Permissions, targetInfo.Permissions)
+	comparison.AddedEntitlements, comparison.RemovedEntitlements = diffStrings(entitlementLines(baseInfo.Entitlements), entitlementLines(targetInfo.Entitlements))
+
+	baseEntries, err := bundleEntriesByName(baseFile)
+	if err != nil {
+		return nil, err
+	}
+	targetEntries, err := bundleEntriesByName(targetFile)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, entry := range targetEntries {
+		baseEntry, ok := baseEntries[name]
+		if !ok {
+			comparison.AddedEntries = append(comparison.AddedEntries, &BundleEntryChange{
+				Name:       name,
+				TargetSize: int64(entry.UncompressedSize),
+			})
+			continue
+		}
+		if baseEntry.CRC32 != entry.CRC32 || baseEntry.UncompressedSize != entry.UncompressedSize {
+			comparison.ChangedEntries = append(comparison.ChangedEntries, &BundleEntryChange{
+				Name:       name,
+				BaseSize:   int64(baseEntry.UncompressedSize),
+				TargetSize: int64(entry.UncompressedSize),
+			})
+		}
+	}
+	for name, entry := range baseEntries {
+		if _, ok := targetEntries[name]; !ok {
+			comparison.RemovedEntries = append(comparison.RemovedEntries, &BundleEntryChange{
+				Name:     name,
+				BaseSize: int64(entry.UncompressedSize),
+			})
+		}
+	}
+	sort.Sort(bundleEntryChangesByName(comparison.AddedEntries))
+	sort.Sort(bundleEntryChangesByName(comparison.RemovedEntries))
+	sort.Sort(bundleEntryChangesByName(comparison.ChangedEntries))
+
+	return comparison, nil
+}
+
+func (comparison *BundleComparison) SizeDelta() int64 {
+	return comparison.Target.FileSize - comparison.Base.FileSize
+}
+
+func (comparison *BundleComparison) HumanSizeDelta() string {
+	return FormatByteSizeDelta(comparison.SizeDelta())
+}
+
+func (comparison *BundleComparison) JsonResponse(ub UriBuilder) (*BundleComparisonJsonResponse, error) {
+	base, err := comparison.Base.JsonResponse(ub)
+	if err != nil {
+		return nil, err
+	}
+	target, err := comparison.Target.JsonResponse(ub)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := []*BundleFieldChangeJsonResponse{}
+	for _, field := range comparison.Fields {
+		fields = append(fields, &BundleFieldChangeJsonResponse{
+			Name:    field.Name,
+			Base:    field.Base,
+			Target:  field.Target,
+			Changed: field.IsChanged(),
+		})
+	}
+
+	return &BundleComparisonJsonResponse{
+		Base:   base,
+		Target: target,
+		Fields: fields,
+		Permissions: &BundleListChangeJsonResponse{
+			Added:   nonNilStrings(comparison.AddedPermissions),
+			Removed: nonNilStrings(comparison.RemovedPermissions),
+		},
+		Entitlements: &BundleListChangeJsonResponse{
+			Added:   nonNilStrings(comparison.AddedEntitlements),
+			Removed: nonNilStrings(comparison.RemovedEntitlements),
+		},
+		Entries: &BundleEntriesChangeJsonResponse{
+			Added:   bundleEntryChangesJsonResponse(comparison.AddedEntries),
+			Removed: bundleEntryChangesJsonResponse(comparison.RemovedEntries),
+			Changed: bundleEntryChangesJsonResponse(comparison.ChangedEntries),
+		},
+		SizeDelta: comparison.SizeDelta(),
+	}, nil
+}
+
+func bundleEntryChangesJsonResponse(changes []*BundleEntryChange) []*BundleEntryChangeJsonResponse {
+	responses := []*BundleEntryChangeJsonResponse{}
+	for _, change := range changes {
+		responses = append(responses, &BundleEntryChangeJsonResponse{
+			Name:       change.Name,
+			BaseSize:   change.BaseSize,
+			TargetSize: change.TargetSize,
+			SizeDelta:  change.SizeDelta(),
+		})
+	}
+	return responses
+}
+
+// bundleEntriesByName returns the files in the bundle except directories.
+// A file which is not a zip archive has no entries.
+func bundleEntriesByName(file *os.File) (map[string]*BundleEntry, error) {
+	entries, err := NewBundleEntries(file)
+	if err == zip.ErrFormat {
+		return map[string]*BundleEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entriesByName := map[string]*BundleEntry{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			entriesByName[entry.Name] = entry
+		}
+	}
+	return entriesByName, nil
+}
+
+// diffStrings returns the strings only in the target and the strings only in the base.
+func diffStrings(base, target []string) (added, removed []string) {
+	baseSet := map[string]bool{}
+	for _, s := range base {
+		baseSet[s] = true
+	}
+	targetSet := map[string]bool{}
+	for _, s := range target {
+		targetSet[s] = true
+		if !baseSet[s] {
+			added = append(added, s)
+		}
+	}
+	for _, s := range base {
+		if !targetSet[s] {
+			removed = append(removed, s)
+		}
+	}
+	return added, removed
+}
+
+func nonNilStrings(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
+
+type bundleEntryChangesByName []*BundleEntryChange
+
+func (s bundleEntryChangesByName) Len() int           { return len(s) }
+func (s bundleEntryChangesByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s bundleEntryChangesByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,272 @@
+package models
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+	"unicode/utf8"
+
+	"github.com/DHowett/go-plist"
+	"github.com/shogo82148/androidbinary"
+)
+
+var (
+	ErrBundleEntryNotFound = errors.New("entry is not found in the bundle")
+	ErrBundleEntryTooLarge = errors.New("entry is too large to read")
+)
+
+// MaxBundleEntryDisplaySize is the maximum size of an entry shown as text in the contents browser.
+const MaxBundleEntryDisplaySize = 1024 * 1024
+
+// the directory where the bundles downloaded to browse the contents are cached
+var BundleCacheDir = filepath.Join(os.TempDir(), "alphawing-bundles")
+
+// the number of the bundles kept in BundleCacheDir
+var BundleCacheCount = 10
+
+// a BundleEntry is a file contained in an application package.
+type BundleEntry struct {
+	Name             string
+	CompressedSize   uint64
+	UncompressedSize uint64
+	CRC32            uint32
+}
+
+func (entry *BundleEntry) IsDir() bool {
+	return len(entry.Name) > 0 && entry.Name[len(entry.Name)-1] == '/'
+}
+
+func newZipReader(file *os.File) (*zip.Reader, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return zip.NewReader(file, stat.Size())
+}
+
+// NewBundleEntries returns the files contained in the application package.
+// It returns zip.ErrFormat if the file is not a zip archive.
+func NewBundleEntries(file *os.File) ([]*BundleEntry, error) {
+	reader, err := newZipReader(file)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*BundleEntry, 0, len(reader.File))
+	for _, f := range reader.File {
+		entries = append(entries, &BundleEntry{
+			Name:             f.Name,
+			CompressedSize:   f.CompressedSize64,
+			UncompressedSize: f.UncompressedSize64,
+			CRC32:            f.CRC32,
+		})
+	}
+
+	return entries, nil
+}
+
+// OpenBundleEntry opens the file contained in the application package.
+// The archive is closed when the returned reader is closed.
+func OpenBundleEntry(file *os.File, name string) (io.ReadCloser, error) {
+	reader, err := newZipReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	for _, f := range reader.File {
+		if f.Name != name {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return &bundleEntryReader{rc, file}, nil
+	}
+
+	file.Close()
+	return nil, ErrBundleEntryNotFound
+}
+
+// a bundleEntryReader reads an entry, and closes the archive with the entry.
+type bundleEntryReader struct {
+	io.ReadCloser
+	archive *os.File
+}
+
+func (r *bundleEntryReader) Close() error {
+	err := r.ReadCloser.Close()
+	if closeErr := r.archive.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// ReadBundleEntry returns the content of the file contained in the application package.
+// It returns ErrBundleEntryTooLarge if the content is larger than the limit.
+func ReadBundleEntry(file *os.File, name string, limit int64) ([]byte, error) {
+	reader, err := newZipReader(file)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range reader.File {
+		if f.Name != name {
+			continue
+		}
+		if f.UncompressedSize64 > uint64(limit) {
+			return nil, ErrBundleEntryTooLarge
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+
+		// the size in the header can be forged
+		data, err := ioutil.ReadAll(io.LimitReader(rc, limit+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(data)) > limit {
+			return nil, ErrBundleEntryTooLarge
+		}
+		return data, nil
+	}
+
+	return nil, ErrBundleEntryNotFound
+}
+
+// OpenCachedBundleFile opens the file of the bundle downloaded from Google Drive.
+// The file is cached in BundleCacheDir, so browsing the contents doesn't download the bundle every time.
+// The caller should close the file, but must not remove it.
+func OpenCachedBundleFile(s *GoogleService, bundle *Bundle) (*os.File, error) {
+	h := sha256.Sum256([]byte(bundle.FileId))
+	path := filepath.Join(BundleCacheDir, hex.EncodeToString(h[:]))
+
+	file, err := os.Open(path)
+	if err == nil {
+		now := time.Now()
+		os.Chtimes(path, now, now)
+		return file, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(BundleCacheDir, 0700); err != nil {
+		return nil, err
+	}
+	file, err = s.downloadTempFileIn(BundleCacheDir, bundle.FileId)
+	if err != nil {
+		return nil, err
+	}
+	if bundle.Sha256 != "" {
+		sha256, err := FileSha256(file)
+		if err != nil {
+			RemoveTempFile(file)
+			return nil, err
+		}
+		if sha256 != bundle.Sha256 {
+			RemoveTempFile(file)
+			return nil, ErrChecksumMismatch
+		}
+	}
+	// the concurrent download may have been renamed already, but the content is the same
+	if err := os.Rename(file.Name(), path); err != nil {
+		RemoveTempFile(file)
+		return nil, err
+	}
+
+	if err := pruneBundleCache(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// pruneBundleCache removes the least recently used files over BundleCacheCount.
+// The opened files can be still read after they are removed.
+func pruneBundleCache() error {
+	infos, err := ioutil.ReadDir(BundleCacheDir)
+	if err != nil {
+		return err
+	}
+
+	var cached []os.FileInfo
+	for _, info := range infos {
+		// the files being downloaded have other names
+		if info.Mode().IsRegular() && len(info.Name()) == sha256.Size*2 {
+			cached = append(cached, info)
+		}
+	}
+	if len(cached) <= BundleCacheCount {
+		return nil
+	}
+
+	sort.Sort(fileInfosByModTime(cached))
+	for _, info := range cached[:len(cached)-BundleCacheCount] {
+		if err := os.Remove(filepath.Join(BundleCacheDir, info.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+type fileInfosByModTime []os.FileInfo
+
+func (s fileInfosByModTime) Len() int           { return len(s) }
+func (s fileInfosByModTime) Less(i, j int) bool { return s[i].ModTime().Before(s[j].ModTime()) }
+func (s fileInfosByModTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+var (
+	binaryXmlHeader   = []byte{0x03, 0x00, 0x08, 0x00}
+	binaryPlistHeader = []byte("bplist00")
+)
+
+// DecodeBundleEntry converts the content of a file to readable text.
+// Android binary XML and binary plist are decoded to XML.
+// It returns false if the content is not text.
+func DecodeBundleEntry(data []byte) (string, bool) {
+	switch {
+	case bytes.HasPrefix(data, binaryXmlHeader):
+		xmlFile, err := androidbinary.NewXMLFile(bytes.NewReader(data))
+		if err != nil {
+			return "", false
+		}
+		buf, err := ioutil.ReadAll(xmlFile.Reader())
+		if err != nil {
+			return "", false
+		}
+		return string(buf), true
+
+	case bytes.HasPrefix(data, binaryPlistHeader):
+		var v interface{}
+		if _, err := plist.Unmarshal(data, &v); err != nil {
+			return "", false
+		}
+		buf, err := plist.MarshalIndent(v, plist.XMLFormat, "\t")
+		if err != nil {
+			return "", false
+		}
+		return string(buf), true
+
+	case utf8.Valid(data) && bytes.IndexByte(data, 0) < 0:
+		return string(data), true
+	}
+
+	return "", false
+}
@@ -3,33 +3,80 @@ package models
 import (
 	"archive/zip"
 	"bytes"
+	"encoding/json"
 	"encoding/xml"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/DHowett/go-plist"
 	"github.com/shogo82148/androidbinary"
 )
 
 var reInfoPlist = regexp.MustCompile(`Payload/[^/]+/Info\.plist`)
+var reSimulatorInfoPlist = regexp.MustCompile(`^[^/]+\.app/Info\.plist$`)
+var reUsageDescriptionKey = regexp.MustCompile(`^NS[A-Za-z]*UsageDescription$`)
 
 // a BundleInfo is information of an application package(apk file, ipa file, etc.)
 type BundleInfo struct {
-	Version      string
-	Identifier   string
-	PlatformType BundlePlatformType
+	Version          string
+	Identifier       string
+	MinSdkVersion    string
+	TargetSdkVersion string
+	Executable       string
+	PlatformType     BundlePlatformType
+	Splits           []*BundleSplit
+
+	Permissions            []string          // Android permissions, iOS privacy usage keys
+	UsageDescriptions      map[string]string // iOS privacy usage descriptions by key
+	Entitlements           map[string]string
+	CertificateFingerprint string
+	Flags                  map[string]string // security related flags such as "android:debuggable"
 }
 
 type androidManifest struct {
 	XMLName     xml.Name `xml:"manifest"`
+	Package     string   `xml:"package,attr"`
 	VersionName string   `xml:"http://schemas.android.com/apk/res/android versionName,attr"`
+	UsesSdk     struct {
+		MinSdkVersion    string `xml:"http://schemas.android.com/apk/res/android minSdkVersion,attr"`
+		TargetSdkVersion string `xml:"http://schemas.android.com/apk/res/android targetSdkVersion,attr"`
+	} `xml:"uses-sdk"`
+	Application struct {
+		Debuggable           string `xml:"http://schemas.android.com/apk/res/android debuggable,attr"`
+		AllowBackup          string `xml:"http://schemas.android.com/apk/res/android allowBackup,attr"`
+		UsesCleartextTraffic string `xml:"http://schemas.android.com/apk/res/android usesCleartextTraffic,attr"`
+	} `xml:"application"`
+	UsesPermissions      []androidPermission `xml:"uses-permission"`
+	UsesPermissionsSdk23 []androidPermission `xml:"uses-permission-sdk-23"`
+}
+
+type androidPermission struct {
+	Name string `xml:"http://schemas.android.com/apk/res/android name,attr"`
 }
 
 type iosInfo struct {
-	CFBundleVersion    string `plist:"CFBundleVersion"`
-	CFBundleIdentifier string `plist:"CFBundleIdentifier"`
+	CFBundleVersion        string `plist:"CFBundleVersion"`
+	CFBundleIdentifier     string `plist:"CFBundleIdentifier"`
+	CFBundleExecutable     string `plist:"CFBundleExecutable"`
+	NSAppTransportSecurity struct {
+		NSAllowsArbitraryLoads bool `plist:"NSAllowsArbitraryLoads"`
+	} `plist:"NSAppTransportSecurity"`
+}
+
+type xapkManifest struct {
+	PackageName string `json:"package_name"`
+	SplitApks   []struct {
+		File string `json:"file"`
+		Id   string `json:"id"`
+	} `json:"split_apks"`
 }
 
 type BundleParseError struct {
@@ -41,41 +88,135 @@ func (e *BundleParseError) Error() string {
 }
 
 func NewBundleInfo(file *os.File, platformType BundlePlatformType) (*BundleInfo, error) {
-	stat, err := file.Stat()
-	if err != nil {
-		return nil, err
+	platform := platformType.Platform()
+	if platform == nil {
+		return nil, errors.New("unknown platform")
 	}
 
-	reader, err := zip.NewReader(file, stat.Size())
+	return platform.Parse(file)
+}
+
+// bundleSystemFiles are the files which have the metadata of an application package.
+type bundleSystemFiles struct {
+	xmlFile            *zip.File   // apk system file
+	plistFile          *zip.File   // ipa system file
+	protoXmlFile       *zip.File   // aab system file
+	apkFiles           []*zip.File // apks, xapk splits
+	xapkManifestFile   *zip.File   // xapk system file
+	simulatorPlistFile *zip.File   // simulator app system file
+	signatureFile      *zip.File   // v1 signature block of apk and aab
+	provisionFile      *zip.File   // provisioning profile of ipa
+}
+
+func searchSystemFiles(file *os.File) (*bundleSystemFiles, error) {
+	reader, err := newZipReader(file)
 	if err != nil {
 		return nil, err
 	}
 
-	// search system files
-	var xmlFile *zip.File   // apk system file
-	var plistFile *zip.File // ipa system file
+	files := &bundleSystemFiles{}
 	for _, f := range reader.File {
 		switch {
+		case path.Ext(f.Name) == ".apk":
+			files.apkFiles = append(files.apkFiles, f)
+		case f.Name == "manifest.json":
+			files.xapkManifestFile = f
 		case f.Name == "AndroidManifest.xml":
-			xmlFile = f
+			files.xmlFile = f
+		case f.Name == "base/manifest/AndroidManifest.xml":
+			files.protoXmlFile = f
 		case reInfoPlist.MatchString(f.Name):
-			plistFile = f
+			files.plistFile = f
+		case reSimulatorInfoPlist.MatchString(f.Name):
+			files.simulatorPlistFile = f
+		case reSignatureBlock.MatchString(f.Name):
+			files.signatureFile = f
+		case reMobileProvision.MatchString(f.Name):
+			files.provisionFile = f
 		}
 	}
 
-	// parse an apk file
-	if platformType == BundlePlatformTypeAndroid {
-		bundleInfo, err := parseApkFile(xmlFile)
-		return bundleInfo, err
+	return files, nil
+}
+
+// parse an apk file
+func parseApk(file *os.File) (*BundleInfo, error) {
+	files, err := searchSystemFiles(file)
+	if err != nil {
+		return nil, err
+	}
+
+	bundleInfo, err := parseApkFile(files.xmlFile)
+	if err != nil {
+		return nil, err
+	}
+	bundleInfo.CertificateFingerprint = apkCertificateFingerprint(file, files.signatureFile)
+
+	return bundleInfo, nil
+}
+
+// parse an ipa file
+func parseIpa(file *os.File) (*BundleInfo, error) {
+	files, err := searchSystemFiles(file)
+	if err != nil {
+		return nil, err
+	}
+
+	bundleInfo, err := parseIpaFile(files.plistFile)
+	if err != nil {
+		return nil, err
+	}
+	applyMobileProvision(bundleInfo, files.provisionFile)
+
+	return bundleInfo, nil
+}
+
+// parse an aab file
+func parseAab(file *os.File) (*BundleInfo, error) {
+	files, err := searchSystemFiles(file)
+	if err != nil {
+		return nil, err
+	}
+
+	bundleInfo, err := parseAabFile(files.protoXmlFile)
+	if err != nil {
+		return nil, err
+	}
+	bundleInfo.CertificateFingerprint = androidCertificateFingerprint(files.signatureFile)
+
+	return bundleInfo, nil
+}
+
+// parse an apks or xapk file
+func parseApkSet(file *os.File) (*BundleInfo, error) {
+	files, err := searchSystemFiles(file)
+	if err != nil {
+		return nil, err
+	}
+	return parseApkSetFile(files.apkFiles, files.xapkManifestFile)
+}
+
+// parse a zipped simulator app
+func parseIOSSimulatorApp(file *os.File) (*BundleInfo, error) {
+	files, err := searchSystemFiles(file)
+	if err != nil {
+		return nil, err
 	}
 
-	// parse an ipa file
-	if platformType == BundlePlatformTypeIOS {
-		bundleInfo, err := parseIpaFile(plistFile)
-		return bundleInfo, err
+	bundleInfo, err := parseIpaFile(files.simulatorPlistFile)
+	if err != nil {
+		return nil, err
 	}
+	bundleInfo.PlatformType = BundlePlatformTypeIOSSimulator
+
+	return bundleInfo, nil
+}
 
-	return nil, errors.New("unknown platform")
+// a generic file has no metadata. the version is supplied by the uploader.
+func parseGenericFile(file *os.File) (*BundleInfo, error) {
+	return &BundleInfo{
+		PlatformType: BundlePlatformTypeFile,
+	}, nil
 }
 
 func parseApkFile(xmlFile *zip.File) (*BundleInfo, error) {
@@ -90,11 +231,149 @@ func parseApkFile(xmlFile *zip.File) (*BundleInfo, error) {
 
 	bundleInfo := &BundleInfo{}
 	bundleInfo.Version = manifest.VersionName
+	bundleInfo.Identifier = manifest.Package
+	bundleInfo.MinSdkVersion = manifest.UsesSdk.MinSdkVersion
+	bundleInfo.TargetSdkVersion = manifest.UsesSdk.TargetSdkVersion
 	bundleInfo.PlatformType = BundlePlatformTypeAndroid
+	bundleInfo.Flags = map[string]string{
+		"android:debuggable":           manifest.Application.Debuggable,
+		"android:allowBackup":          manifest.Application.AllowBackup,
+		"android:usesCleartextTraffic": manifest.Application.UsesCleartextTraffic,
+	}
+	for _, permission := range append(manifest.UsesPermissions, manifest.UsesPermissionsSdk23...) {
+		bundleInfo.Permissions = append(bundleInfo.Permissions, permission.Name)
+	}
+	sort.Strings(bundleInfo.Permissions)
 
 	return bundleInfo, nil
 }
 
+func parseApkSetFile(apkFiles []*zip.File, xapkManifestFile *zip.File) (*BundleInfo, error) {
+	baseFile, err := findBaseSplit(apkFiles, xapkManifestFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// the base split may be large, so it is read from a temporary file instead of the memory
+	tmp, err := extractToTempFile(baseFile)
+	if err != nil {
+		return nil, err
+	}
+	defer RemoveTempFile(tmp)
+
+	info, err := tmp.Stat()
+	if err != nil {
+		return nil, err
+	}
+	reader, err := zip.NewReader(tmp, info.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	var xmlFile, signatureFile *zip.File
+	for _, f := range reader.File {
+		switch {
+		case f.Name == "AndroidManifest.xml":
+			xmlFile = f
+		case reSignatureBlock.MatchString(f.Name):
+			signatureFile = f
+		}
+	}
+
+	bundleInfo, err := parseApkFile(xmlFile)
+	if err != nil {
+		return nil, err
+	}
+	bundleInfo.PlatformType = BundlePlatformTypeApkSet
+	bundleInfo.CertificateFingerprint = apkCertificateFingerprint(tmp, signatureFile)
+
+	for _, f := range apkFiles {
+		bundleInfo.Splits = append(bundleInfo.Splits, &BundleSplit{
+			Name: f.Name,
+			Size: int64(f.UncompressedSize64),
+		})
+	}
+
+	return bundleInfo, nil
+}
+
+// extractToTempFile extracts the file in the zip to a temporary file.
+// The caller should remove the file by RemoveTempFile.
+func extractToTempFile(f *zip.File) (*os.File, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	tmp, err := ioutil.TempFile("", "alphawing")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(tmp, rc); err != nil {
+		RemoveTempFile(tmp)
+		return nil, err
+	}
+	return tmp, nil
+}
+
+// findBaseSplit returns the apk file which has the base manifest in the split apk set.
+func findBaseSplit(apkFiles []*zip.File, xapkManifestFile *zip.File) (*zip.File, error) {
+	if len(apkFiles) == 0 {
+		return nil, errors.New("apk file is not found")
+	}
+
+	baseNames := []string{"base-master.apk", "base.apk", "universal.apk"}
+	if xapkManifestFile != nil {
+		manifest, err := parseXapkManifest(xapkManifestFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, split := range manifest.SplitApks {
+			if split.Id == "base" {
+				baseNames = append([]string{split.File}, baseNames...)
+			}
+		}
+		baseNames = append(baseNames, manifest.PackageName+".apk")
+	}
+
+	for _, baseName := range baseNames {
+		for _, f := range apkFiles {
+			if path.Base(f.Name) == baseName {
+				return f, nil
+			}
+		}
+	}
+
+	// standalone apks only
+	for _, f := range apkFiles {
+		if strings.HasPrefix(f.Name, "standalones/") {
+			return f, nil
+		}
+	}
+
+	if len(apkFiles) == 1 {
+		return apkFiles[0], nil
+	}
+
+	return nil, errors.New("base apk file is not found")
+}
+
+func parseXapkManifest(manifestFile *zip.File) (*xapkManifest, error) {
+	rc, err := manifestFile.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	manifest := &xapkManifest{}
+	if err := json.NewDecoder(rc).Decode(manifest); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
 func parseAndroidManifest(xmlFile *zip.File) (*androidManifest, error) {
 	rc, err := xmlFile.Open()
 	if err != nil {
@@ -121,6 +400,63 @@ func parseAndroidManifest(xmlFile *zip.File) (*androidManifest, error) {
 	return manifest, nil
 }
 
+func parseAabFile(protoXmlFile *zip.File) (*BundleInfo, error) {
+	if protoXmlFile == nil {
+		return nil, errors.New("base/manifest/AndroidManifest.xml is not found")
+	}
+
+	manifest, err := parseProtoAndroidManifest(protoXmlFile)
+	if err != nil {
+		return nil, err
+	}
+
+	bundleInfo := &BundleInfo{}
+	bundleInfo.Version = manifest.Attribute(androidNamespaceUri, "versionName")
+	bundleInfo.Identifier = manifest.Attribute("", "package")
+	if usesSdk := manifest.Child("uses-sdk"); usesSdk != nil {
+		bundleInfo.MinSdkVersion = usesSdk.Attribute(androidNamespaceUri, "minSdkVersion")
+		bundleInfo.TargetSdkVersion = usesSdk.Attribute(androidNamespaceUri, "targetSdkVersion")
+	}
+	bundleInfo.Flags = map[string]string{}
+	if application := manifest.Child("application"); application != nil {
+		for _, name := range []string{"debuggable", "allowBackup", "usesCleartextTraffic"} {
+			bundleInfo.Flags["android:"+name] = application.Attribute(androidNamespaceUri, name)
+		}
+	}
+	for _, name := range []string{"uses-permission", "uses-permission-sdk-23"} {
+		for _, permission := range manifest.ChildrenByName(name) {
+			bundleInfo.Permissions = append(bundleInfo.Permissions, permission.Attribute(androidNamespaceUri, "name"))
+		}
+	}
+	sort.Strings(bundleInfo.Permissions)
+	bundleInfo.PlatformType = BundlePlatformTypeAndroidAppBundle
+
+	return bundleInfo, nil
+}
+
+func parseProtoAndroidManifest(protoXmlFile *zip.File) (*protoXmlElement, error) {
+	rc, err := protoXmlFile.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	buf, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := parseProtoXmlNode(buf)
+	if err != nil {
+		return nil, err
+	}
+	if manifest == nil || manifest.Name != "manifest" {
+		return nil, errors.New("manifest element is not found")
+	}
+
+	return manifest, nil
+}
+
 func parseIpaFile(plistFile *zip.File) (*BundleInfo, error) {
 	if plistFile == nil {
 		return nil, errors.New("info.plist is not found")
@@ -143,10 +479,27 @@ func parseIpaFile(plistFile *zip.File) (*BundleInfo, error) {
 		return nil, err
 	}
 
+	var keys map[string]interface{}
+	if _, err := plist.Unmarshal(buf, &keys); err != nil {
+		return nil, err
+	}
+
 	bundleInfo := &BundleInfo{}
 	bundleInfo.Version = info.CFBundleVersion
 	bundleInfo.Identifier = info.CFBundleIdentifier
+	bundleInfo.Executable = info.CFBundleExecutable
 	bundleInfo.PlatformType = BundlePlatformTypeIOS
+	bundleInfo.Flags = map[string]string{
+		"NSAllowsArbitraryLoads": strconv.FormatBool(info.NSAppTransportSecurity.NSAllowsArbitraryLoads),
+	}
+	bundleInfo.UsageDescriptions = map[string]string{}
+	for key, value := range keys {
+		if reUsageDescriptionKey.MatchString(key) {
+			bundleInfo.Permissions = append(bundleInfo.Permissions, key)
+			bundleInfo.UsageDescriptions[key] = fmt.Sprint(value)
+		}
+	}
+	sort.Strings(bundleInfo.Permissions)
 
 	return bundleInfo, nil
 }
@@ -0,0 +1,112 @@
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/coopernurse/gorp"
+)
+
+// a BundleMetadata is a custom key-value pair attached to a bundle.
+type BundleMetadata struct {
+	Id        int       `db:"id"`
+	BundleId  int       `db:"bundle_id"`
+	Key       string    `db:"meta_key"`
+	Value     string    `db:"meta_value"`
+	CreatedAt time.Time `db:"created_at"`
+	UpdatedAt time.Time `db:"updated_at"`
+}
+
+var reBundleMetadataKey = regexp.MustCompile(`^[A-Za-z0-9_.\-]{1,64}$`)
+
+// IsValidBundleMetadataKey reports whether the key can be used as the key of metadata.
+func IsValidBundleMetadataKey(key string) bool {
+	return reBundleMetadataKey.MatchString(key)
+}
+
+// ParseBundleMetadataLines parses the metadata written as a "key=value" per line.
+// Blank lines are ignored.
+func ParseBundleMetadataLines(text string) (map[string]string, error) {
+	values := map[string]string{}
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		key := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || !IsValidBundleMetadataKey(key) {
+			return nil, fmt.Errorf("metadata %q is invalid", line)
+		}
+		values[key] = strings.TrimSpace(kv[1])
+	}
+	return values, nil
+}
+
+func (metadata *BundleMetadata) PreInsert(s gorp.SqlExecutor) error {
+	metadata.CreatedAt = time.Now()
+	metadata.UpdatedAt = metadata.CreatedAt
+	return nil
+}
+
+func (metadata *BundleMetadata) PreUpdate(s gorp.SqlExecutor) error {
+	metadata.UpdatedAt = time.Now()
+	return nil
+}
+
+func (metadata *BundleMetadata) Save(txn gorp.SqlExecutor) error {
+	return txn.Insert(metadata)
+}
+
+func (bundle *Bundle) MetadataList(txn gorp.SqlExecutor) ([]*BundleMetadata, error) {
+	var metadataList []*BundleMetadata
+	_, err := txn.Select(&metadataList, "SELECT * FROM bundle_metadata WHERE bundle_id = ? ORDER BY meta_key ASC", bundle.Id)
+	if err != nil {
+		return nil, err
+	}
+	return metadataList, nil
+}
+
+// LoadMetadata sets the metadata of the bundle to Metadata for the JSON response.
+func (bundle *Bundle) LoadMetadata(txn gorp.SqlExecutor) error {
+	metadataList, err := bundle.MetadataList(txn)
+	if err != nil {
+		return err
+	}
+
+	bundle.Metadata = map[string]string{}
+	for _, metadata := range metadataList {
+		bundle.Metadata[metadata.Key] = metadata.Value
+	}
+	return nil
+}
+
+// UpdateMetadata sets the values of the keys.
+// The keys of empty values are removed, and the other keys are kept.
+func (bundle *Bundle) UpdateMetadata(txn gorp.SqlExecutor, values map[string]string) error {
+	for key, value := range values {
+		if _, err := txn.Exec("DELETE FROM bundle_metadata WHERE bundle_id = ? AND meta_key = ?", bundle.Id, key); err != nil {
+			return err
+		}
+		if value == "" {
+			continue
+		}
+
+		metadata := &BundleMetadata{
+			BundleId: bundle.Id,
+			Key:      key,
+			Value:    value,
+		}
+		if err := metadata.Save(txn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func DeleteBundleMetadataByBundleId(txn gorp.SqlExecutor, bundleId int) error {
+	_, err := txn.Exec("DELETE FROM bundle_metadata WHERE bundle_id = ?", bundleId)
+	return err
+}
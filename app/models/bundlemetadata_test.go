@@ -0,0 +1,51 @@
+package models
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseBundleMetadataLines(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want map[string]string
+	}{
+		{"empty", "", map[string]string{}},
+		{"pairs", "channel=beta\nflavor=staging", map[string]string{"channel": "beta", "flavor": "staging"}},
+		{"spaces and blank lines", "  channel = beta  \n\n\r\nbuild.type=debug\r\n", map[string]string{"channel": "beta", "build.type": "debug"}},
+		{"value with equals", "query=a=b", map[string]string{"query": "a=b"}},
+		{"empty value", "channel=", map[string]string{"channel": ""}},
+		{"last value wins", "channel=alpha\nchannel=beta", map[string]string{"channel": "beta"}},
+		{"long key", strings.Repeat("k", 64) + "=v", map[string]string{strings.Repeat("k", 64): "v"}},
+	}
+	for _, test := range tests {
+		values, err := ParseBundleMetadataLines(test.text)
+		if err != nil {
+			t.Errorf("%s: returned an error: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(values, test.want) {
+			t.Errorf("%s: values are %v, want %v", test.name, values, test.want)
+		}
+	}
+}
+
+func TestParseBundleMetadataLinesInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+	}{
+		{"no equals", "channel"},
+		{"empty key", "=beta"},
+		{"invalid key", "release channel=beta"},
+		{"too long key", strings.Repeat("k", 65) + "=v"},
+		{"invalid line after valid", "channel=beta\nflavor"},
+	}
+	for _, test := range tests {
+		if values, err := ParseBundleMetadataLines(test.text); err == nil {
+			t.Errorf("%s: returned %v without an error", test.name, values)
+		}
+	}
+}
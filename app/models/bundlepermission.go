@@ -0,0 +1,164 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coopernurse/gorp"
+)
+
+type BundlePermissionKind int
+
+const (
+	BundlePermissionKindPermission BundlePermissionKind = 1 + iota
+	BundlePermissionKindUsageDescription
+	BundlePermissionKindEntitlement
+)
+
+func (kind BundlePermissionKind) String() string {
+	switch kind {
+	case BundlePermissionKindPermission:
+		return "permission"
+	case BundlePermissionKindUsageDescription:
+		return "usage_description"
+	case BundlePermissionKindEntitlement:
+		return "entitlement"
+	}
+	return ""
+}
+
+// a BundlePermission is a permission, a privacy usage description or an entitlement requested by a bundle.
+type BundlePermission struct {
+	Id          int                  `db:"id"`
+	BundleId    int                  `db:"bundle_id"`
+	Kind        BundlePermissionKind `db:"kind"`
+	Name        string               `db:"name"`
+	Description string               `db:"description"`
+	CreatedAt   time.Time            `db:"created_at"`
+	UpdatedAt   time.Time            `db:"updated_at"`
+
+	IsNew bool `db:"-"`
+}
+
+func (permission *BundlePermission) PreInsert(s gorp.SqlExecutor) error {
+	permission.CreatedAt = time.Now()
+	permission.UpdatedAt = permission.CreatedAt
+	return nil
+}
+
+func (permission *BundlePermission) PreUpdate(s gorp.SqlExecutor) error {
+	permission.UpdatedAt = time.Now()
+	return nil
+}
+
+func (permission *BundlePermission) Save(txn gorp.SqlExecutor) error {
+	return txn.Insert(permission)
+}
+
+func (permission *BundlePermission) key() string {
+	return fmt.Sprintf("%d:%s", permission.Kind, permission.Name)
+}
+
+// NewBundlePermissions returns the records of the permissions in the bundle information.
+func NewBundlePermissions(bundleInfo *BundleInfo) []*BundlePermission {
+	var permissions []*BundlePermission
+	for _, name := range bundleInfo.Permissions {
+		if description, ok := bundleInfo.UsageDescriptions[name]; ok {
+			permissions = append(permissions, &BundlePermission{
+				Kind:        BundlePermissionKindUsageDescription,
+				Name:        name,
+				Description: description,
+			})
+			continue
+		}
+		permissions = append(permissions, &BundlePermission{
+			Kind: BundlePermissionKindPermission,
+			Name: name,
+		})
+	}
+
+	var keys []string
+	for key := range bundleInfo.Entitlements {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		permissions = append(permissions, &BundlePermission{
+			Kind:        BundlePermissionKindEntitlement,
+			Name:        key,
+			Description: bundleInfo.Entitlements[key],
+		})
+	}
+
+	return permissions
+}
+
+// MarkNewPermissions marks the permissions which the previous bundle doesn't have, and returns them.
+// Nothing is marked without the previous bundle.
+func MarkNewPermissions(txn gorp.SqlExecutor, permissions []*BundlePermission, previous *Bundle) ([]*BundlePermission, error) {
+	if previous == nil {
+		return nil, nil
+	}
+
+	previousPermissions, err := previous.Permissions(txn)
+	if err != nil {
+		return nil, err
+	}
+	exists := map[string]bool{}
+	for _, permission := range previousPermissions {
+		exists[permission.key()] = true
+	}
+
+	var newPermissions []*BundlePermission
+	for _, permission := range permissions {
+		if !exists[permission.key()] {
+			permission.IsNew = true
+			newPermissions = append(newPermissions, permission)
+		}
+	}
+	return newPermissions, nil
+}
+
+// NotifyNewPermissions posts the message about the new permissions to the incoming webhook.
+// The payload is compatible with Slack.
+func NotifyNewPermissions(webhookUrl string, app *App, bundle *Bundle, bundleUrl string, permissions []*BundlePermission) error {
+	var lines []string
+	for _, permission := range permissions {
+		lines = append(lines, fmt.Sprintf("- %s (%s)", permission.Name, permission.Kind))
+	}
+	text := fmt.Sprintf(
+		"%s %s #%d (%s) requests new permissions.\n%s\n%s",
+		app.Title,
+		bundle.BundleVersion,
+		bundle.Revision,
+		bundle.PlatformType,
+		strings.Join(lines, "\n"),
+		bundleUrl,
+	)
+
+	payload, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.Post(webhookUrl, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func DeleteBundlePermissionsByBundleId(txn gorp.SqlExecutor, bundleId int) error {
+	_, err := txn.Exec("DELETE FROM bundle_permission WHERE bundle_id = ?", bundleId)
+	return err
+}
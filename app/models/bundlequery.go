@@ -0,0 +1,242 @@
+package models
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coopernurse/gorp"
+)
+
+// BundleChannelMetadataKey is the key of the metadata used as the release channel of bundles.
+const BundleChannelMetadataKey = "channel"
+
+var ErrInvalidBundleCursor = errors.New("cursor is invalid")
+
+// a BundleSort is the order of listing bundles.
+// The id breaks ties, so the order is total.
+type BundleSort struct {
+	Name string // the name in the API, such as "created_at"
+	Desc bool
+}
+
+// the sortable columns by the name in the API
+var bundleSortColumns = map[string]string{
+	"created_at": "created_at",
+	"version":    "bundle_version",
+	"file_size":  "file_size",
+}
+
+var DefaultBundleSort = BundleSort{Name: "created_at", Desc: true}
+
+// ParseBundleSort parses the sort such as "created_at" (ascending) or "-created_at" (descending).
+func ParseBundleSort(str string) (BundleSort, error) {
+	if str == "" {
+		return DefaultBundleSort, nil
+	}
+
+	sort := BundleSort{Name: strings.TrimPrefix(str, "-"), Desc: strings.HasPrefix(str, "-")}
+	if _, ok := bundleSortColumns[sort.Name]; !ok {
+		return sort, fmt.Errorf("sort %q is invalid", str)
+	}
+	return sort, nil
+}
+
+func (sort BundleSort) String() string {
+	if sort.Desc {
+		return "-" + sort.Name
+	}
+	return sort.Name
+}
+
+func (sort BundleSort) column() string {
+	return bundleSortColumns[sort.Name]
+}
+
+func (sort BundleSort) value(bundle *Bundle) string {
+	switch sort.Name {
+	case "version":
+		return bundle.BundleVersion
+	case "file_size":
+		return strconv.FormatInt(bundle.FileSize, 10)
+	}
+	return bundle.CreatedAt.Format(time.RFC3339Nano)
+}
+
+func (sort BundleSort) parseValue(str string) (interface{}, error) {
+	switch sort.Name {
+	case "version":
+		return str, nil
+	case "file_size":
+		return strconv.ParseInt(str, 10, 64)
+	}
+	return time.Parse(time.RFC3339Nano, str)
+}
+
+// a bundleCursor points the last bundle of a page.
+// It is encoded in the API as an opaque string.
+type bundleCursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	Id    int    `json:"i"`
+}
+
+func encodeBundleCursor(sort BundleSort, bundle *Bundle) string {
+	b, _ := json.Marshal(&bundleCursor{
+		Sort:  sort.String(),
+		Value: sort.value(bundle),
+		Id:    bundle.Id,
+	})
+	return base64.URLEncoding.EncodeToString(b)
+}
+
+func decodeBundleCursor(str string) (*bundleCursor, error) {
+	b, err := base64.URLEncoding.DecodeString(str)
+	if err != nil {
+		return nil, ErrInvalidBundleCursor
+	}
+	var cursor bundleCursor
+	if err := json.Unmarshal(b, &cursor); err != nil {
+		return nil, ErrInvalidBundleCursor
+	}
+	return &cursor, nil
+}
+
+// a BundleQuery is the conditions to list bundles of an app.
+// The zero values are not used as conditions.
+type BundleQuery struct {
+	PlatformType BundlePlatformType
+	Version      string
+	Identifier   string
+	Channel      string
+	CommitSha    string // a prefix of the commit SHA
+	Branch       string
+	BuildNumber  string
+	Search       string // a part of the description
+	Since        time.Time
+	Until        time.Time
+	Sort         BundleSort
+	Limit        int
+
+	// The page is given either by the cursor or the page number.
+	// The cursor is stable while bundles are uploaded.
+	Cursor string
+	Page   int
+}
+
+// escapeLike escapes the wildcards of LIKE with "!".
+func escapeLike(str string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(str)
+}
+
+// where returns the conditions except the cursor.
+func (query *BundleQuery) where(app *App) ([]string, []interface{}) {
+	conditions := []string{"app_id = ?"}
+	args := []interface{}{app.Id}
+
+	if query.PlatformType != 0 {
+		conditions = append(conditions, "platform_type = ?")
+		args = append(args, query.PlatformType)
+	}
+	if query.Version != "" {
+		conditions = append(conditions, "bundle_version = ?")
+		args = append(args, query.Version)
+	}
+	if query.Identifier != "" {
+		conditions = append(conditions, "bundle_identifier = ?")
+		args = append(args, query.Identifier)
+	}
+	if query.Channel != "" {
+		conditions = append(conditions, "id IN (SELECT bundle_id FROM bundle_metadata WHERE meta_key = ? AND meta_value = ?)")
+		args = append(args, BundleChannelMetadataKey, query.Channel)
+	}
+	if query.CommitSha != "" {
+		conditions = append(conditions, "id IN (SELECT bundle_id FROM bundle_build WHERE commit_sha LIKE ? ESCAPE '!')")
+		args = append(args, escapeLike(query.CommitSha)+"%")
+	}
+	if query.Branch != "" {
+		conditions = append(conditions, "id IN (SELECT bundle_id FROM bundle_build WHERE branch = ?)")
+		args = append(args, query.Branch)
+	}
+	if query.BuildNumber != "" {
+		conditions = append(conditions, "id IN (SELECT bundle_id FROM bundle_build WHERE build_number = ?)")
+		args = append(args, query.BuildNumber)
+	}
+	if query.Search != "" {
+		conditions = append(conditions, "description LIKE ? ESCAPE '!'")
+		args = append(args, "%"+escapeLike(query.Search)+"%")
+	}
+	if !query.Since.IsZero() {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, query.Since)
+	}
+	if !query.Until.IsZero() {
+		conditions = append(conditions, "created_at < ?")
+		args = append(args, query.Until)
+	}
+	return conditions, args
+}
+
+// QueryBundles returns the bundles matched to the query, the total count of them, and the cursor of the next page.
+// The next cursor is empty at the last page.
+// It returns ErrInvalidBundleCursor if the cursor is broken or made for another sort.
+func (app *App) QueryBundles(txn gorp.SqlExecutor, query *BundleQuery) (Bundles, int, string, error) {
+	if query.Limit < 1 {
+		return nil, 0, "", errors.New("limit must be positive")
+	}
+
+	conditions, args := query.where(app)
+
+	count, err := txn.SelectInt(fmt.Sprintf("SELECT COUNT(*) FROM bundle WHERE %s", strings.Join(conditions, " AND ")), args...)
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	sort := query.Sort
+	if sort.Name == "" {
+		sort = DefaultBundleSort
+	}
+	column := sort.column()
+	direction, operator := "ASC", ">"
+	if sort.Desc {
+		direction, operator = "DESC", "<"
+	}
+
+	offset := 0
+	if query.Cursor != "" {
+		cursor, err := decodeBundleCursor(query.Cursor)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		if cursor.Sort != sort.String() {
+			return nil, 0, "", ErrInvalidBundleCursor
+		}
+		value, err := sort.parseValue(cursor.Value)
+		if err != nil {
+			return nil, 0, "", ErrInvalidBundleCursor
+		}
+		conditions = append(conditions, fmt.Sprintf("(%s %s ? OR (%s = ? AND id %s ?))", column, operator, column, operator))
+		args = append(args, value, value, cursor.Id)
+	} else if query.Page > 1 {
+		offset = (query.Page - 1) * query.Limit
+	}
+
+	// one more bundle is selected to know whether the next page exists
+	var bundles []*Bundle
+	_, err = txn.Select(&bundles, fmt.Sprintf("SELECT * FROM bundle WHERE %s ORDER BY %s %s, id %s LIMIT ? OFFSET ?", strings.Join(conditions, " AND "), column, direction, direction), append(args, query.Limit+1, offset)...)
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	var next string
+	if len(bundles) > query.Limit {
+		bundles = bundles[:query.Limit]
+		next = encodeBundleCursor(sort, bundles[len(bundles)-1])
+	}
+
+	return Bundles(bundles), int(count), next, nil
+}
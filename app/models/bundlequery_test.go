@@ -0,0 +1,102 @@
+package models
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestParseBundleSort(t *testing.T) {
+	tests := []struct {
+		str  string
+		want BundleSort
+	}{
+		{"", DefaultBundleSort},
+		{"created_at", BundleSort{Name: "created_at"}},
+		{"-created_at", BundleSort{Name: "created_at", Desc: true}},
+		{"version", BundleSort{Name: "version"}},
+		{"-file_size", BundleSort{Name: "file_size", Desc: true}},
+	}
+	for _, test := range tests {
+		sort, err := ParseBundleSort(test.str)
+		if err != nil {
+			t.Errorf("%q: returned an error: %s", test.str, err)
+			continue
+		}
+		if sort != test.want {
+			t.Errorf("%q: sort is %+v, want %+v", test.str, sort, test.want)
+		}
+		if test.str != "" && sort.String() != test.str {
+			t.Errorf("%q: String() is %q", test.str, sort.String())
+		}
+	}
+
+	for _, str := range []string{"id", "-", "--created_at", "bundle_version"} {
+		if _, err := ParseBundleSort(str); err == nil {
+			t.Errorf("%q: returned no error", str)
+		}
+	}
+}
+
+func TestBundleCursor(t *testing.T) {
+	bundle := &Bundle{
+		Id:            42,
+		BundleVersion: "1.2.3",
+		FileSize:      123456789,
+		CreatedAt:     time.Date(2014, 4, 1, 12, 34, 56, 789000000, time.UTC),
+	}
+
+	tests := []struct {
+		sort  BundleSort
+		value interface{}
+	}{
+		{BundleSort{Name: "created_at", Desc: true}, bundle.CreatedAt},
+		{BundleSort{Name: "version"}, bundle.BundleVersion},
+		{BundleSort{Name: "file_size", Desc: true}, bundle.FileSize},
+	}
+	for _, test := range tests {
+		cursor, err := decodeBundleCursor(encodeBundleCursor(test.sort, bundle))
+		if err != nil {
+			t.Errorf("%s: returned an error: %s", test.sort, err)
+			continue
+		}
+		if cursor.Sort != test.sort.String() || cursor.Id != bundle.Id {
+			t.Errorf("%s: cursor is %+v", test.sort, cursor)
+		}
+		value, err := test.sort.parseValue(cursor.Value)
+		if err != nil {
+			t.Errorf("%s: the value %q is invalid: %s", test.sort, cursor.Value, err)
+			continue
+		}
+		if tm, ok := test.value.(time.Time); ok {
+			if !tm.Equal(value.(time.Time)) {
+				t.Errorf("%s: value is %v, want %v", test.sort, value, tm)
+			}
+		} else if value != test.value {
+			t.Errorf("%s: value is %v, want %v", test.sort, value, test.value)
+		}
+	}
+}
+
+func TestDecodeBundleCursorInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		str  string
+	}{
+		{"empty", ""},
+		{"not base64", "!!!"},
+		{"not json", base64.URLEncoding.EncodeToString([]byte("cursor"))},
+		{"wrong type", base64.URLEncoding.EncodeToString([]byte(`{"s":"created_at","v":"x","i":"1"}`))},
+	}
+	for _, test := range tests {
+		if _, err := decodeBundleCursor(test.str); err != ErrInvalidBundleCursor {
+			t.Errorf("%s: error is %v, want %v", test.name, err, ErrInvalidBundleCursor)
+		}
+	}
+
+	// the value of another sort
+	sort := BundleSort{Name: "file_size"}
+	if _, err := sort.parseValue("1.2.3"); err == nil {
+		t.Errorf("parseValue returned no error for the version as the file size")
+	}
+}
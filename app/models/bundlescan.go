@@ -0,0 +1,223 @@
+package models
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/coopernurse/gorp"
+)
+
+type BundleScanPolicy int
+
+const (
+	BundleScanPolicyWarn BundleScanPolicy = iota
+	BundleScanPolicyReject
+)
+
+type BundleFindingKind int
+
+const (
+	BundleFindingKindFlag BundleFindingKind = 1 + iota
+	BundleFindingKindSecret
+)
+
+// maxScannedEntrySize is the max size of a file to grep for secrets.
+const maxScannedEntrySize = 16 * 1024 * 1024
+
+// the extensions of files which can have secrets as text
+var scannedEntryExtensions = map[string]bool{
+	".arsc":       true,
+	".pb":         true,
+	".plist":      true,
+	".json":       true,
+	".xml":        true,
+	".properties": true,
+	".txt":        true,
+	".js":         true,
+	".cfg":        true,
+	".ini":        true,
+}
+
+// a SecretPattern is a regular expression to find secrets in bundles.
+type SecretPattern struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+
+	re *regexp.Regexp
+}
+
+func (pattern *SecretPattern) Regexp() (*regexp.Regexp, error) {
+	if pattern.re == nil {
+		re, err := regexp.Compile(pattern.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		pattern.re = re
+	}
+	return pattern.re, nil
+}
+
+// SecretPatterns are the patterns used to scan bundles.
+// They can be replaced with LoadSecretPatterns.
+var SecretPatterns = []*SecretPattern{
+	{Name: "AWS Access Key ID", Pattern: `AKIA[0-9A-Z]{16}`},
+	{Name: "Google API Key", Pattern: `AIza[0-9A-Za-z_\-]{35}`},
+	{Name: "Slack Token", Pattern: `xox[abposr]-[0-9A-Za-z\-]{10,}`},
+	{Name: "Private Key", Pattern: `-----BEGIN (RSA |EC |DSA |OPENSSH )?PRIVATE KEY-----`},
+}
+
+// LoadSecretPatterns replaces SecretPatterns with the JSON file.
+func LoadSecretPatterns(filename string) error {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	var patterns []*SecretPattern
+	if err := json.Unmarshal(buf, &patterns); err != nil {
+		return err
+	}
+	for _, pattern := range patterns {
+		if _, err := pattern.Regexp(); err != nil {
+			return err
+		}
+	}
+
+	SecretPatterns = patterns
+	return nil
+}
+
+// a BundleFinding is a problem found in a bundle by the scanner.
+type BundleFinding struct {
+	Id        int               `db:"id"`
+	BundleId  int               `db:"bundle_id"`
+	Kind      BundleFindingKind `db:"kind"`
+	Rule      string            `db:"rule"`
+	Location  string            `db:"location"`
+	Excerpt   string            `db:"excerpt"`
+	CreatedAt time.Time         `db:"created_at"`
+	UpdatedAt time.Time         `db:"updated_at"`
+}
+
+func (finding *BundleFinding) PreInsert(s gorp.SqlExecutor) error {
+	finding.CreatedAt = time.Now()
+	finding.UpdatedAt = finding.CreatedAt
+	return nil
+}
+
+func (finding *BundleFinding) PreUpdate(s gorp.SqlExecutor) error {
+	finding.UpdatedAt = time.Now()
+	return nil
+}
+
+func (finding *BundleFinding) Save(txn gorp.SqlExecutor) error {
+	return txn.Insert(finding)
+}
+
+func (finding *BundleFinding) String() string {
+	if finding.Excerpt == "" {
+		return fmt.Sprintf("%s (%s)", finding.Rule, finding.Location)
+	}
+	return fmt.Sprintf("%s (%s: %s)", finding.Rule, finding.Location, finding.Excerpt)
+}
+
+func DeleteBundleFindingsByBundleId(txn gorp.SqlExecutor, bundleId int) error {
+	_, err := txn.Exec("DELETE FROM bundle_finding WHERE bundle_id = ?", bundleId)
+	return err
+}
+
+type BundleScanRejectedError struct {
+	Findings []*BundleFinding
+}
+
+func (e *BundleScanRejectedError) Error() string {
+	var findings []string
+	for _, finding := range e.Findings {
+		findings = append(findings, finding.String())
+	}
+	return "the bundle is rejected by the scanner: " + strings.Join(findings, ", ")
+}
+
+// the flags which must not be shipped to testers, and their dangerous values
+var dangerousFlags = []struct {
+	Name  string
+	Value string
+}{
+	{"android:debuggable", "true"},
+	{"android:allowBackup", "true"},
+	{"android:usesCleartextTraffic", "true"},
+	{"NSAllowsArbitraryLoads", "true"},
+}
+
+// ScanBundle checks the flags of the bundle and greps the text files in it for the secret patterns.
+func ScanBundle(file *os.File, bundleInfo *BundleInfo, patterns []*SecretPattern) ([]*BundleFinding, error) {
+	var findings []*BundleFinding
+
+	for _, flag := range dangerousFlags {
+		if bundleInfo.Flags[flag.Name] == flag.Value {
+			findings = append(findings, &BundleFinding{
+				Kind:     BundleFindingKindFlag,
+				Rule:     fmt.Sprintf("%s=%s", flag.Name, flag.Value),
+				Location: bundleInfo.PlatformType.Platform().Title,
+			})
+		}
+	}
+	if bundleInfo.Entitlements["get-task-allow"] == "true" {
+		findings = append(findings, &BundleFinding{
+			Kind:     BundleFindingKindFlag,
+			Rule:     "get-task-allow=true",
+			Location: "embedded.mobileprovision",
+		})
+	}
+
+	reader, err := newZipReader(file)
+	if err == zip.ErrFormat {
+		return findings, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range reader.File {
+		if !scannedEntryExtensions[path.Ext(f.Name)] || f.UncompressedSize64 > maxScannedEntrySize {
+			continue
+		}
+
+		data, err := readZipFile(f)
+		if err != nil {
+			return nil, err
+		}
+		for _, pattern := range patterns {
+			re, err := pattern.Regexp()
+			if err != nil {
+				return nil, err
+			}
+			if match := re.Find(data); match != nil {
+				findings = append(findings, &BundleFinding{
+					Kind:     BundleFindingKindSecret,
+					Rule:     pattern.Name,
+					Location: f.Name,
+					Excerpt:  maskSecret(string(match)),
+				})
+			}
+		}
+	}
+
+	return findings, nil
+}
+
+// maskSecret hides the secret except the first characters not to leak it again.
+func maskSecret(secret string) string {
+	const visible = 4
+	if len(secret) <= visible {
+		return strings.Repeat("*", len(secret))
+	}
+	return secret[:visible] + strings.Repeat("*", len(secret)-visible)
+}
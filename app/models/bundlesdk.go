@@ -0,0 +1,285 @@
+package models
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/DHowett/go-plist"
+	"github.com/coopernurse/gorp"
+)
+
+var reDexEntry = regexp.MustCompile(`(^|/)classes\d*\.dex$`)
+var reFrameworkInfoPlist = regexp.MustCompile(`(^|/)Frameworks/([^/]+)\.framework/Info\.plist$`)
+
+// a SdkSignature is the rule to detect a third-party SDK in bundles.
+type SdkSignature struct {
+	Name          string   `json:"name"`
+	ClassPrefixes []string `json:"class_prefixes"` // Android class name prefixes such as "com.example.sdk."
+	Libraries     []string `json:"libraries"`      // native library file names such as "libexample.so"
+	Frameworks    []string `json:"frameworks"`     // iOS framework names without ".framework"
+	VersionFile   string   `json:"version_file"`   // the file in the apk which has the version such as "META-INF/com.example_sdk.version"
+}
+
+// SdkSignatures are the signatures used to detect SDKs.
+// They can be replaced with LoadSdkSignatures.
+var SdkSignatures = []*SdkSignature{
+	{Name: "Firebase", ClassPrefixes: []string{"com.google.firebase."}, Frameworks: []string{"FirebaseCore"}, VersionFile: "META-INF/com.google.firebase_firebase-common.version"},
+	{Name: "Firebase Crashlytics", ClassPrefixes: []string{"com.google.firebase.crashlytics.", "com.crashlytics."}, Libraries: []string{"libcrashlytics.so"}, Frameworks: []string{"FirebaseCrashlytics", "Crashlytics"}},
+	{Name: "Google Play services", ClassPrefixes: []string{"com.google.android.gms."}, VersionFile: "META-INF/com.google.android.gms_play-services-basement.version"},
+	{Name: "Google Mobile Ads", ClassPrefixes: []string{"com.google.android.gms.ads."}, Frameworks: []string{"GoogleMobileAds"}, VersionFile: "META-INF/com.google.android.gms_play-services-ads.version"},
+	{Name: "Facebook SDK", ClassPrefixes: []string{"com.facebook."}, Frameworks: []string{"FBSDKCoreKit", "FBSDKLoginKit"}},
+	{Name: "Adjust", ClassPrefixes: []string{"com.adjust.sdk."}, Frameworks: []string{"AdjustSdk"}},
+	{Name: "AppsFlyer", ClassPrefixes: []string{"com.appsflyer."}, Frameworks: []string{"AppsFlyerLib"}},
+	{Name: "OkHttp", ClassPrefixes: []string{"okhttp3."}},
+	{Name: "Realm", ClassPrefixes: []string{"io.realm."}, Libraries: []string{"librealm-jni.so"}, Frameworks: []string{"Realm", "RealmSwift"}},
+	{Name: "Unity", ClassPrefixes: []string{"com.unity3d.player."}, Libraries: []string{"libunity.so"}, Frameworks: []string{"UnityFramework"}},
+	{Name: "Flutter", ClassPrefixes: []string{"io.flutter."}, Libraries: []string{"libflutter.so"}, Frameworks: []string{"Flutter"}},
+	{Name: "React Native", ClassPrefixes: []string{"com.facebook.react."}, Libraries: []string{"libreactnativejni.so"}, Frameworks: []string{"React"}},
+}
+
+// LoadSdkSignatures replaces SdkSignatures with the JSON file.
+func LoadSdkSignatures(filename string) error {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	var signatures []*SdkSignature
+	if err := json.Unmarshal(buf, &signatures); err != nil {
+		return err
+	}
+
+	SdkSignatures = signatures
+	return nil
+}
+
+// a BundleSdk is a third-party SDK detected in a bundle.
+type BundleSdk struct {
+	Id        int       `db:"id"`
+	BundleId  int       `db:"bundle_id"`
+	Name      string    `db:"name"`
+	Version   string    `db:"version"`
+	CreatedAt time.Time `db:"created_at"`
+	UpdatedAt time.Time `db:"updated_at"`
+}
+
+func (sdk *BundleSdk) PreInsert(s gorp.SqlExecutor) error {
+	sdk.CreatedAt = time.Now()
+	sdk.UpdatedAt = sdk.CreatedAt
+	return nil
+}
+
+func (sdk *BundleSdk) PreUpdate(s gorp.SqlExecutor) error {
+	sdk.UpdatedAt = time.Now()
+	return nil
+}
+
+func (sdk *BundleSdk) Save(txn gorp.SqlExecutor) error {
+	return txn.Insert(sdk)
+}
+
+func DeleteBundleSdksByBundleId(txn gorp.SqlExecutor, bundleId int) error {
+	_, err := txn.Exec("DELETE FROM bundle_sdk WHERE bundle_id = ?", bundleId)
+	return err
+}
+
+type frameworkInfo struct {
+	CFBundleShortVersionString string `plist:"CFBundleShortVersionString"`
+}
+
+// a sdkDetector collects the SDKs matched with the signatures.
+type sdkDetector struct {
+	signatures []*SdkSignature
+	sdks       map[string]*BundleSdk
+	versions   map[string]string // versions by the version file name
+}
+
+// DetectSdks returns the SDKs bundled in the file.
+// Split apks in apks and xapk files are scanned too.
+// Files other than zip archives have no SDKs.
+func DetectSdks(file *os.File, signatures []*SdkSignature) ([]*BundleSdk, error) {
+	reader, err := newZipReader(file)
+	if err == zip.ErrFormat {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	detector := &sdkDetector{
+		signatures: signatures,
+		sdks:       map[string]*BundleSdk{},
+		versions:   map[string]string{},
+	}
+	if err := detector.scan(reader, true); err != nil {
+		return nil, err
+	}
+
+	return detector.result(), nil
+}
+
+func (detector *sdkDetector) scan(reader *zip.Reader, nested bool) error {
+	for _, f := range reader.File {
+		switch {
+		case reDexEntry.MatchString(f.Name):
+			data, err := readZipFile(f)
+			if err != nil {
+				return err
+			}
+			names, err := dexClassNames(data)
+			if err != nil {
+				// obfuscated or broken dex files are not fatal
+				continue
+			}
+			detector.matchClasses(names)
+
+		case path.Ext(f.Name) == ".so":
+			detector.matchLibrary(path.Base(f.Name))
+
+		case path.Ext(f.Name) == ".version" && strings.Contains(f.Name, "META-INF/"):
+			data, err := readZipFile(f)
+			if err != nil {
+				return err
+			}
+			detector.versions[f.Name[strings.Index(f.Name, "META-INF/"):]] = strings.TrimSpace(string(data))
+
+		case reFrameworkInfoPlist.MatchString(f.Name):
+			name := reFrameworkInfoPlist.FindStringSubmatch(f.Name)[2]
+			data, err := readZipFile(f)
+			if err != nil {
+				return err
+			}
+			info := &frameworkInfo{}
+			if _, err := plist.Unmarshal(data, info); err != nil {
+				continue
+			}
+			detector.matchFramework(name, info.CFBundleShortVersionString)
+
+		case nested && path.Ext(f.Name) == ".apk":
+			data, err := readZipFile(f)
+			if err != nil {
+				return err
+			}
+			apkReader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+			if err != nil {
+				continue
+			}
+			if err := detector.scan(apkReader, false); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (detector *sdkDetector) add(signature *SdkSignature, version string) {
+	sdk, ok := detector.sdks[signature.Name]
+	if !ok {
+		sdk = &BundleSdk{Name: signature.Name}
+		detector.sdks[signature.Name] = sdk
+	}
+	if sdk.Version == "" {
+		sdk.Version = version
+	}
+}
+
+func (detector *sdkDetector) matchClasses(names []string) {
+	for _, signature := range detector.signatures {
+		if _, ok := detector.sdks[signature.Name]; ok {
+			continue
+		}
+	match:
+		for _, prefix := range signature.ClassPrefixes {
+			for _, name := range names {
+				if strings.HasPrefix(name, prefix) {
+					detector.add(signature, "")
+					break match
+				}
+			}
+		}
+	}
+}
+
+func (detector *sdkDetector) matchLibrary(name string) {
+	for _, signature := range detector.signatures {
+		for _, library := range signature.Libraries {
+			if library == name {
+				detector.add(signature, "")
+			}
+		}
+	}
+}
+
+func (detector *sdkDetector) matchFramework(name, version string) {
+	for _, signature := range detector.signatures {
+		for _, framework := range signature.Frameworks {
+			if framework == name {
+				detector.add(signature, version)
+			}
+		}
+	}
+}
+
+func (detector *sdkDetector) result() []*BundleSdk {
+	var sdks []*BundleSdk
+	for _, signature := range detector.signatures {
+		sdk, ok := detector.sdks[signature.Name]
+		if !ok {
+			continue
+		}
+		if sdk.Version == "" && signature.VersionFile != "" {
+			sdk.Version = detector.versions[signature.VersionFile]
+		}
+		sdks = append(sdks, sdk)
+	}
+	sort.Sort(bundleSdksByName(sdks))
+	return sdks
+}
+
+type bundleSdksByName []*BundleSdk
+
+func (s bundleSdksByName) Len() int           { return len(s) }
+func (s bundleSdksByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s bundleSdksByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// a BundleSdkHistory is the SDKs detected in a bundle of an app.
+type BundleSdkHistory struct {
+	Bundle *Bundle
+	Sdks   []*BundleSdk
+}
+
+// SdkHistory returns the SDKs of the bundles of the app in descending order.
+func (app *App) SdkHistory(txn gorp.SqlExecutor) ([]*BundleSdkHistory, error) {
+	bundles, err := app.Bundles(txn)
+	if err != nil {
+		return nil, err
+	}
+
+	var sdks []*BundleSdk
+	_, err = txn.Select(&sdks, "SELECT bundle_sdk.* FROM bundle_sdk INNER JOIN bundle ON bundle.id = bundle_sdk.bundle_id WHERE bundle.app_id = ? ORDER BY bundle_sdk.name ASC", app.Id)
+	if err != nil {
+		return nil, err
+	}
+	sdksByBundleId := map[int][]*BundleSdk{}
+	for _, sdk := range sdks {
+		sdksByBundleId[sdk.BundleId] = append(sdksByBundleId[sdk.BundleId], sdk)
+	}
+
+	history := make([]*BundleSdkHistory, 0, len(bundles))
+	for _, bundle := range bundles {
+		history = append(history, &BundleSdkHistory{
+			Bundle: bundle,
+			Sdks:   sdksByBundleId[bundle.Id],
+		})
+	}
+	return history, nil
+}
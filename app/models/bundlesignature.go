@@ -0,0 +1,294 @@
+package models
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/DHowett/go-plist"
+)
+
+var reSignatureBlock = regexp.MustCompile(`^META-INF/[^/]+\.(RSA|DSA|EC)$`)
+var reMobileProvision = regexp.MustCompile(`^Payload/[^/]+\.app/embedded\.mobileprovision$`)
+
+// https://tools.ietf.org/html/rfc2315#section-7
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+// https://tools.ietf.org/html/rfc2315#section-9.1
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue
+	ContentInfo      asn1.RawValue
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+}
+
+type mobileProvision struct {
+	Entitlements          map[string]interface{} `plist:"Entitlements"`
+	DeveloperCertificates [][]byte               `plist:"DeveloperCertificates"`
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	return ioutil.ReadAll(rc)
+}
+
+// CertificateFingerprint returns the SHA-256 fingerprint of the DER encoded certificate.
+func CertificateFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	hexes := make([]string, len(sum))
+	for i, b := range sum {
+		hexes[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(hexes, ":")
+}
+
+// parsePkcs7Certificate returns the first certificate in the PKCS#7 signed data.
+func parsePkcs7Certificate(data []byte) ([]byte, error) {
+	var info pkcs7ContentInfo
+	if _, err := asn1.Unmarshal(data, &info); err != nil {
+		return nil, err
+	}
+
+	var signedData pkcs7SignedData
+	if _, err := asn1.Unmarshal(info.Content.Bytes, &signedData); err != nil {
+		return nil, err
+	}
+
+	var cert asn1.RawValue
+	if _, err := asn1.Unmarshal(signedData.Certificates.Bytes, &cert); err != nil {
+		return nil, errors.New("certificate is not found")
+	}
+
+	return cert.FullBytes, nil
+}
+
+// the ids of the signature scheme blocks in the APK Signing Block
+// https://source.android.com/security/apksigning/v2#apk-signing-block
+const (
+	apkSignatureSchemeV2BlockId = 0x7109871a
+	apkSignatureSchemeV3BlockId = 0xf05368c0
+)
+
+var apkSigningBlockMagic = []byte("APK Sig Block 42")
+
+var errApkSigningBlockNotFound = errors.New("APK Signing Block is not found")
+
+// apkCertificateFingerprint returns the fingerprint of the signing certificate of the apk file.
+// The certificate in the v3 or v2 signature scheme is preferred to the v1 signature block.
+func apkCertificateFingerprint(file *os.File, signatureFile *zip.File) string {
+	info, err := file.Stat()
+	if err != nil {
+		return ""
+	}
+
+	cert, err := apkSigningBlockCertificate(file, info.Size())
+	if err != nil {
+		return androidCertificateFingerprint(signatureFile)
+	}
+	return CertificateFingerprint(cert)
+}
+
+// apkSigningBlockCertificate returns the first certificate of the first signer in the v3 or v2 signature scheme block.
+// The APK Signing Block is placed just before the central directory of the zip archive.
+func apkSigningBlockCertificate(r io.ReaderAt, size int64) ([]byte, error) {
+	cdOffset, err := zipCentralDirectoryOffset(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	// the block ends with the size of the block and the magic
+	if cdOffset < 32 {
+		return nil, errApkSigningBlockNotFound
+	}
+	footer := make([]byte, 24)
+	if _, err := r.ReadAt(footer, cdOffset-24); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(footer[8:], apkSigningBlockMagic) {
+		return nil, errApkSigningBlockNotFound
+	}
+	blockSize := binary.LittleEndian.Uint64(footer)
+	if blockSize < 24 || blockSize > uint64(cdOffset-8) {
+		return nil, errApkSigningBlockNotFound
+	}
+
+	// the pairs of the id and the value are between the size at the start and the footer
+	pairs := make([]byte, blockSize-24)
+	if _, err := r.ReadAt(pairs, cdOffset-int64(blockSize)); err != nil {
+		return nil, err
+	}
+
+	values := map[uint32][]byte{}
+	for len(pairs) > 0 {
+		if len(pairs) < 12 {
+			return nil, errApkSigningBlockNotFound
+		}
+		length := binary.LittleEndian.Uint64(pairs)
+		if length < 4 || length > uint64(len(pairs)-8) {
+			return nil, errApkSigningBlockNotFound
+		}
+		id := binary.LittleEndian.Uint32(pairs[8:])
+		values[id] = pairs[12 : 8+length]
+		pairs = pairs[8+length:]
+	}
+
+	for _, id := range []uint32{apkSignatureSchemeV3BlockId, apkSignatureSchemeV2BlockId} {
+		if value, ok := values[id]; ok {
+			return apkSignerCertificate(value)
+		}
+	}
+	return nil, errApkSigningBlockNotFound
+}
+
+// apkSignerCertificate returns the first certificate of the first signer in the signature scheme block.
+// The v2 and v3 blocks have the same layout up to the certificates.
+func apkSignerCertificate(value []byte) ([]byte, error) {
+	signers, _, err := readLengthPrefixed(value)
+	if err != nil {
+		return nil, err
+	}
+	signer, _, err := readLengthPrefixed(signers)
+	if err != nil {
+		return nil, err
+	}
+	signedData, _, err := readLengthPrefixed(signer)
+	if err != nil {
+		return nil, err
+	}
+	// the digests precede the certificates
+	_, rest, err := readLengthPrefixed(signedData)
+	if err != nil {
+		return nil, err
+	}
+	certificates, _, err := readLengthPrefixed(rest)
+	if err != nil {
+		return nil, err
+	}
+	cert, _, err := readLengthPrefixed(certificates)
+	if err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// readLengthPrefixed splits the data prefixed with its uint32 length and the rest.
+func readLengthPrefixed(buf []byte) ([]byte, []byte, error) {
+	if len(buf) < 4 {
+		return nil, nil, errApkSigningBlockNotFound
+	}
+	length := binary.LittleEndian.Uint32(buf)
+	if uint64(length) > uint64(len(buf)-4) {
+		return nil, nil, errApkSigningBlockNotFound
+	}
+	return buf[4 : 4+length], buf[4+length:], nil
+}
+
+// zipCentralDirectoryOffset returns the offset of the central directory in the End of Central Directory record.
+func zipCentralDirectoryOffset(r io.ReaderAt, size int64) (int64, error) {
+	// the record is 22 bytes followed by the comment up to 65535 bytes
+	n := int64(22 + 65535)
+	if n > size {
+		n = size
+	}
+	buf := make([]byte, n)
+	if _, err := r.ReadAt(buf, size-n); err != nil {
+		return 0, err
+	}
+
+	for i := len(buf) - 22; i >= 0; i-- {
+		if binary.LittleEndian.Uint32(buf[i:]) == 0x06054b50 {
+			return int64(binary.LittleEndian.Uint32(buf[i+16:])), nil
+		}
+	}
+	return 0, zip.ErrFormat
+}
+
+// androidCertificateFingerprint returns the fingerprint of the signing certificate in the v1 signature block.
+// It returns an empty string if the package is not signed with the v1 scheme.
+func androidCertificateFingerprint(signatureFile *zip.File) string {
+	if signatureFile == nil {
+		return ""
+	}
+
+	data, err := readZipFile(signatureFile)
+	if err != nil {
+		return ""
+	}
+
+	cert, err := parsePkcs7Certificate(data)
+	if err != nil {
+		return ""
+	}
+
+	return CertificateFingerprint(cert)
+}
+
+// parseMobileProvision reads the plist signed in the provisioning profile.
+func parseMobileProvision(provisionFile *zip.File) (*mobileProvision, error) {
+	data, err := readZipFile(provisionFile)
+	if err != nil {
+		return nil, err
+	}
+
+	start := bytes.Index(data, []byte("<?xml"))
+	end := bytes.LastIndex(data, []byte("</plist>"))
+	if start < 0 || end < start {
+		return nil, errors.New("plist is not found in the provisioning profile")
+	}
+
+	provision := &mobileProvision{}
+	if _, err := plist.Unmarshal(data[start:end+len("</plist>")], provision); err != nil {
+		return nil, err
+	}
+
+	return provision, nil
+}
+
+// applyMobileProvision sets the entitlements and the signing certificate of the provisioning profile.
+// An unreadable profile is ignored since it is not required to distribute the app.
+func applyMobileProvision(bundleInfo *BundleInfo, provisionFile *zip.File) {
+	if provisionFile == nil {
+		return
+	}
+
+	provision, err := parseMobileProvision(provisionFile)
+	if err != nil {
+		return
+	}
+
+	bundleInfo.Entitlements = map[string]string{}
+	for key, value := range provision.Entitlements {
+		bundleInfo.Entitlements[key] = fmt.Sprint(value)
+	}
+	if len(provision.DeveloperCertificates) > 0 {
+		bundleInfo.CertificateFingerprint = CertificateFingerprint(provision.DeveloperCertificates[0])
+	}
+}
+
+// entitlementLines converts the entitlements to sorted "key = value" lines to compare.
+func entitlementLines(entitlements map[string]string) []string {
+	lines := make([]string, 0, len(entitlements))
+	for key, value := range entitlements {
+		lines = append(lines, fmt.Sprintf("%s = %s", key, value))
+	}
+	sort.Strings(lines)
+	return lines
+}
@@ -0,0 +1,147 @@
+package models
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func appendUint32(buf []byte, v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return append(buf, b...)
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, v)
+	return append(buf, b...)
+}
+
+func lengthPrefixed(data ...[]byte) []byte {
+	var buf []byte
+	for _, d := range data {
+		buf = append(buf, d...)
+	}
+	return append(appendUint32(nil, uint32(len(buf))), buf...)
+}
+
+// signedApk returns a zip archive which has the APK Signing Block of the pairs before the central directory.
+func signedApk(t *testing.T, pairs map[uint32][]byte) []byte {
+	var archive bytes.Buffer
+	w := zip.NewWriter(&archive)
+	f, err := w.Create("AndroidManifest.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("manifest"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data := archive.Bytes()
+
+	eocd := bytes.LastIndex(data, []byte{0x50, 0x4b, 0x05, 0x06})
+	cdOffset := binary.LittleEndian.Uint32(data[eocd+16:])
+
+	var block []byte
+	for id, value := range pairs {
+		block = appendUint64(block, uint64(len(value)+4))
+		block = appendUint32(block, id)
+		block = append(block, value...)
+	}
+	size := uint64(len(block) + 24)
+	block = append(appendUint64(nil, size), block...)
+	block = appendUint64(block, size)
+	block = append(block, apkSigningBlockMagic...)
+
+	var apk []byte
+	apk = append(apk, data[:cdOffset]...)
+	apk = append(apk, block...)
+	apk = append(apk, data[cdOffset:]...)
+	binary.LittleEndian.PutUint32(apk[eocd+len(block)+16:], cdOffset+uint32(len(block)))
+	return apk
+}
+
+// signatureSchemeBlock returns the block of a signer which has the certificates.
+func signatureSchemeBlock(certs ...[]byte) []byte {
+	var certificates [][]byte
+	for _, cert := range certs {
+		certificates = append(certificates, lengthPrefixed(cert))
+	}
+	digests := lengthPrefixed(lengthPrefixed([]byte("digest")))
+	signedData := lengthPrefixed(digests, lengthPrefixed(certificates...))
+	signer := lengthPrefixed(signedData, lengthPrefixed(), lengthPrefixed())
+	return lengthPrefixed(signer)
+}
+
+func TestApkSigningBlockCertificate(t *testing.T) {
+	tests := []struct {
+		name  string
+		pairs map[uint32][]byte
+		want  string
+	}{
+		{
+			"v2",
+			map[uint32][]byte{apkSignatureSchemeV2BlockId: signatureSchemeBlock([]byte("v2 cert"), []byte("intermediate"))},
+			"v2 cert",
+		},
+		{
+			"v3 is preferred",
+			map[uint32][]byte{
+				apkSignatureSchemeV2BlockId: signatureSchemeBlock([]byte("v2 cert")),
+				apkSignatureSchemeV3BlockId: signatureSchemeBlock([]byte("v3 cert")),
+			},
+			"v3 cert",
+		},
+		{
+			"unknown blocks are skipped",
+			map[uint32][]byte{
+				0x42726577:                  make([]byte, 100),
+				apkSignatureSchemeV2BlockId: signatureSchemeBlock([]byte("v2 cert")),
+			},
+			"v2 cert",
+		},
+	}
+	for _, test := range tests {
+		apk := signedApk(t, test.pairs)
+		cert, err := apkSigningBlockCertificate(bytes.NewReader(apk), int64(len(apk)))
+		if err != nil {
+			t.Errorf("%s: returned an error: %s", test.name, err)
+			continue
+		}
+		if string(cert) != test.want {
+			t.Errorf("%s: certificate is %q, want %q", test.name, cert, test.want)
+		}
+
+		// the archive is still readable
+		if _, err := zip.NewReader(bytes.NewReader(apk), int64(len(apk))); err != nil {
+			t.Errorf("%s: archive is broken: %s", test.name, err)
+		}
+	}
+}
+
+func TestApkSigningBlockCertificateNotFound(t *testing.T) {
+	tests := []struct {
+		name  string
+		pairs map[uint32][]byte
+	}{
+		{"no signature scheme block", map[uint32][]byte{0x42726577: make([]byte, 8)}},
+		{"broken signer", map[uint32][]byte{apkSignatureSchemeV2BlockId: lengthPrefixed([]byte{0xff, 0xff})}},
+	}
+	for _, test := range tests {
+		apk := signedApk(t, test.pairs)
+		if _, err := apkSigningBlockCertificate(bytes.NewReader(apk), int64(len(apk))); err != errApkSigningBlockNotFound {
+			t.Errorf("%s: error is %v, want %v", test.name, err, errApkSigningBlockNotFound)
+		}
+	}
+
+	// signed only with the v1 scheme
+	var archive bytes.Buffer
+	w := zip.NewWriter(&archive)
+	w.Create("AndroidManifest.xml")
+	w.Close()
+	if _, err := apkSigningBlockCertificate(bytes.NewReader(archive.Bytes()), int64(archive.Len())); err != errApkSigningBlockNotFound {
+		t.Errorf("v1 only: error is %v, want %v", err, errApkSigningBlockNotFound)
+	}
+}
@@ -0,0 +1,208 @@
+package models
+
+import (
+	"archive/zip"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coopernurse/gorp"
+)
+
+var (
+	reDexFile   = regexp.MustCompile(`(^|/)(classes\d*\.dex$|dex/)`)
+	reNativeLib = regexp.MustCompile(`(^|/)lib/([^/]+)/[^/]+$`)
+	reAppDir    = regexp.MustCompile(`^(Payload/)?[^/]+\.app/(.+)$`)
+)
+
+// the directories which are grouped by itself under the module directory of aab files
+var bundleSizeModuleDirs = map[string]bool{
+	"assets":   true,
+	"manifest": true,
+	"res":      true,
+	"root":     true,
+}
+
+// a BundleSize is the total size of the files of a category in an application package.
+type BundleSize struct {
+	Id               int       `db:"id"`
+	BundleId         int       `db:"bundle_id"`
+	Category         string    `db:"category"`
+	CompressedSize   int64     `db:"compressed_size"`
+	UncompressedSize int64     `db:"uncompressed_size"`
+	CreatedAt        time.Time `db:"created_at"`
+	UpdatedAt        time.Time `db:"updated_at"`
+}
+
+func (size *BundleSize) PreInsert(s gorp.SqlExecutor) error {
+	size.CreatedAt = time.Now()
+	size.UpdatedAt = size.CreatedAt
+	return nil
+}
+
+func (size *BundleSize) PreUpdate(s gorp.SqlExecutor) error {
+	size.UpdatedAt = time.Now()
+	return nil
+}
+
+func (size *BundleSize) Save(txn gorp.SqlExecutor) error {
+	return txn.Insert(size)
+}
+
+func (size *BundleSize) HumanCompressedSize() string {
+	return FormatByteSize(size.CompressedSize)
+}
+
+func (size *BundleSize) HumanUncompressedSize() string {
+	return FormatByteSize(size.UncompressedSize)
+}
+
+func DeleteBundleSizesByBundleId(txn gorp.SqlExecutor, bundleId int) error {
+	_, err := txn.Exec("DELETE FROM bundle_size WHERE bundle_id = ?", bundleId)
+	return err
+}
+
+// a BundleSizeInfo is the size information of an application package.
+type BundleSizeInfo struct {
+	FileSize         int64
+	UncompressedSize int64
+	Breakdown        []*BundleSize
+}
+
+// NewBundleSizeInfo measures the file and the files in it by category.
+// The executable is the name of the main binary of iOS apps.
+// Files other than zip archives have only FileSize.
+func NewBundleSizeInfo(file *os.File, executable string) (*BundleSizeInfo, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	sizeInfo := &BundleSizeInfo{
+		FileSize: stat.Size(),
+	}
+
+	reader, err := zip.NewReader(file, stat.Size())
+	if err == zip.ErrFormat {
+		return sizeInfo, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sizes := map[string]*BundleSize{}
+	for _, f := range reader.File {
+		category := bundleSizeCategory(f.Name, executable)
+		size, ok := sizes[category]
+		if !ok {
+			size = &BundleSize{Category: category}
+			sizes[category] = size
+		}
+		size.CompressedSize += int64(f.CompressedSize64)
+		size.UncompressedSize += int64(f.UncompressedSize64)
+		sizeInfo.UncompressedSize += int64(f.UncompressedSize64)
+	}
+
+	for _, size := range sizes {
+		sizeInfo.Breakdown = append(sizeInfo.Breakdown, size)
+	}
+	sort.Sort(bundleSizesBySize(sizeInfo.Breakdown))
+
+	return sizeInfo, nil
+}
+
+func bundleSizeCategory(name, executable string) string {
+	if m := reAppDir.FindStringSubmatch(name); m != nil {
+		rest := m[2]
+		switch {
+		case executable != "" && rest == executable:
+			return "binary"
+		case strings.HasPrefix(rest, "Frameworks/"):
+			return "Frameworks"
+		case strings.HasPrefix(rest, "PlugIns/"):
+			return "PlugIns"
+		case path.Ext(rest) == ".car":
+			return "assets"
+		}
+		return "resources"
+	}
+
+	if reDexFile.MatchString(name) {
+		return "dex"
+	}
+	if m := reNativeLib.FindStringSubmatch(name); m != nil {
+		return "lib/" + m[2]
+	}
+
+	dirs := strings.Split(name, "/")
+	switch {
+	case len(dirs) == 1 && name == "resources.arsc":
+		return name
+	case len(dirs) == 1:
+		return "other"
+	case len(dirs) > 2 && bundleSizeModuleDirs[dirs[1]]:
+		return dirs[1]
+	}
+	return dirs[0]
+}
+
+type bundleSizesBySize []*BundleSize
+
+func (s bundleSizesBySize) Len() int           { return len(s) }
+func (s bundleSizesBySize) Less(i, j int) bool { return s[i].UncompressedSize > s[j].UncompressedSize }
+func (s bundleSizesBySize) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// FormatByteSize formats the size in bytes with a binary prefix.
+func FormatByteSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// FormatByteSizeDelta formats the difference of sizes with the sign.
+func FormatByteSizeDelta(delta int64) string {
+	if delta < 0 {
+		return "-" + FormatByteSize(-delta)
+	}
+	return "+" + FormatByteSize(delta)
+}
+
+// BundleSizeChartUrl returns the URL of the line chart of the file size over the bundles.
+// It returns an empty string if there are no bundles to chart.
+func BundleSizeChartUrl(bundles []*Bundle) string {
+	var values, labels []string
+	// bundles are in descending order
+	for i := len(bundles) - 1; i >= 0; i-- {
+		bundle := bundles[i]
+		if bundle.FileSize <= 0 {
+			continue
+		}
+		values = append(values, fmt.Sprintf("%.2f", float64(bundle.FileSize)/(1024*1024)))
+		labels = append(labels, fmt.Sprintf("%s#%d", bundle.BundleVersion, bundle.Revision))
+	}
+	if len(values) < 2 {
+		return ""
+	}
+
+	v := url.Values{}
+	v.Set("cht", "lc")
+	v.Set("chs", "600x200")
+	v.Set("chds", "a")
+	v.Set("chxt", "x,y")
+	v.Set("chxl", "0:|"+strings.Join(labels, "|"))
+	v.Set("chtt", "File size (MiB)")
+	v.Set("chd", "t:"+strings.Join(values, ","))
+	return "https://chart.googleapis.com/chart?" + v.Encode()
+}
@@ -0,0 +1,37 @@
+package models
+
+import (
+	"time"
+
+	"github.com/coopernurse/gorp"
+)
+
+// a BundleSplit is an apk file contained in a split apk set(apks file, xapk file)
+type BundleSplit struct {
+	Id        int       `db:"id"`
+	BundleId  int       `db:"bundle_id"`
+	Name      string    `db:"name"`
+	Size      int64     `db:"size"`
+	CreatedAt time.Time `db:"created_at"`
+	UpdatedAt time.Time `db:"updated_at"`
+}
+
+func (split *BundleSplit) PreInsert(s gorp.SqlExecutor) error {
+	split.CreatedAt = time.Now()
+	split.UpdatedAt = split.CreatedAt
+	return nil
+}
+
+func (split *BundleSplit) PreUpdate(s gorp.SqlExecutor) error {
+	split.UpdatedAt = time.Now()
+	return nil
+}
+
+func (split *BundleSplit) Save(txn gorp.SqlExecutor) error {
+	return txn.Insert(split)
+}
+
+func DeleteBundleSplitsByBundleId(txn gorp.SqlExecutor, bundleId int) error {
+	_, err := txn.Exec("DELETE FROM bundle_split WHERE bundle_id = ?", bundleId)
+	return err
+}
@@ -0,0 +1,173 @@
+package models
+
+import (
+	"database/sql"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/coopernurse/gorp"
+	"github.com/revel/revel"
+)
+
+// a BundleStatus is whether the file of the bundle is stored on Google Drive.
+type BundleStatus int
+
+const (
+	BundleStatusReady BundleStatus = iota
+	BundleStatusUploading
+	BundleStatusFailed
+)
+
+func (status BundleStatus) String() string {
+	switch status {
+	case BundleStatusUploading:
+		return "uploading"
+	case BundleStatusFailed:
+		return "failed"
+	}
+	return "ready"
+}
+
+// Label returns the label for the web pages.
+func (status BundleStatus) Label() string {
+	switch status {
+	case BundleStatusUploading:
+		return "アップロード中"
+	case BundleStatusFailed:
+		return "アップロード失敗"
+	}
+	return ""
+}
+
+// the number of files uploaded to Google Drive in the background at the same time.
+// The other files wait in the queue.
+const backgroundUploadConcurrency = 2
+
+var backgroundUploadSlots = make(chan struct{}, backgroundUploadConcurrency)
+
+// IsReady reports whether the file of the bundle can be downloaded.
+func (bundle *Bundle) IsReady() bool {
+	return bundle.Status == BundleStatusReady
+}
+
+func (bundle *Bundle) IsUploading() bool {
+	return bundle.Status == BundleStatusUploading
+}
+
+// CreateBundleInBackground saves the bundle as CreateBundle, and queues the upload of the file to Google Drive.
+// The bundle is BundleStatusUploading until the upload is completed, or BundleStatusFailed if it fails.
+// The file is copied, so the caller can remove it after this returns.
+func (app *App) CreateBundleInBackground(dbm *gorp.DbMap, s *GoogleService, bundle *Bundle) error {
+	file, err := copyToTempFile(bundle.File)
+	if err != nil {
+		return err
+	}
+
+	bundle.Status = BundleStatusUploading
+	if err := app.prepareBundle(dbm, bundle); err != nil {
+		RemoveTempFile(file)
+		return err
+	}
+
+	queued := *bundle
+	queued.File = file
+	go func() {
+		defer RemoveTempFile(file)
+
+		backgroundUploadSlots <- struct{}{}
+		defer func() { <-backgroundUploadSlots }()
+
+		// the token of the request may expire while waiting and uploading
+		service, err := s.Renew()
+		if err != nil {
+			revel.ERROR.Printf("failed to upload the bundle %d: %s", queued.Id, err)
+			if err := queued.updateStatus(dbm, "", BundleStatusFailed); err != nil && err != sql.ErrNoRows {
+				revel.ERROR.Printf("failed to update the status of the bundle %d: %s", queued.Id, err)
+			}
+			return
+		}
+
+		if err := app.storeBundle(dbm, service, &queued); err != nil {
+			revel.ERROR.Printf("failed to upload the bundle %d: %s", queued.Id, err)
+		}
+	}()
+	return nil
+}
+
+// storeBundle uploads the file of the saved bundle to Google Drive.
+// The bundle is marked as failed if the upload fails,
+// and the uploaded file is deleted if the bundle is deleted while uploading.
+func (app *App) storeBundle(dbm *gorp.DbMap, s *GoogleService, bundle *Bundle) error {
+	driveFile, err := s.InsertFile(bundle.File, bundle.FileName, app.ParentReference())
+	if err != nil {
+		if err := bundle.updateStatus(dbm, "", BundleStatusFailed); err != nil && err != sql.ErrNoRows {
+			revel.ERROR.Printf("failed to update the status of the bundle %d: %s", bundle.Id, err)
+		}
+		bundle.Status = BundleStatusFailed
+		return err
+	}
+
+	if err := bundle.updateStatus(dbm, driveFile.Id, BundleStatusReady); err != nil {
+		if err == sql.ErrNoRows {
+			return s.DeleteFile(driveFile.Id)
+		}
+		return err
+	}
+	bundle.FileId = driveFile.Id
+	bundle.Status = BundleStatusReady
+	return nil
+}
+
+// updateStatus updates only the file id and the status not to overwrite the changes while uploading.
+// It returns sql.ErrNoRows if the bundle is deleted.
+func (bundle *Bundle) updateStatus(txn gorp.SqlExecutor, fileId string, status BundleStatus) error {
+	result, err := txn.Exec("UPDATE bundle SET file_id = ?, status = ?, updated_at = ? WHERE id = ?", fileId, status, time.Now(), bundle.Id)
+	if err != nil {
+		return err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// the duration after which the bundle still uploading is considered interrupted by the stop of the server.
+// The uploads of the other servers sharing the database are not interrupted in the meantime.
+var BundleUploadTimeout = 6 * time.Hour
+
+// FailInterruptedBundles marks the bundles as failed which are still uploading since before the time,
+// and returns the number of them.
+func FailInterruptedBundles(txn gorp.SqlExecutor, before time.Time) (int, error) {
+	result, err := txn.Exec("UPDATE bundle SET status = ?, updated_at = ? WHERE status = ? AND created_at < ?", BundleStatusFailed, time.Now(), BundleStatusUploading, before)
+	if err != nil {
+		return 0, err
+	}
+	count, err := result.RowsAffected()
+	return int(count), err
+}
+
+func copyToTempFile(src *os.File) (*os.File, error) {
+	if _, err := src.Seek(0, os.SEEK_SET); err != nil {
+		return nil, err
+	}
+
+	file, err := ioutil.TempFile("", "alphawing")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(file, src); err != nil {
+		RemoveTempFile(file)
+		return nil, err
+	}
+	if _, err := src.Seek(0, os.SEEK_SET); err != nil {
+		RemoveTempFile(file)
+		return nil, err
+	}
+	return file, nil
+}
@@ -0,0 +1,29 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+)
+
+var ErrChecksumMismatch = errors.New("checksum of the downloaded file does not match")
+
+// FileSha256 returns the hex encoded SHA-256 of the file.
+// The file offset is rewound to the start.
+func FileSha256(file *os.File) (string, error) {
+	if _, err := file.Seek(0, os.SEEK_SET); err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+
+	if _, err := file.Seek(0, os.SEEK_SET); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,80 @@
+package models
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// https://source.android.com/devices/tech/dalvik/dex-format
+const (
+	dexHeaderSize       = 0x70
+	dexStringIdsSizeOff = 0x38
+	dexTypeIdsSizeOff   = 0x40
+)
+
+var dexMagic = []byte("dex\n")
+
+var errInvalidDex = errors.New("invalid dex file")
+
+// dexClassNames returns the names of the classes referred in the dex file, such as "com.example.Foo".
+func dexClassNames(data []byte) ([]string, error) {
+	if len(data) < dexHeaderSize || !bytes.HasPrefix(data, dexMagic) {
+		return nil, errInvalidDex
+	}
+
+	stringIdsSize := binary.LittleEndian.Uint32(data[dexStringIdsSizeOff:])
+	stringIdsOff := binary.LittleEndian.Uint32(data[dexStringIdsSizeOff+4:])
+	typeIdsSize := binary.LittleEndian.Uint32(data[dexTypeIdsSizeOff:])
+	typeIdsOff := binary.LittleEndian.Uint32(data[dexTypeIdsSizeOff+4:])
+
+	if uint64(stringIdsOff)+uint64(stringIdsSize)*4 > uint64(len(data)) ||
+		uint64(typeIdsOff)+uint64(typeIdsSize)*4 > uint64(len(data)) {
+		return nil, errInvalidDex
+	}
+
+	names := make([]string, 0, typeIdsSize)
+	for i := uint32(0); i < typeIdsSize; i++ {
+		stringIdx := binary.LittleEndian.Uint32(data[typeIdsOff+i*4:])
+		if stringIdx >= stringIdsSize {
+			return nil, errInvalidDex
+		}
+
+		stringDataOff := binary.LittleEndian.Uint32(data[stringIdsOff+stringIdx*4:])
+		descriptor, err := dexString(data, stringDataOff)
+		if err != nil {
+			return nil, err
+		}
+
+		// class descriptors look like "Lcom/example/Foo;"
+		if len(descriptor) < 3 || descriptor[0] != 'L' || descriptor[len(descriptor)-1] != ';' {
+			continue
+		}
+		names = append(names, strings.Replace(descriptor[1:len(descriptor)-1], "/", ".", -1))
+	}
+
+	return names, nil
+}
+
+// dexString reads the MUTF-8 string which is prefixed with its uleb128 length.
+func dexString(data []byte, off uint32) (string, error) {
+	if uint64(off) >= uint64(len(data)) {
+		return "", errInvalidDex
+	}
+
+	// skip the length in utf-16 code units
+	p := int(off)
+	for ; p < len(data) && data[p]&0x80 != 0; p++ {
+	}
+	p++
+	if p >= len(data) {
+		return "", errInvalidDex
+	}
+
+	end := bytes.IndexByte(data[p:], 0)
+	if end < 0 {
+		return "", errInvalidDex
+	}
+	return string(data[p : p+end]), nil
+}
@@ -0,0 +1,114 @@
+package models
+
+import (
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// buildDex returns a dex file which has the strings and the types referring to the strings by the index.
+func buildDex(strs []string, typeIdx []uint32) []byte {
+	stringIdsOff := dexHeaderSize
+	typeIdsOff := stringIdsOff + len(strs)*4
+	dataOff := typeIdsOff + len(typeIdx)*4
+
+	data := make([]byte, dataOff)
+	copy(data, dexMagic)
+	binary.LittleEndian.PutUint32(data[dexStringIdsSizeOff:], uint32(len(strs)))
+	binary.LittleEndian.PutUint32(data[dexStringIdsSizeOff+4:], uint32(stringIdsOff))
+	binary.LittleEndian.PutUint32(data[dexTypeIdsSizeOff:], uint32(len(typeIdx)))
+	binary.LittleEndian.PutUint32(data[dexTypeIdsSizeOff+4:], uint32(typeIdsOff))
+
+	for i, str := range strs {
+		binary.LittleEndian.PutUint32(data[stringIdsOff+i*4:], uint32(len(data)))
+		// the uleb128 length, which is longer than a byte for the long strings
+		if len(str) >= 0x80 {
+			data = append(data, byte(len(str))|0x80, byte(len(str)>>7))
+		} else {
+			data = append(data, byte(len(str)))
+		}
+		data = append(data, str...)
+		data = append(data, 0)
+	}
+	for i, idx := range typeIdx {
+		binary.LittleEndian.PutUint32(data[typeIdsOff+i*4:], idx)
+	}
+	return data
+}
+
+func TestDexClassNames(t *testing.T) {
+	longName := strings.Repeat("a", 300)
+
+	tests := []struct {
+		name    string
+		strings []string
+		typeIdx []uint32
+		want    []string
+	}{
+		{
+			"classes",
+			[]string{"Lcom/example/Foo;", "Lcom/google/firebase/FirebaseApp;", "onCreate"},
+			[]uint32{0, 1},
+			[]string{"com.example.Foo", "com.google.firebase.FirebaseApp"},
+		},
+		{
+			"primitives and arrays are skipped",
+			[]string{"I", "[Ljava/lang/String;", "Ljava/lang/String;", "V"},
+			[]uint32{0, 1, 2, 3},
+			[]string{"java.lang.String"},
+		},
+		{
+			"long descriptor",
+			[]string{"Lcom/example/" + longName + ";"},
+			[]uint32{0},
+			[]string{"com.example." + longName},
+		},
+		{
+			"no types",
+			[]string{"Lcom/example/Foo;"},
+			nil,
+			[]string{},
+		},
+	}
+	for _, test := range tests {
+		names, err := dexClassNames(buildDex(test.strings, test.typeIdx))
+		if err != nil {
+			t.Errorf("%s: returned an error: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(names, test.want) {
+			t.Errorf("%s: names are %q, want %q", test.name, names, test.want)
+		}
+	}
+}
+
+func TestDexClassNamesInvalid(t *testing.T) {
+	valid := buildDex([]string{"Lcom/example/Foo;"}, []uint32{0})
+
+	outOfStrings := buildDex([]string{"Lcom/example/Foo;"}, []uint32{1})
+
+	brokenStringOff := buildDex([]string{"Lcom/example/Foo;"}, []uint32{0})
+	binary.LittleEndian.PutUint32(brokenStringOff[dexHeaderSize:], uint32(len(brokenStringOff)))
+
+	brokenTypeIds := buildDex([]string{"Lcom/example/Foo;"}, []uint32{0})
+	binary.LittleEndian.PutUint32(brokenTypeIds[dexTypeIdsSizeOff:], 1<<20)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"not dex", append([]byte("PK\x03\x04"), valid[4:]...)},
+		{"truncated header", valid[:dexHeaderSize-1]},
+		{"type out of strings", outOfStrings},
+		{"string out of data", brokenStringOff},
+		{"type ids out of data", brokenTypeIds},
+		{"unterminated string", valid[:len(valid)-1]},
+	}
+	for _, test := range tests {
+		if _, err := dexClassNames(test.data); err != errInvalidDex {
+			t.Errorf("%s: error is %v, want %v", test.name, err, errInvalidDex)
+		}
+	}
+}
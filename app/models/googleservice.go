@@ -1,12 +1,18 @@
 package models
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"code.google.com/p/goauth2/oauth"
 	"code.google.com/p/goauth2/oauth/jwt"
@@ -15,6 +21,21 @@ import (
 	"code.google.com/p/google-api-go-client/oauth2/v2"
 )
 
+const driveResumableUploadUrl = "https://www.googleapis.com/upload/drive/v2/files?uploadType=resumable"
+
+// the status of the resumable upload to continue
+const statusResumeIncomplete = 308
+
+var (
+	// the size of each request of the resumable upload, which must be a multiple of 256 KiB
+	DriveUploadChunkSize int64 = 8 * 1024 * 1024
+
+	// the number of times a request of the resumable upload is retried
+	DriveUploadMaxRetries = 5
+)
+
+var errDriveUploadNoProgress = errors.New("Google Drive has received no more bytes of the upload")
+
 type WebApplicationConfig struct {
 	ClientId     string
 	ClientSecret string
@@ -29,6 +50,7 @@ type ServiceAccountConfig struct {
 }
 
 type GoogleService struct {
+	ServiceAccount     *ServiceAccountConfig // nil unless the service is authorized as the service account
 	AccessToken        string
 	Client             *http.Client
 	OAuth2Service      *oauth2.Service
@@ -68,6 +90,30 @@ func GetServiceAccountToken(config *ServiceAccountConfig) (*oauth.Token, error)
 	return oauthToken, nil
 }
 
+// NewServiceAccountGoogleService returns the service authorized with a new token of the service account.
+func NewServiceAccountGoogleService(config *ServiceAccountConfig) (*GoogleService, error) {
+	token, err := GetServiceAccountToken(config)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := NewGoogleService(token)
+	if err != nil {
+		return nil, err
+	}
+	s.ServiceAccount = config
+	return s, nil
+}
+
+// Renew returns the service with a new token of the same service account.
+// The work running longer than the request uses it, since the token of the request is not refreshed.
+func (s *GoogleService) Renew() (*GoogleService, error) {
+	if s.ServiceAccount == nil {
+		return nil, errors.New("the service is not authorized as the service account")
+	}
+	return NewServiceAccountGoogleService(s.ServiceAccount)
+}
+
 func createOAuthClient(token *oauth.Token) *http.Client {
 	transport := &oauth.Transport{
 		Token: token,
@@ -115,12 +161,170 @@ func (s *GoogleService) CreateFolder(folderName string) (*drive.File, error) {
 	return s.FilesService.Insert(driveFolder).Do()
 }
 
+// InsertFile uploads the file with the resumable upload protocol of Google Drive.
+// The upload is retried from the last offset acknowledged by Google Drive on network errors and server errors.
+// ref. https://developers.google.com/drive/web/manage-uploads#resumable
 func (s *GoogleService) InsertFile(file *os.File, filename string, parent *drive.ParentReference) (*drive.File, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+
 	driveFile := &drive.File{
 		Title:   filename,
 		Parents: []*drive.ParentReference{parent},
 	}
-	return s.FilesService.Insert(driveFile).Media(file).Do()
+	sessionUrl, err := s.startResumableUpload(driveFile, size)
+	if err != nil {
+		return nil, err
+	}
+
+	var offset int64
+	retries := 0
+	for {
+		inserted, next, err := s.putResumableUpload(sessionUrl, file, offset, size)
+		if err == nil {
+			if inserted != nil {
+				return inserted, nil
+			}
+			if next > offset {
+				offset = next
+				retries = 0
+				continue
+			}
+			// the request which makes no progress is counted as a retry not to loop forever
+			err = errDriveUploadNoProgress
+		}
+
+		if uploadErr, ok := err.(*DriveUploadError); ok && !uploadErr.Retryable() {
+			return nil, err
+		}
+		if retries >= DriveUploadMaxRetries {
+			return nil, err
+		}
+		time.Sleep(time.Duration(1<<uint(retries)) * time.Second)
+		retries++
+
+		// resume from the offset which Google Drive has received
+		inserted, next, err = s.putResumableUpload(sessionUrl, nil, 0, size)
+		if err != nil {
+			continue
+		}
+		if inserted != nil {
+			return inserted, nil
+		}
+		offset = next
+	}
+}
+
+// startResumableUpload starts the upload of the file metadata and returns the URL of the upload session.
+func (s *GoogleService) startResumableUpload(driveFile *drive.File, size int64) (string, error) {
+	body, err := json.Marshal(driveFile)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest("POST", driveResumableUploadUrl, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(size, 10))
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", newDriveUploadError(resp)
+	}
+	sessionUrl := resp.Header.Get("Location")
+	if sessionUrl == "" {
+		return "", errors.New("the upload session URL is not responded")
+	}
+	return sessionUrl, nil
+}
+
+// putResumableUpload sends the chunk of the file from the offset, and returns the inserted file if the upload is completed,
+// or the offset to send next.
+// If the file is nil, it only asks the offset received by Google Drive.
+func (s *GoogleService) putResumableUpload(sessionUrl string, file *os.File, offset int64, size int64) (*drive.File, int64, error) {
+	var body io.Reader
+	var length int64
+	contentRange := fmt.Sprintf("bytes */%d", size)
+	if file != nil {
+		length = size - offset
+		if length > DriveUploadChunkSize {
+			length = DriveUploadChunkSize
+		}
+		body = io.NewSectionReader(file, offset, length)
+		if length > 0 {
+			contentRange = fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, size)
+		}
+	}
+
+	req, err := http.NewRequest("PUT", sessionUrl, body)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.ContentLength = length
+	req.Header.Set("Content-Range", contentRange)
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		var inserted drive.File
+		if err := json.NewDecoder(resp.Body).Decode(&inserted); err != nil {
+			return nil, 0, err
+		}
+		return &inserted, size, nil
+	case statusResumeIncomplete:
+		// Range is "bytes=0-{the last received byte}", or absent if nothing is received
+		var next int64
+		if received := resp.Header.Get("Range"); received != "" {
+			var first, last int64
+			if _, err := fmt.Sscanf(received, "bytes=%d-%d", &first, &last); err != nil {
+				return nil, 0, fmt.Errorf("the received range %q is invalid", received)
+			}
+			next = last + 1
+		}
+		return nil, next, nil
+	}
+	return nil, 0, newDriveUploadError(resp)
+}
+
+// a DriveUploadError is an error response of the resumable upload.
+type DriveUploadError struct {
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func newDriveUploadError(resp *http.Response) *DriveUploadError {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return &DriveUploadError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Body:       string(body),
+	}
+}
+
+func (e *DriveUploadError) Error() string {
+	return fmt.Sprintf("failed to upload the file: %s %s", e.Status, e.Body)
+}
+
+// Retryable reports whether the upload can be resumed.
+// The upload session expires with 404 Not Found, and it can't be resumed.
+func (e *DriveUploadError) Retryable() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
 }
 
 func (s *GoogleService) GetFile(fileId string) (*drive.File, error) {
@@ -128,17 +332,70 @@ func (s *GoogleService) GetFile(fileId string) (*drive.File, error) {
 }
 
 func (s *GoogleService) DownloadFile(fileId string) (*http.Response, *drive.File, error) {
+	return s.DownloadFileRange(fileId, "")
+}
+
+// DownloadFileRange downloads the part of the file given as the value of the Range header.
+// The whole file is downloaded if the range is empty.
+func (s *GoogleService) DownloadFileRange(fileId string, byteRange string) (*http.Response, *drive.File, error) {
 	file, err := s.GetFile(fileId)
 	if err != nil {
 		return nil, nil, err
 	}
-	resp, err := s.Client.Get(file.DownloadUrl)
+	req, err := http.NewRequest("GET", file.DownloadUrl, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if byteRange != "" {
+		req.Header.Set("Range", byteRange)
+	}
+	resp, err := s.Client.Do(req)
 	if err != nil {
 		return nil, nil, err
 	}
 	return resp, file, nil
 }
 
+// DownloadTempFile downloads the file into a temporary file.
+// The caller should remove it by RemoveTempFile.
+func (s *GoogleService) DownloadTempFile(fileId string) (*os.File, error) {
+	return s.downloadTempFileIn("", fileId)
+}
+
+// downloadTempFileIn downloads the file into a temporary file in the directory.
+func (s *GoogleService) downloadTempFileIn(dir string, fileId string) (*os.File, error) {
+	resp, _, err := s.DownloadFile(fileId)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download the file: %s", resp.Status)
+	}
+
+	tempFile, err := ioutil.TempFile(dir, "alphawing")
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = io.Copy(tempFile, resp.Body); err != nil {
+		RemoveTempFile(tempFile)
+		return nil, err
+	}
+	if _, err = tempFile.Seek(0, os.SEEK_SET); err != nil {
+		RemoveTempFile(tempFile)
+		return nil, err
+	}
+
+	return tempFile, nil
+}
+
+func RemoveTempFile(file *os.File) error {
+	file.Close()
+	return os.Remove(file.Name())
+}
+
 func (s *GoogleService) GetFileList() (*drive.FileList, error) {
 	return s.FilesService.List().Do()
 }
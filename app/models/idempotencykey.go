@@ -0,0 +1,130 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/coopernurse/gorp"
+)
+
+// MaxIdempotencyKeyLength is the maximum length of the key given by the client.
+// It is shorter than the column, which also has the id of the app.
+const MaxIdempotencyKeyLength = 200
+
+// the duration a key is remembered, set by the config
+var IdempotencyKeyWindow = 24 * time.Hour
+
+// the duration after which the request of the key not completed is considered interrupted by the stop of the server.
+// The requests to the other servers sharing the database are not interrupted in the meantime.
+var IdempotencyKeyPendingTimeout = time.Hour
+
+// an IdempotencyKey remembers the response of the request with the key given by the client,
+// so a retried request returns the same response instead of creating the bundle again.
+type IdempotencyKey struct {
+	Id          int       `db:"id"`
+	AppId       int       `db:"app_id"`
+	AppKey      string    `db:"app_key"` // unique for each app
+	Fingerprint string    `db:"fingerprint"`
+	Completed   bool      `db:"completed"`
+	Response    string    `db:"response"` // the response encoded by the controller
+	ExpiresAt   time.Time `db:"expires_at"`
+	CreatedAt   time.Time `db:"created_at"`
+	UpdatedAt   time.Time `db:"updated_at"`
+}
+
+func idempotencyAppKey(appId int, key string) string {
+	return fmt.Sprintf("%d:%s", appId, key)
+}
+
+func (idempotencyKey *IdempotencyKey) PreInsert(s gorp.SqlExecutor) error {
+	idempotencyKey.CreatedAt = time.Now()
+	idempotencyKey.UpdatedAt = idempotencyKey.CreatedAt
+	return nil
+}
+
+func (idempotencyKey *IdempotencyKey) PreUpdate(s gorp.SqlExecutor) error {
+	idempotencyKey.UpdatedAt = time.Now()
+	return nil
+}
+
+// Complete records the response to replay.
+func (idempotencyKey *IdempotencyKey) Complete(txn gorp.SqlExecutor, response string) error {
+	idempotencyKey.Completed = true
+	idempotencyKey.Response = response
+	_, err := txn.Update(idempotencyKey)
+	return err
+}
+
+// Release forgets the key, so the request can be retried with it.
+func (idempotencyKey *IdempotencyKey) Release(txn gorp.SqlExecutor) error {
+	_, err := txn.Delete(idempotencyKey)
+	return err
+}
+
+func getIdempotencyKey(txn gorp.SqlExecutor, appId int, key string) (*IdempotencyKey, error) {
+	var idempotencyKey IdempotencyKey
+	if err := txn.SelectOne(&idempotencyKey, "SELECT * FROM idempotency_key WHERE app_key = ?", idempotencyAppKey(appId, key)); err != nil {
+		return nil, err
+	}
+	return &idempotencyKey, nil
+}
+
+// ReserveIdempotencyKey reserves the key of the app for the request of the fingerprint.
+// If the key is already used in the window, it returns the existing one with reserved false.
+// The existing one may be still in progress, or made by a request of another fingerprint.
+func ReserveIdempotencyKey(dbm *gorp.DbMap, appId int, key string, fingerprint string) (*IdempotencyKey, bool, error) {
+	if _, err := dbm.Exec("DELETE FROM idempotency_key WHERE app_key = ? AND expires_at < ?", idempotencyAppKey(appId, key), time.Now()); err != nil {
+		return nil, false, err
+	}
+
+	existing, err := getIdempotencyKey(dbm, appId, key)
+	if err == nil {
+		return existing, false, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, false, err
+	}
+
+	idempotencyKey := &IdempotencyKey{
+		AppId:       appId,
+		AppKey:      idempotencyAppKey(appId, key),
+		Fingerprint: fingerprint,
+		ExpiresAt:   time.Now().Add(IdempotencyKeyWindow),
+	}
+	if err := dbm.Insert(idempotencyKey); err != nil {
+		// the concurrent request has reserved the key
+		existing, selectErr := getIdempotencyKey(dbm, appId, key)
+		if selectErr != nil {
+			return nil, false, err
+		}
+		return existing, false, nil
+	}
+	return idempotencyKey, true, nil
+}
+
+// DeleteExpiredIdempotencyKeys deletes the keys expired before the time, and returns the number of them.
+func DeleteExpiredIdempotencyKeys(txn gorp.SqlExecutor, now time.Time) (int, error) {
+	result, err := txn.Exec("DELETE FROM idempotency_key WHERE expires_at < ?", now)
+	if err != nil {
+		return 0, err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(count), nil
+}
+
+// DeletePendingIdempotencyKeys deletes the keys not completed since before the time, and returns the number of them.
+func DeletePendingIdempotencyKeys(txn gorp.SqlExecutor, before time.Time) (int, error) {
+	result, err := txn.Exec("DELETE FROM idempotency_key WHERE completed = ? AND created_at < ?", false, before)
+	if err != nil {
+		return 0, err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(count), nil
+}
@@ -0,0 +1,120 @@
+package models
+
+import (
+	"time"
+
+	"github.com/coopernurse/gorp"
+)
+
+// a PersonalAccessToken is an API token of a user.
+// It acts with the authorities of the user across all apps.
+// Only the hash of the token is stored.
+type PersonalAccessToken struct {
+	Id         int        `db:"id"`
+	UserId     int        `db:"user_id"`
+	Name       string     `db:"name"`
+	TokenHash  string     `db:"token_hash"`
+	LastUsedAt *time.Time `db:"last_used_at"`
+	ExpiresAt  *time.Time `db:"expires_at"`
+	CreatedAt  time.Time  `db:"created_at"`
+	UpdatedAt  time.Time  `db:"updated_at"`
+
+	Token string `db:"-"` // the raw token, only available on creation
+}
+
+// NewPersonalAccessToken generates a new token of the user.
+// The token expires after the duration unless it is zero.
+func NewPersonalAccessToken(userId int, name string, expiresIn time.Duration) *PersonalAccessToken {
+	token := NewToken()
+	personalAccessToken := &PersonalAccessToken{
+		UserId:    userId,
+		Name:      name,
+		TokenHash: HashApiToken(token),
+		Token:     token,
+	}
+	if expiresIn > 0 {
+		expiresAt := time.Now().Add(expiresIn)
+		personalAccessToken.ExpiresAt = &expiresAt
+	}
+	return personalAccessToken
+}
+
+func (personalAccessToken *PersonalAccessToken) PreInsert(s gorp.SqlExecutor) error {
+	personalAccessToken.CreatedAt = time.Now()
+	personalAccessToken.UpdatedAt = personalAccessToken.CreatedAt
+	return nil
+}
+
+func (personalAccessToken *PersonalAccessToken) PreUpdate(s gorp.SqlExecutor) error {
+	personalAccessToken.UpdatedAt = time.Now()
+	return nil
+}
+
+func (personalAccessToken *PersonalAccessToken) Save(txn gorp.SqlExecutor) error {
+	return txn.Insert(personalAccessToken)
+}
+
+func (personalAccessToken *PersonalAccessToken) Delete(txn gorp.SqlExecutor) error {
+	_, err := txn.Delete(personalAccessToken)
+	return err
+}
+
+func (personalAccessToken *PersonalAccessToken) IsExpired() bool {
+	return personalAccessToken.ExpiresAt != nil && personalAccessToken.ExpiresAt.Before(time.Now())
+}
+
+// Touch records the time when the token is used.
+func (personalAccessToken *PersonalAccessToken) Touch(txn gorp.SqlExecutor) error {
+	now := time.Now()
+	_, err := txn.Exec("UPDATE personal_access_token SET last_used_at = ? WHERE id = ?", now, personalAccessToken.Id)
+	if err != nil {
+		return err
+	}
+	personalAccessToken.LastUsedAt = &now
+	return nil
+}
+
+func (user *User) PersonalAccessTokens(txn gorp.SqlExecutor) ([]*PersonalAccessToken, error) {
+	var personalAccessTokens []*PersonalAccessToken
+	_, err := txn.Select(&personalAccessTokens, "SELECT * FROM personal_access_token WHERE user_id = ? ORDER BY id ASC", user.Id)
+	if err != nil {
+		return nil, err
+	}
+	return personalAccessTokens, nil
+}
+
+// Apps returns the apps which the user has the authority of.
+func (user *User) Apps(txn gorp.SqlExecutor) ([]*App, error) {
+	var apps []*App
+	_, err := txn.Select(&apps, "SELECT * FROM app WHERE id IN (SELECT app_id FROM authority WHERE email = ?) ORDER BY id DESC", user.Email)
+	if err != nil {
+		return nil, err
+	}
+	return apps, nil
+}
+
+// CanAccessApp returns whether the user has the authority of the app.
+func (user *User) CanAccessApp(txn gorp.SqlExecutor, app *App) (bool, error) {
+	return app.HasAuthorityForEmail(txn, user.Email)
+}
+
+func GetPersonalAccessToken(txn gorp.SqlExecutor, id int) (*PersonalAccessToken, error) {
+	var personalAccessToken PersonalAccessToken
+	if err := txn.SelectOne(&personalAccessToken, "SELECT * FROM personal_access_token WHERE id = ?", id); err != nil {
+		return nil, err
+	}
+	return &personalAccessToken, nil
+}
+
+// GetPersonalAccessTokenByToken returns the personal access token of the raw token.
+// It returns ErrApiTokenExpired if the token is expired.
+func GetPersonalAccessTokenByToken(txn gorp.SqlExecutor, token string) (*PersonalAccessToken, error) {
+	var personalAccessToken PersonalAccessToken
+	if err := txn.SelectOne(&personalAccessToken, "SELECT * FROM personal_access_token WHERE token_hash = ?", HashApiToken(token)); err != nil {
+		return nil, err
+	}
+	if personalAccessToken.IsExpired() {
+		return nil, ErrApiTokenExpired
+	}
+	return &personalAccessToken, nil
+}
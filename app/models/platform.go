@@ -0,0 +1,280 @@
+package models
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type BundlePlatformType int
+
+const (
+	BundlePlatformTypeAndroid BundlePlatformType = 1 + iota
+	BundlePlatformTypeIOS
+	BundlePlatformTypeAndroidAppBundle
+	BundlePlatformTypeApkSet
+	BundlePlatformTypeIOSSimulator
+	BundlePlatformTypeFile
+)
+
+type BundleFileExtension string
+
+const (
+	BundleFileExtensionAndroid          BundleFileExtension = ".apk"
+	BundleFileExtensionIOS              BundleFileExtension = ".ipa"
+	BundleFileExtensionAndroidAppBundle BundleFileExtension = ".aab"
+	BundleFileExtensionApkSet           BundleFileExtension = ".apks"
+	BundleFileExtensionXapk             BundleFileExtension = ".xapk"
+	BundleFileExtensionIOSSimulator     BundleFileExtension = ".app.zip"
+	BundleFileExtensionDmg              BundleFileExtension = ".dmg"
+	BundleFileExtensionPkg              BundleFileExtension = ".pkg"
+	BundleFileExtensionMsi              BundleFileExtension = ".msi"
+	BundleFileExtensionExe              BundleFileExtension = ".exe"
+	BundleFileExtensionZip              BundleFileExtension = ".zip"
+)
+
+// a BundleInstallFlow is the way testers get a bundle.
+type BundleInstallFlow int
+
+const (
+	// download the file as it is
+	BundleInstallFlowDownload BundleInstallFlow = 1 + iota
+	// install over the air via the itms-services manifest
+	BundleInstallFlowItmsServices
+	// download the file as it is, but it can't be installed to devices directly
+	BundleInstallFlowArchive
+)
+
+// a BundlePlatformFamily is the kind of identifier a bundle has.
+type BundlePlatformFamily int
+
+const (
+	BundlePlatformFamilyNone BundlePlatformFamily = iota
+	BundlePlatformFamilyAndroid
+	BundlePlatformFamilyIOS
+)
+
+// a BundlePlatform is a handler of a platform registered by RegisterBundlePlatform.
+type BundlePlatform struct {
+	Type        BundlePlatformType
+	Name        string
+	Title       string
+	Label       string
+	Extensions  []BundleFileExtension
+	ContentType string
+	InstallFlow BundleInstallFlow
+	Family      BundlePlatformFamily
+
+	// Parse reads the metadata of the file.
+	Parse func(file *os.File) (*BundleInfo, error)
+
+	// If UserSuppliedVersion is true, the version is given by the uploader instead of the file.
+	UserSuppliedVersion bool
+}
+
+var bundlePlatforms = map[BundlePlatformType]*BundlePlatform{}
+
+func RegisterBundlePlatform(platform *BundlePlatform) {
+	bundlePlatforms[platform.Type] = platform
+}
+
+// BundlePlatforms returns the registered platforms in order of the platform type.
+func BundlePlatforms() []*BundlePlatform {
+	platforms := make([]*BundlePlatform, 0, len(bundlePlatforms))
+	for _, platform := range bundlePlatforms {
+		platforms = append(platforms, platform)
+	}
+	sort.Sort(bundlePlatformsByType(platforms))
+	return platforms
+}
+
+type bundlePlatformsByType []*BundlePlatform
+
+func (p bundlePlatformsByType) Len() int           { return len(p) }
+func (p bundlePlatformsByType) Less(i, j int) bool { return p[i].Type < p[j].Type }
+func (p bundlePlatformsByType) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+func init() {
+	RegisterBundlePlatform(&BundlePlatform{
+		Type:        BundlePlatformTypeAndroid,
+		Name:        "android",
+		Title:       "Android",
+		Label:       "apk",
+		Extensions:  []BundleFileExtension{BundleFileExtensionAndroid},
+		ContentType: "application/vnd.android.package-archive",
+		InstallFlow: BundleInstallFlowDownload,
+		Family:      BundlePlatformFamilyAndroid,
+		Parse:       parseApk,
+	})
+	RegisterBundlePlatform(&BundlePlatform{
+		Type:        BundlePlatformTypeIOS,
+		Name:        "ios",
+		Title:       "iOS",
+		Label:       "ipa",
+		Extensions:  []BundleFileExtension{BundleFileExtensionIOS},
+		ContentType: "application/octet-stream",
+		InstallFlow: BundleInstallFlowItmsServices,
+		Family:      BundlePlatformFamilyIOS,
+		Parse:       parseIpa,
+	})
+	RegisterBundlePlatform(&BundlePlatform{
+		Type:        BundlePlatformTypeAndroidAppBundle,
+		Name:        "aab",
+		Title:       "Android App Bundle",
+		Label:       "aab",
+		Extensions:  []BundleFileExtension{BundleFileExtensionAndroidAppBundle},
+		ContentType: "application/octet-stream",
+		InstallFlow: BundleInstallFlowArchive,
+		Family:      BundlePlatformFamilyAndroid,
+		Parse:       parseAab,
+	})
+	RegisterBundlePlatform(&BundlePlatform{
+		Type:        BundlePlatformTypeApkSet,
+		Name:        "apks",
+		Title:       "Split APKs",
+		Label:       "apks",
+		Extensions:  []BundleFileExtension{BundleFileExtensionApkSet, BundleFileExtensionXapk},
+		ContentType: "application/octet-stream",
+		InstallFlow: BundleInstallFlowDownload,
+		Family:      BundlePlatformFamilyAndroid,
+		Parse:       parseApkSet,
+	})
+	RegisterBundlePlatform(&BundlePlatform{
+		Type:        BundlePlatformTypeIOSSimulator,
+		Name:        "ios_simulator",
+		Title:       "iOS Simulator",
+		Label:       "シミュレータ用app",
+		Extensions:  []BundleFileExtension{BundleFileExtensionIOSSimulator},
+		ContentType: "application/zip",
+		InstallFlow: BundleInstallFlowDownload,
+		Family:      BundlePlatformFamilyIOS,
+		Parse:       parseIOSSimulatorApp,
+	})
+	RegisterBundlePlatform(&BundlePlatform{
+		Type:  BundlePlatformTypeFile,
+		Name:  "file",
+		Title: "Other",
+		Label: "その他",
+		Extensions: []BundleFileExtension{
+			BundleFileExtensionDmg,
+			BundleFileExtensionPkg,
+			BundleFileExtensionMsi,
+			BundleFileExtensionExe,
+			BundleFileExtensionZip,
+		},
+		ContentType:         "application/octet-stream",
+		InstallFlow:         BundleInstallFlowDownload,
+		Family:              BundlePlatformFamilyNone,
+		Parse:               parseGenericFile,
+		UserSuppliedVersion: true,
+	})
+}
+
+// BundlePlatformByName returns the registered platform of the name, or nil if not registered.
+func BundlePlatformByName(name string) *BundlePlatform {
+	for _, platform := range bundlePlatforms {
+		if platform.Name == name {
+			return platform
+		}
+	}
+	return nil
+}
+
+// Platform returns the registered platform, or nil if not registered.
+func (platformType BundlePlatformType) Platform() *BundlePlatform {
+	return bundlePlatforms[platformType]
+}
+
+func (platformType BundlePlatformType) Extention() BundleFileExtension {
+	var ext BundleFileExtension
+	if platform := platformType.Platform(); platform != nil {
+		ext = platform.Extensions[0]
+	}
+	return ext
+}
+
+func (platformType BundlePlatformType) String() string {
+	var str string
+	if platform := platformType.Platform(); platform != nil {
+		str = platform.Name
+	}
+	return str
+}
+
+func (platformType BundlePlatformType) Label() string {
+	var label string
+	if platform := platformType.Platform(); platform != nil {
+		label = platform.Label
+	}
+	return label
+}
+
+func (platformType BundlePlatformType) ContentType() string {
+	contentType := "application/octet-stream"
+	if platform := platformType.Platform(); platform != nil {
+		contentType = platform.ContentType
+	}
+	return contentType
+}
+
+func (platformType BundlePlatformType) InstallFlow() BundleInstallFlow {
+	installFlow := BundleInstallFlowDownload
+	if platform := platformType.Platform(); platform != nil {
+		installFlow = platform.InstallFlow
+	}
+	return installFlow
+}
+
+// IsAndroid reports whether the bundle of the platform has an Android package name.
+func (platformType BundlePlatformType) IsAndroid() bool {
+	platform := platformType.Platform()
+	return platform != nil && platform.Family == BundlePlatformFamilyAndroid
+}
+
+// IsIOS reports whether the bundle of the platform has an iOS bundle identifier.
+func (platformType BundlePlatformType) IsIOS() bool {
+	platform := platformType.Platform()
+	return platform != nil && platform.Family == BundlePlatformFamilyIOS
+}
+
+func (platformType BundlePlatformType) UserSuppliedVersion() bool {
+	platform := platformType.Platform()
+	return platform != nil && platform.UserSuppliedVersion
+}
+
+// NewBundleFileExtension returns the extension of the file name.
+// Unlike filepath.Ext, it recognizes registered double extensions such as ".app.zip".
+func NewBundleFileExtension(filename string) BundleFileExtension {
+	lower := strings.ToLower(filename)
+
+	var found BundleFileExtension
+	for _, platform := range bundlePlatforms {
+		for _, ext := range platform.Extensions {
+			if strings.HasSuffix(lower, string(ext)) && len(ext) > len(found) {
+				found = ext
+			}
+		}
+	}
+	if found != "" {
+		return found
+	}
+
+	return BundleFileExtension(filepath.Ext(filename))
+}
+
+func (ext BundleFileExtension) IsValid() bool {
+	return ext.PlatformType() != 0
+}
+
+func (ext BundleFileExtension) PlatformType() BundlePlatformType {
+	var platformType BundlePlatformType
+	for _, platform := range bundlePlatforms {
+		for _, e := range platform.Extensions {
+			if e == ext {
+				platformType = platform.Type
+			}
+		}
+	}
+	return platformType
+}
@@ -0,0 +1,246 @@
+package models
+
+import (
+	"errors"
+	"strconv"
+)
+
+// The manifest of an Android App Bundle is a protobuf-encoded XmlNode message
+// defined in aapt2's Resources.proto. protoXmlNode decodes just the parts
+// needed to read attributes of the manifest.
+
+const androidNamespaceUri = "http://schemas.android.com/apk/res/android"
+
+const (
+	protoWireVarint  = 0
+	protoWireFixed64 = 1
+	protoWireBytes   = 2
+	protoWireFixed32 = 5
+)
+
+var errProtoMalformed = errors.New("malformed protobuf message")
+
+type protoXmlElement struct {
+	NamespaceUri string
+	Name         string
+	Attributes   []*protoXmlAttribute
+	Children     []*protoXmlElement
+}
+
+type protoXmlAttribute struct {
+	NamespaceUri string
+	Name         string
+	Value        string
+}
+
+// Attribute returns the value of the attribute, or an empty string if not found.
+func (e *protoXmlElement) Attribute(namespaceUri, name string) string {
+	for _, attr := range e.Attributes {
+		if attr.NamespaceUri == namespaceUri && attr.Name == name {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// Child returns the first child element with the name, or nil if not found.
+func (e *protoXmlElement) Child(name string) *protoXmlElement {
+	for _, child := range e.Children {
+		if child.Name == name {
+			return child
+		}
+	}
+	return nil
+}
+
+// ChildrenByName returns all child elements with the name.
+func (e *protoXmlElement) ChildrenByName(name string) []*protoXmlElement {
+	var children []*protoXmlElement
+	for _, child := range e.Children {
+		if child.Name == name {
+			children = append(children, child)
+		}
+	}
+	return children
+}
+
+type protoField struct {
+	Number   int
+	WireType int
+	Varint   uint64
+	Bytes    []byte
+}
+
+func readProtoVarint(buf []byte) (uint64, int, error) {
+	var v uint64
+	for i := 0; i < len(buf) && i < 10; i++ {
+		b := buf[i]
+		v |= uint64(b&0x7f) << (7 * uint(i))
+		if b < 0x80 {
+			return v, i + 1, nil
+		}
+	}
+	return 0, 0, errProtoMalformed
+}
+
+func readProtoFields(buf []byte) ([]*protoField, error) {
+	var fields []*protoField
+	for len(buf) > 0 {
+		key, n, err := readProtoVarint(buf)
+		if err != nil {
+			return nil, err
+		}
+		buf = buf[n:]
+
+		field := &protoField{
+			Number:   int(key >> 3),
+			WireType: int(key & 0x7),
+		}
+		switch field.WireType {
+		case protoWireVarint:
+			field.Varint, n, err = readProtoVarint(buf)
+			if err != nil {
+				return nil, err
+			}
+		case protoWireFixed64:
+			n = 8
+		case protoWireFixed32:
+			n = 4
+		case protoWireBytes:
+			length, m, err := readProtoVarint(buf)
+			if err != nil {
+				return nil, err
+			}
+			if uint64(len(buf)-m) < length {
+				return nil, errProtoMalformed
+			}
+			field.Bytes = buf[m : m+int(length)]
+			n = m + int(length)
+		default:
+			return nil, errProtoMalformed
+		}
+		if len(buf) < n {
+			return nil, errProtoMalformed
+		}
+		buf = buf[n:]
+
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// parseProtoXmlNode decodes an XmlNode message and returns its element.
+func parseProtoXmlNode(buf []byte) (*protoXmlElement, error) {
+	fields, err := readProtoFields(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, field := range fields {
+		// XmlNode.element
+		if field.Number == 1 && field.WireType == protoWireBytes {
+			return parseProtoXmlElement(field.Bytes)
+		}
+	}
+	return nil, nil
+}
+
+func parseProtoXmlElement(buf []byte) (*protoXmlElement, error) {
+	fields, err := readProtoFields(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	element := &protoXmlElement{}
+	for _, field := range fields {
+		if field.WireType != protoWireBytes {
+			continue
+		}
+		switch field.Number {
+		case 2: // XmlElement.namespace_uri
+			element.NamespaceUri = string(field.Bytes)
+		case 3: // XmlElement.name
+			element.Name = string(field.Bytes)
+		case 4: // XmlElement.attribute
+			attr, err := parseProtoXmlAttribute(field.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			element.Attributes = append(element.Attributes, attr)
+		case 5: // XmlElement.child
+			child, err := parseProtoXmlNode(field.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			if child != nil {
+				element.Children = append(element.Children, child)
+			}
+		}
+	}
+	return element, nil
+}
+
+func parseProtoXmlAttribute(buf []byte) (*protoXmlAttribute, error) {
+	fields, err := readProtoFields(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	attr := &protoXmlAttribute{}
+	var compiled string
+	for _, field := range fields {
+		if field.WireType != protoWireBytes {
+			continue
+		}
+		switch field.Number {
+		case 1: // XmlAttribute.namespace_uri
+			attr.NamespaceUri = string(field.Bytes)
+		case 2: // XmlAttribute.name
+			attr.Name = string(field.Bytes)
+		case 3: // XmlAttribute.value
+			attr.Value = string(field.Bytes)
+		case 6: // XmlAttribute.compiled_item
+			compiled, err = parseProtoItem(field.Bytes)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if attr.Value == "" {
+		attr.Value = compiled
+	}
+	return attr, nil
+}
+
+// parseProtoItem returns the string representation of a compiled primitive value.
+func parseProtoItem(buf []byte) (string, error) {
+	fields, err := readProtoFields(buf)
+	if err != nil {
+		return "", err
+	}
+
+	for _, field := range fields {
+		// Item.prim
+		if field.Number != 7 || field.WireType != protoWireBytes {
+			continue
+		}
+		prims, err := readProtoFields(field.Bytes)
+		if err != nil {
+			return "", err
+		}
+		for _, prim := range prims {
+			if prim.WireType != protoWireVarint {
+				continue
+			}
+			switch prim.Number {
+			case 6: // Primitive.int_decimal_value
+				return strconv.FormatInt(int64(int32(prim.Varint)), 10), nil
+			case 7: // Primitive.int_hexadecimal_value
+				return "0x" + strconv.FormatUint(uint64(uint32(prim.Varint)), 16), nil
+			case 8: // Primitive.boolean_value
+				return strconv.FormatBool(prim.Varint != 0), nil
+			}
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,150 @@
+package models
+
+import (
+	"testing"
+)
+
+// protoKey and the helpers below encode the messages of the tests.
+func protoKey(number, wireType int) []byte {
+	return protoVarint(uint64(number<<3 | wireType))
+}
+
+func protoVarint(v uint64) []byte {
+	var buf []byte
+	for v >= 0x80 {
+		buf = append(buf, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(buf, byte(v))
+}
+
+func protoBytes(number int, value []byte) []byte {
+	buf := protoKey(number, protoWireBytes)
+	buf = append(buf, protoVarint(uint64(len(value)))...)
+	return append(buf, value...)
+}
+
+func protoString(number int, value string) []byte {
+	return protoBytes(number, []byte(value))
+}
+
+func protoUint(number int, value uint64) []byte {
+	return append(protoKey(number, protoWireVarint), protoVarint(value)...)
+}
+
+func protoConcat(parts ...[]byte) []byte {
+	var buf []byte
+	for _, part := range parts {
+		buf = append(buf, part...)
+	}
+	return buf
+}
+
+func protoAttribute(namespaceUri, name, value string) []byte {
+	return protoBytes(4, protoConcat(
+		protoString(1, namespaceUri),
+		protoString(2, name),
+		protoString(3, value),
+	))
+}
+
+func protoCompiledAttribute(name string, primitive []byte) []byte {
+	return protoBytes(4, protoConcat(
+		protoString(1, androidNamespaceUri),
+		protoString(2, name),
+		protoBytes(6, protoBytes(7, primitive)),
+	))
+}
+
+func protoNode(name string, contents ...[]byte) []byte {
+	return protoBytes(1, protoConcat(append([][]byte{protoString(3, name)}, contents...)...))
+}
+
+func TestParseProtoXmlNode(t *testing.T) {
+	usesSdk := protoNode("uses-sdk",
+		protoCompiledAttribute("minSdkVersion", protoUint(6, 21)),
+		protoCompiledAttribute("targetSdkVersion", protoUint(6, 30)),
+	)
+	application := protoNode("application",
+		protoCompiledAttribute("debuggable", protoUint(8, 1)),
+		protoCompiledAttribute("allowBackup", protoUint(8, 0)),
+		protoCompiledAttribute("theme", protoUint(7, 0x7f0e0001)),
+	)
+	manifest := protoNode("manifest",
+		protoAttribute("", "package", "com.example.app"),
+		protoAttribute(androidNamespaceUri, "versionName", "1.2.3"),
+		protoBytes(5, usesSdk),
+		protoBytes(5, application),
+		protoBytes(5, protoNode("uses-permission", protoAttribute(androidNamespaceUri, "name", "android.permission.INTERNET"))),
+		protoBytes(5, protoNode("uses-permission", protoAttribute(androidNamespaceUri, "name", "android.permission.CAMERA"))),
+		// a text node has no element
+		protoBytes(5, protoString(2, "text")),
+	)
+
+	element, err := parseProtoXmlNode(manifest)
+	if err != nil {
+		t.Fatalf("parseProtoXmlNode returned an error: %s", err)
+	}
+	if element.Name != "manifest" {
+		t.Fatalf("name is %q, want manifest", element.Name)
+	}
+
+	tests := []struct {
+		element      *protoXmlElement
+		namespaceUri string
+		name         string
+		want         string
+	}{
+		{element, "", "package", "com.example.app"},
+		{element, androidNamespaceUri, "versionName", "1.2.3"},
+		{element, "", "versionName", ""},
+		{element, androidNamespaceUri, "versionCode", ""},
+		{element.Child("uses-sdk"), androidNamespaceUri, "minSdkVersion", "21"},
+		{element.Child("uses-sdk"), androidNamespaceUri, "targetSdkVersion", "30"},
+		{element.Child("application"), androidNamespaceUri, "debuggable", "true"},
+		{element.Child("application"), androidNamespaceUri, "allowBackup", "false"},
+		{element.Child("application"), androidNamespaceUri, "theme", "0x7f0e0001"},
+	}
+	for _, test := range tests {
+		if test.element == nil {
+			t.Errorf("element of %s is not found", test.name)
+			continue
+		}
+		if got := test.element.Attribute(test.namespaceUri, test.name); got != test.want {
+			t.Errorf("attribute %s of %s is %q, want %q", test.name, test.element.Name, got, test.want)
+		}
+	}
+
+	if n := len(element.Children); n != 4 {
+		t.Errorf("manifest has %d children, want 4", n)
+	}
+	if n := len(element.ChildrenByName("uses-permission")); n != 2 {
+		t.Errorf("manifest has %d uses-permission, want 2", n)
+	}
+	if element.Child("activity") != nil {
+		t.Errorf("Child returned an element not found")
+	}
+}
+
+func TestParseProtoXmlNodeMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		buf  []byte
+	}{
+		{"truncated varint", []byte{0x80}},
+		{"truncated bytes", []byte{0x0a, 0x05, 'a'}},
+		{"truncated fixed32", []byte{0x0d, 0x01}},
+		{"unknown wire type", []byte{0x0f}},
+		{"malformed element", protoBytes(1, []byte{0x1a, 0x05})},
+	}
+	for _, test := range tests {
+		if _, err := parseProtoXmlNode(test.buf); err != errProtoMalformed {
+			t.Errorf("%s: error is %v, want %v", test.name, err, errProtoMalformed)
+		}
+	}
+
+	element, err := parseProtoXmlNode(protoString(2, "text"))
+	if err != nil || element != nil {
+		t.Errorf("text node: got %v, %v, want nil element", element, err)
+	}
+}
@@ -0,0 +1,403 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/coopernurse/gorp"
+)
+
+// the statuses of UploadJob
+const (
+	UploadJobStatusQueued     = "queued"
+	UploadJobStatusFetching   = "fetching"
+	UploadJobStatusProcessing = "processing"
+	UploadJobStatusCompleted  = "completed"
+	UploadJobStatusFailed     = "failed"
+)
+
+// the hosts permitted to fetch files from, set by the config. All hosts are permitted if it is empty.
+// The hosts in the private networks are permitted only if they are listed, and the ports are ignored.
+var UploadJobAllowedHosts []string
+
+// the time limit to fetch a file
+var UploadJobFetchTimeout = time.Hour
+
+// the duration after which the job still running is considered interrupted by the stop of the server.
+// The jobs of the other servers sharing the database are not interrupted in the meantime.
+var UploadJobTimeout = 6 * time.Hour
+
+// the networks which upload jobs can't connect to, in addition to the loopback, link-local and unspecified addresses
+var uploadJobDeniedNetworks = parseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"fc00::/7",
+)
+
+// uploadJobDial connects to the address of the file. It is replaced in the tests.
+var uploadJobDial = dialPublic
+
+var errUploadJobDenied = errors.New("the address is not permitted")
+
+// an UploadJob creates a bundle from the file fetched from the URL in the background.
+type UploadJob struct {
+	Id           int       `db:"id"`
+	AppId        int       `db:"app_id"`
+	Token        string    `db:"token"` // the id of the job in the API
+	Url          string    `db:"url"`
+	Sha256       string    `db:"sha256"` // the expected checksum, optional
+	Status       string    `db:"status"`
+	BundleId     int       `db:"bundle_id"`
+	Messages     string    `db:"messages"` // joined with newlines
+	ErrorCode    string    `db:"error_code"`
+	ErrorMessage string    `db:"error_message"`
+	CreatedAt    time.Time `db:"created_at"`
+	UpdatedAt    time.Time `db:"updated_at"`
+}
+
+type UploadJobErrorJsonResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type UploadJobJsonResponse struct {
+	Id        string                      `json:"id"`
+	AppId     int                         `json:"app_id"`
+	Url       string                      `json:"url"`
+	Status    string                      `json:"status"`
+	Bundle    *BundleJsonResponse         `json:"bundle,omitempty"` // set by the controller
+	Messages  []string                    `json:"messages"`
+	Error     *UploadJobErrorJsonResponse `json:"error,omitempty"`
+	CreatedAt string                      `json:"created_at"`
+	UpdatedAt string                      `json:"updated_at"`
+}
+
+// a FetchError is an error to fetch the file of an upload job.
+type FetchError struct {
+	Reason string
+}
+
+func (e *FetchError) Error() string {
+	return fmt.Sprintf("failed to fetch the file: %s", e.Reason)
+}
+
+func NewUploadJob(appId int, rawUrl string, sha256 string) *UploadJob {
+	return &UploadJob{
+		AppId:  appId,
+		Token:  NewToken(),
+		Url:    rawUrl,
+		Sha256: strings.ToLower(sha256),
+		Status: UploadJobStatusQueued,
+	}
+}
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+	return networks
+}
+
+// isPublicIP reports whether upload jobs can connect to the IP.
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, network := range uploadJobDeniedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// dialPublic connects to the address only if the host is resolved to the public IPs.
+// The resolved IPs are connected in order, so the host can't be resolved to another IP after it is checked.
+func dialPublic(network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no address of %s", host)
+	}
+	for _, ip := range ips {
+		if !isPublicIP(ip) {
+			return nil, errUploadJobDenied
+		}
+	}
+
+	var conn net.Conn
+	for _, ip := range ips {
+		conn, err = net.DialTimeout(network, net.JoinHostPort(ip.String(), port), 30*time.Second)
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// hostName returns the host of the "host:port" without the port and the brackets of IPv6.
+func hostName(hostport string) string {
+	host := hostport
+	if h, _, err := net.SplitHostPort(hostport); err == nil {
+		host = h
+	}
+	return strings.Trim(host, "[]")
+}
+
+// isListedUploadJobHost reports whether the host is in UploadJobAllowedHosts.
+func isListedUploadJobHost(host string) bool {
+	for _, allowed := range UploadJobAllowedHosts {
+		if strings.EqualFold(hostName(allowed), host) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAllowedUploadJobUrl reports whether the file can be fetched from the URL.
+// The listed hosts are permitted even in the private networks.
+// The other host given as an IP is checked here, and the resolved IP of the host name is checked when connecting.
+func IsAllowedUploadJobUrl(rawUrl string) bool {
+	u, err := url.Parse(rawUrl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return false
+	}
+	host := hostName(u.Host)
+	if len(UploadJobAllowedHosts) != 0 {
+		return isListedUploadJobHost(host)
+	}
+	if ip := net.ParseIP(host); ip != nil && !isPublicIP(ip) {
+		return false
+	}
+	return true
+}
+
+// UploadJobFileName returns the name of the file in the path of the URL.
+func UploadJobFileName(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return ""
+	}
+	return path.Base(u.Path)
+}
+
+func (job *UploadJob) PreInsert(s gorp.SqlExecutor) error {
+	job.CreatedAt = time.Now()
+	job.UpdatedAt = job.CreatedAt
+	return nil
+}
+
+func (job *UploadJob) PreUpdate(s gorp.SqlExecutor) error {
+	job.UpdatedAt = time.Now()
+	return nil
+}
+
+func (job *UploadJob) Save(txn gorp.SqlExecutor) error {
+	return txn.Insert(job)
+}
+
+func (job *UploadJob) UpdateStatus(txn gorp.SqlExecutor, status string) error {
+	job.Status = status
+	_, err := txn.Update(job)
+	return err
+}
+
+// Complete records the bundle created by the job.
+func (job *UploadJob) Complete(txn gorp.SqlExecutor, bundleId int, messages []string) error {
+	job.BundleId = bundleId
+	job.Messages = strings.Join(messages, "\n")
+	return job.UpdateStatus(txn, UploadJobStatusCompleted)
+}
+
+// Fail records the error of the job with the code of the API.
+func (job *UploadJob) Fail(txn gorp.SqlExecutor, code string, message string) error {
+	job.ErrorCode = code
+	job.ErrorMessage = message
+	return job.UpdateStatus(txn, UploadJobStatusFailed)
+}
+
+// Fetch downloads the file of the URL with the headers into a temporary file, and verifies the checksum if it is given.
+// It returns a FetchError if the server doesn't respond the file or the file is larger than MaxUploadFileSize,
+// or ErrUploadChecksumMismatch.
+// The headers are not sent to the other hosts than the host of the URL when the request is redirected.
+// The host of the URL can be in the private networks only if it is listed, and the other hosts redirected to are always checked.
+// The caller should remove the file by RemoveTempFile.
+func (job *UploadJob) Fetch(header http.Header) (*os.File, error) {
+	req, err := http.NewRequest("GET", job.Url, nil)
+	if err != nil {
+		return nil, &FetchError{err.Error()}
+	}
+	for name, values := range header {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+
+	// the listed host of the URL is trusted, but the hosts it redirects to are not
+	trustedHost := ""
+	if host := hostName(req.URL.Host); isListedUploadJobHost(host) {
+		trustedHost = host
+	}
+	dial := func(network, addr string) (net.Conn, error) {
+		if trustedHost != "" && strings.EqualFold(hostName(addr), trustedHost) {
+			return net.DialTimeout(network, addr, 30*time.Second)
+		}
+		return uploadJobDial(network, addr)
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial:                dial,
+			TLSHandshakeTimeout: 30 * time.Second,
+		},
+		Timeout: UploadJobFetchTimeout,
+		// the redirected URL is also checked not to reach the hosts not permitted
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			if !IsAllowedUploadJobUrl(req.URL.String()) {
+				return fmt.Errorf("redirected to %s which is not permitted", req.URL.Host)
+			}
+			// the headers such as the credentials are only for the host of the URL
+			if !strings.EqualFold(req.URL.Host, via[0].URL.Host) {
+				for name := range header {
+					req.Header.Del(name)
+				}
+			}
+			return nil
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, &FetchError{err.Error()}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &FetchError{resp.Status}
+	}
+	if resp.ContentLength > MaxUploadFileSize {
+		return nil, &FetchError{fmt.Sprintf("the file is larger than %d bytes", MaxUploadFileSize)}
+	}
+
+	file, err := ioutil.TempFile("", "alphawing")
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(file, h), io.LimitReader(resp.Body, MaxUploadFileSize+1))
+	if err != nil {
+		RemoveTempFile(file)
+		return nil, &FetchError{err.Error()}
+	}
+	if n > MaxUploadFileSize {
+		RemoveTempFile(file)
+		return nil, &FetchError{fmt.Sprintf("the file is larger than %d bytes", MaxUploadFileSize)}
+	}
+	if job.Sha256 != "" && hex.EncodeToString(h.Sum(nil)) != job.Sha256 {
+		RemoveTempFile(file)
+		return nil, ErrUploadChecksumMismatch
+	}
+
+	if _, err := file.Seek(0, os.SEEK_SET); err != nil {
+		RemoveTempFile(file)
+		return nil, err
+	}
+	return file, nil
+}
+
+func (job *UploadJob) JsonResponse() *UploadJobJsonResponse {
+	messages := []string{}
+	if job.Messages != "" {
+		messages = strings.Split(job.Messages, "\n")
+	}
+
+	var jobError *UploadJobErrorJsonResponse
+	if job.Status == UploadJobStatusFailed {
+		jobError = &UploadJobErrorJsonResponse{
+			Code:    job.ErrorCode,
+			Message: job.ErrorMessage,
+		}
+	}
+
+	return &UploadJobJsonResponse{
+		Id:        job.Token,
+		AppId:     job.AppId,
+		Url:       job.Url,
+		Status:    job.Status,
+		Messages:  messages,
+		Error:     jobError,
+		CreatedAt: job.CreatedAt.Format(time.RFC3339),
+		UpdatedAt: job.UpdatedAt.Format(time.RFC3339),
+	}
+}
+
+func GetUploadJobByToken(txn gorp.SqlExecutor, token string) (*UploadJob, error) {
+	var job UploadJob
+	if err := txn.SelectOne(&job, "SELECT * FROM upload_job WHERE token = ?", token); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// FailInterruptedUploadJobs marks the jobs as failed which are still running without updates since before the time,
+// and returns the number of them.
+func FailInterruptedUploadJobs(txn gorp.SqlExecutor, code string, before time.Time) (int, error) {
+	result, err := txn.Exec(
+		"UPDATE upload_job SET status = ?, error_code = ?, error_message = ?, updated_at = ? WHERE status IN (?, ?, ?) AND updated_at < ?",
+		UploadJobStatusFailed, code, "The job is interrupted by the restart of the server.", time.Now(),
+		UploadJobStatusQueued, UploadJobStatusFetching, UploadJobStatusProcessing, before,
+	)
+	if err != nil {
+		return 0, err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(count), nil
+}
+
+// DeleteFinishedUploadJobs deletes the jobs finished before the time, and returns the number of them.
+func DeleteFinishedUploadJobs(txn gorp.SqlExecutor, before time.Time) (int, error) {
+	result, err := txn.Exec(
+		"DELETE FROM upload_job WHERE status IN (?, ?) AND updated_at < ?",
+		UploadJobStatusCompleted, UploadJobStatusFailed, before,
+	)
+	if err != nil {
+		return 0, err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(count), nil
+}
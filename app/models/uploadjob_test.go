@@ -0,0 +1,238 @@
+package models
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIsAllowedUploadJobUrl(t *testing.T) {
+	defaultHosts := UploadJobAllowedHosts
+	defer func() { UploadJobAllowedHosts = defaultHosts }()
+
+	tests := []struct {
+		allowedHosts []string
+		url          string
+		want         bool
+	}{
+		{nil, "https://artifacts.example.com/app.ipa", true},
+		{nil, "http://artifacts.example.com:8080/app.ipa", true},
+		{nil, "https://203.0.113.1/app.ipa", true},
+		{nil, "ftp://artifacts.example.com/app.ipa", false},
+		{nil, "file:///etc/passwd", false},
+		{nil, "/app.ipa", false},
+		{nil, "https://", false},
+		{nil, "http://127.0.0.1/app.ipa", false},
+		{nil, "http://127.0.0.1:8080/app.ipa", false},
+		{nil, "http://10.1.2.3/app.ipa", false},
+		{nil, "http://172.16.0.1/app.ipa", false},
+		{nil, "http://192.168.1.1/app.ipa", false},
+		{nil, "http://169.254.169.254/latest/meta-data/", false},
+		{nil, "http://0.0.0.0/app.ipa", false},
+		{nil, "http://[::1]/app.ipa", false},
+		{nil, "http://[::1]:8080/app.ipa", false},
+		{nil, "http://[fe80::1]/app.ipa", false},
+		{nil, "http://[fd00::1]/app.ipa", false},
+		{nil, "http://[::ffff:10.0.0.1]/app.ipa", false},
+		{[]string{"artifacts.example.com"}, "https://artifacts.example.com/app.ipa", true},
+		{[]string{"artifacts.example.com"}, "https://ARTIFACTS.example.com/app.ipa", true},
+		{[]string{"artifacts.example.com"}, "https://evil.example.com/app.ipa", false},
+		{[]string{"artifacts.example.com"}, "https://artifacts.example.com:8443/app.ipa", true},
+		{[]string{"ci.example.com:8080"}, "http://ci.example.com:8080/app.ipa", true},
+		{[]string{"ci.example.com:8080"}, "http://ci.example.com/app.ipa", true},
+		{[]string{"10.0.0.1"}, "http://10.0.0.1/app.ipa", true},
+		{[]string{"10.0.0.1"}, "http://10.0.0.2/app.ipa", false},
+		{[]string{"artifacts.example.com"}, "http://10.0.0.1/app.ipa", false},
+		{[]string{"[fd00::1]"}, "http://[fd00::1]:8080/app.ipa", true},
+	}
+	for _, test := range tests {
+		UploadJobAllowedHosts = test.allowedHosts
+		if got := IsAllowedUploadJobUrl(test.url); got != test.want {
+			t.Errorf("%s with %v: got %v, want %v", test.url, test.allowedHosts, got, test.want)
+		}
+	}
+}
+
+func TestUploadJobFetchDeniesPrivateAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("file"))
+	}))
+	defer server.Close()
+
+	// the host name resolved to the loopback address
+	url := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+	job := NewUploadJob(1, url, "")
+	if file, err := job.Fetch(nil); err == nil {
+		RemoveTempFile(file)
+		t.Fatalf("fetched the file from %s", url)
+	} else if _, ok := err.(*FetchError); !ok {
+		t.Errorf("error is %v, want a FetchError", err)
+	}
+}
+
+// allowLoopback permits the test servers while the test runs.
+func allowLoopback() func() {
+	uploadJobDial = func(network, addr string) (net.Conn, error) {
+		return net.Dial(network, addr)
+	}
+	return func() { uploadJobDial = dialPublic }
+}
+
+func TestUploadJobFetch(t *testing.T) {
+	defer allowLoopback()()
+	defaultMaxSize := MaxUploadFileSize
+	MaxUploadFileSize = 8
+	defer func() { MaxUploadFileSize = defaultMaxSize }()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small":
+			w.Write([]byte("12345678"))
+		case "/large":
+			w.Write([]byte("123456789"))
+		case "/chunked":
+			// no Content-Length
+			w.(http.Flusher).Flush()
+			w.Write([]byte("123456789"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		path    string
+		sha256  string
+		content string
+		fails   bool
+	}{
+		{"/small", "", "12345678", false},
+		{"/small", "ef797c8118f02dfb649607dd5d3f8c7623048c9c063d532cc95c5ed7a898a64f", "12345678", false},
+		{"/large", "", "", true},
+		{"/chunked", "", "", true},
+		{"/missing", "", "", true},
+	}
+	for _, test := range tests {
+		job := NewUploadJob(1, server.URL+test.path, test.sha256)
+		file, err := job.Fetch(nil)
+		if test.fails {
+			if err == nil {
+				RemoveTempFile(file)
+				t.Errorf("%s: fetched without an error", test.path)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: returned an error: %s", test.path, err)
+			continue
+		}
+		content, err := ioutil.ReadAll(file)
+		RemoveTempFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != test.content {
+			t.Errorf("%s: content is %q, want %q", test.path, content, test.content)
+		}
+	}
+
+	job := NewUploadJob(1, server.URL+"/small", "0000000000000000000000000000000000000000000000000000000000000000")
+	if _, err := job.Fetch(nil); err != ErrUploadChecksumMismatch {
+		t.Errorf("error of the wrong checksum is %v, want %v", err, ErrUploadChecksumMismatch)
+	}
+}
+
+func TestUploadJobFetchRedirect(t *testing.T) {
+	defer allowLoopback()()
+
+	var received []string
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = append(received, r.Header.Get("X-Artifact-Token"))
+		w.Write([]byte("file"))
+	}))
+	defer other.Close()
+	// the literal loopback addresses are denied as redirected URLs
+	otherUrl := strings.Replace(other.URL, "127.0.0.1", "localhost", 1)
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/same":
+			received = append(received, r.Header.Get("X-Artifact-Token"))
+			http.Redirect(w, r, "/file", http.StatusFound)
+		case "/other":
+			received = append(received, r.Header.Get("X-Artifact-Token"))
+			http.Redirect(w, r, otherUrl+"/file", http.StatusFound)
+		case "/file":
+			received = append(received, r.Header.Get("X-Artifact-Token"))
+			w.Write([]byte("file"))
+		}
+	}))
+	defer origin.Close()
+	originUrl := strings.Replace(origin.URL, "127.0.0.1", "localhost", 1)
+
+	header := http.Header{}
+	header.Set("X-Artifact-Token", "secret")
+
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{"/same", []string{"secret", "secret"}},
+		{"/other", []string{"secret", ""}},
+	}
+	for _, test := range tests {
+		received = nil
+		job := NewUploadJob(1, originUrl+test.path, "")
+		file, err := job.Fetch(header)
+		if err != nil {
+			t.Errorf("%s: returned an error: %s", test.path, err)
+			continue
+		}
+		RemoveTempFile(file)
+		if strings.Join(received, ",") != strings.Join(test.want, ",") {
+			t.Errorf("%s: received headers are %q, want %q", test.path, received, test.want)
+		}
+	}
+}
+
+func TestUploadJobFetchListedPrivateHost(t *testing.T) {
+	defaultHosts := UploadJobAllowedHosts
+	defer func() { UploadJobAllowedHosts = defaultHosts }()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/file":
+			w.Write([]byte("file"))
+		case "/redirect":
+			// the other listed host in the private network
+			http.Redirect(w, r, "http://"+strings.Replace(r.Host, "localhost", "127.0.0.1", 1)+"/file", http.StatusFound)
+		}
+	}))
+	defer server.Close()
+	serverUrl := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+	UploadJobAllowedHosts = []string{"localhost", "127.0.0.1"}
+
+	tests := []struct {
+		path  string
+		fails bool
+	}{
+		{"/file", false},
+		{"/redirect", true},
+	}
+	for _, test := range tests {
+		job := NewUploadJob(1, serverUrl+test.path, "")
+		file, err := job.Fetch(nil)
+		if err == nil {
+			RemoveTempFile(file)
+		}
+		if test.fails && err == nil {
+			t.Errorf("%s: fetched without an error", test.path)
+		}
+		if !test.fails && err != nil {
+			t.Errorf("%s: returned an error: %s", test.path, err)
+		}
+	}
+}
@@ -0,0 +1,374 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coopernurse/gorp"
+)
+
+const (
+	DefaultUploadChunkSize int64 = 8 * 1024 * 1024
+	MinUploadChunkSize     int64 = 256 * 1024
+	MaxUploadChunkSize     int64 = 64 * 1024 * 1024
+)
+
+// the directory where the chunks of upload sessions are stored, set by the config
+var UploadSessionDir = filepath.Join(os.TempDir(), "alphawing-uploads")
+
+// the duration an upload session is kept after its last activity, set by the config
+var UploadSessionExpiry = 24 * time.Hour
+
+// the maximum size of a file uploaded in chunks or fetched by an upload job, set by the config
+var MaxUploadFileSize int64 = 2 * 1024 * 1024 * 1024
+
+// the duration after which the finalizing of a session is considered interrupted
+var uploadSessionFinalizeTimeout = time.Hour
+
+var (
+	ErrUploadChunkIndex       = errors.New("chunk index is out of range")
+	ErrUploadChunkSize        = errors.New("chunk size is not matched")
+	ErrUploadIncomplete       = errors.New("some chunks are not uploaded yet")
+	ErrUploadChecksumMismatch = errors.New("sha256 of the uploaded file is not matched")
+	ErrUploadFinalizing       = errors.New("upload session is being finalized")
+)
+
+// an UploadSession receives a large file in chunks.
+// The chunks are stored in UploadSessionDir until the session is finalized or expires.
+type UploadSession struct {
+	Id           int        `db:"id"`
+	AppId        int        `db:"app_id"`
+	Token        string     `db:"token"` // the id of the session in the API
+	FileName     string     `db:"file_name"`
+	FileSize     int64      `db:"file_size"`
+	ChunkSize    int64      `db:"chunk_size"`
+	Sha256       string     `db:"sha256"` // the expected checksum, optional
+	FinalizingAt *time.Time `db:"finalizing_at"`
+	BundleId     int        `db:"bundle_id"` // the bundle created from the session, kept until the session is deleted
+	ExpiresAt    time.Time  `db:"expires_at"`
+	CreatedAt    time.Time  `db:"created_at"`
+	UpdatedAt    time.Time  `db:"updated_at"`
+}
+
+// an UploadRange is a range of the received bytes. The end is inclusive.
+type UploadRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+type UploadSessionJsonResponse struct {
+	Id             string         `json:"id"`
+	AppId          int            `json:"app_id"`
+	FileName       string         `json:"file_name"`
+	FileSize       int64          `json:"file_size"`
+	ChunkSize      int64          `json:"chunk_size"`
+	ChunkCount     int            `json:"chunk_count"`
+	ReceivedChunks []int          `json:"received_chunks"`
+	ReceivedRanges []*UploadRange `json:"received_ranges"`
+	ReceivedSize   int64          `json:"received_size"`
+	Complete       bool           `json:"complete"`
+	ExpiresAt      string         `json:"expires_at"`
+}
+
+func NewUploadSession(appId int, fileName string, fileSize int64, chunkSize int64, sha256 string) *UploadSession {
+	return &UploadSession{
+		AppId:     appId,
+		Token:     NewToken(),
+		FileName:  fileName,
+		FileSize:  fileSize,
+		ChunkSize: chunkSize,
+		Sha256:    strings.ToLower(sha256),
+		ExpiresAt: time.Now().Add(UploadSessionExpiry),
+	}
+}
+
+func (session *UploadSession) PreInsert(s gorp.SqlExecutor) error {
+	session.CreatedAt = time.Now()
+	session.UpdatedAt = session.CreatedAt
+	return nil
+}
+
+func (session *UploadSession) PreUpdate(s gorp.SqlExecutor) error {
+	session.UpdatedAt = time.Now()
+	return nil
+}
+
+func (session *UploadSession) Save(txn gorp.SqlExecutor) error {
+	return txn.Insert(session)
+}
+
+// Delete deletes the session with the stored chunks.
+func (session *UploadSession) Delete(txn gorp.SqlExecutor) error {
+	if err := session.RemoveFiles(); err != nil {
+		return err
+	}
+	_, err := txn.Delete(session)
+	return err
+}
+
+// Touch extends the expiry of the session.
+func (session *UploadSession) Touch(txn gorp.SqlExecutor) error {
+	now := time.Now()
+	session.ExpiresAt = now.Add(UploadSessionExpiry)
+	_, err := txn.Exec("UPDATE upload_session SET expires_at = ?, updated_at = ? WHERE id = ?", session.ExpiresAt, now, session.Id)
+	return err
+}
+
+func (session *UploadSession) IsExpired() bool {
+	return session.ExpiresAt.Before(time.Now())
+}
+
+// IsFinalizing reports whether a request is finalizing the session.
+func (session *UploadSession) IsFinalizing() bool {
+	return session.FinalizingAt != nil && session.FinalizingAt.After(time.Now().Add(-uploadSessionFinalizeTimeout))
+}
+
+// BeginFinalize marks the session as finalizing, so that the concurrent requests don't create the bundle twice.
+// It returns ErrUploadFinalizing if another request is finalizing the session.
+func (session *UploadSession) BeginFinalize(txn gorp.SqlExecutor) error {
+	now := time.Now()
+	result, err := txn.Exec(
+		"UPDATE upload_session SET finalizing_at = ? WHERE id = ? AND (finalizing_at IS NULL OR finalizing_at < ?)",
+		now,
+		session.Id,
+		now.Add(-uploadSessionFinalizeTimeout),
+	)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrUploadFinalizing
+	}
+	session.FinalizingAt = &now
+	return nil
+}
+
+// EndFinalize unmarks the session to finalize it again after an error.
+func (session *UploadSession) EndFinalize(txn gorp.SqlExecutor) error {
+	_, err := txn.Exec("UPDATE upload_session SET finalizing_at = NULL WHERE id = ?", session.Id)
+	if err != nil {
+		return err
+	}
+	session.FinalizingAt = nil
+	return nil
+}
+
+// Complete records the bundle created from the session, so that a retry returns the bundle if the session can't be deleted.
+func (session *UploadSession) Complete(txn gorp.SqlExecutor, bundleId int) error {
+	_, err := txn.Exec("UPDATE upload_session SET bundle_id = ? WHERE id = ?", bundleId, session.Id)
+	if err != nil {
+		return err
+	}
+	session.BundleId = bundleId
+	return nil
+}
+
+func (session *UploadSession) ChunkCount() int {
+	return int((session.FileSize + session.ChunkSize - 1) / session.ChunkSize)
+}
+
+// ChunkLength returns the size of the chunk. Only the last chunk can be shorter than ChunkSize.
+func (session *UploadSession) ChunkLength(index int) int64 {
+	if index == session.ChunkCount()-1 {
+		return session.FileSize - int64(index)*session.ChunkSize
+	}
+	return session.ChunkSize
+}
+
+func (session *UploadSession) dir() string {
+	return filepath.Join(UploadSessionDir, session.Token)
+}
+
+func (session *UploadSession) chunkPath(index int) string {
+	return filepath.Join(session.dir(), strconv.Itoa(index))
+}
+
+// WriteChunk stores the chunk of the index read from r.
+// The chunk is replaced if it is already uploaded, so the client can retry it.
+func (session *UploadSession) WriteChunk(index int, r io.Reader) error {
+	if index < 0 || index >= session.ChunkCount() {
+		return ErrUploadChunkIndex
+	}
+	if err := os.MkdirAll(session.dir(), 0700); err != nil {
+		return err
+	}
+
+	// write to a unique temporary file not to leave a partial chunk,
+	// and not to mix the concurrent uploads of the same chunk
+	tmp, err := ioutil.TempFile(session.dir(), strconv.Itoa(index)+".part")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	length := session.ChunkLength(index)
+	n, err := io.Copy(tmp, io.LimitReader(r, length+1))
+	if err != nil {
+		return err
+	}
+	if n != length {
+		return ErrUploadChunkSize
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), session.chunkPath(index))
+}
+
+// ReceivedChunks returns the indexes of the stored chunks in ascending order.
+func (session *UploadSession) ReceivedChunks() ([]int, error) {
+	indexes := []int{}
+	for i := 0; i < session.ChunkCount(); i++ {
+		info, err := os.Stat(session.chunkPath(i))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		if info.Size() == session.ChunkLength(i) {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes, nil
+}
+
+// receivedRanges returns the byte ranges of the chunks. The adjacent chunks are merged.
+func (session *UploadSession) receivedRanges(indexes []int) []*UploadRange {
+	ranges := []*UploadRange{}
+	for _, i := range indexes {
+		start := int64(i) * session.ChunkSize
+		end := start + session.ChunkLength(i) - 1
+		if len(ranges) > 0 && ranges[len(ranges)-1].End+1 == start {
+			ranges[len(ranges)-1].End = end
+			continue
+		}
+		ranges = append(ranges, &UploadRange{Start: start, End: end})
+	}
+	return ranges
+}
+
+// Assemble concatenates the chunks into a file and verifies the checksum if it is given.
+// It returns ErrUploadIncomplete if some chunks are missing.
+// The file is created in the directory of the session, so it is removed with RemoveFiles at the latest.
+func (session *UploadSession) Assemble() (*os.File, error) {
+	indexes, err := session.ReceivedChunks()
+	if err != nil {
+		return nil, err
+	}
+	if len(indexes) != session.ChunkCount() {
+		return nil, ErrUploadIncomplete
+	}
+
+	// a unique file for each call not to break the file assembled concurrently
+	file, err := ioutil.TempFile(session.dir(), "assembled")
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range indexes {
+		if err := appendFile(file, session.chunkPath(i)); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	if session.Sha256 != "" {
+		sha256, err := FileSha256(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		if sha256 != session.Sha256 {
+			file.Close()
+			return nil, ErrUploadChecksumMismatch
+		}
+	}
+
+	if _, err := file.Seek(0, 0); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func appendFile(dst *os.File, path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+// RemoveFiles removes the stored chunks and the assembled file.
+func (session *UploadSession) RemoveFiles() error {
+	return os.RemoveAll(session.dir())
+}
+
+func (session *UploadSession) JsonResponse() (*UploadSessionJsonResponse, error) {
+	indexes, err := session.ReceivedChunks()
+	if err != nil {
+		return nil, err
+	}
+
+	var receivedSize int64
+	for _, i := range indexes {
+		receivedSize += session.ChunkLength(i)
+	}
+
+	return &UploadSessionJsonResponse{
+		Id:             session.Token,
+		AppId:          session.AppId,
+		FileName:       session.FileName,
+		FileSize:       session.FileSize,
+		ChunkSize:      session.ChunkSize,
+		ChunkCount:     session.ChunkCount(),
+		ReceivedChunks: indexes,
+		ReceivedRanges: session.receivedRanges(indexes),
+		ReceivedSize:   receivedSize,
+		Complete:       len(indexes) == session.ChunkCount(),
+		ExpiresAt:      session.ExpiresAt.Format(time.RFC3339),
+	}, nil
+}
+
+// GetUploadSessionByToken returns the session of the id in the API.
+// The expired session is treated as not found.
+func GetUploadSessionByToken(txn gorp.SqlExecutor, token string) (*UploadSession, error) {
+	var session UploadSession
+	if err := txn.SelectOne(&session, "SELECT * FROM upload_session WHERE token = ?", token); err != nil {
+		return nil, err
+	}
+	if session.IsExpired() {
+		return nil, sql.ErrNoRows
+	}
+	return &session, nil
+}
+
+// DeleteExpiredUploadSessions deletes the sessions abandoned before the time, and returns the number of them.
+func DeleteExpiredUploadSessions(txn gorp.SqlExecutor, now time.Time) (int, error) {
+	var sessions []*UploadSession
+	_, err := txn.Select(&sessions, "SELECT * FROM upload_session WHERE expires_at < ?", now)
+	if err != nil {
+		return 0, err
+	}
+	for _, session := range sessions {
+		if err := session.Delete(txn); err != nil {
+			return 0, err
+		}
+	}
+	return len(sessions), nil
+}
@@ -0,0 +1,131 @@
+package models
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestUploadSessionChunks(t *testing.T) {
+	tests := []struct {
+		fileSize  int64
+		chunkSize int64
+		count     int
+		lengths   []int64
+	}{
+		{10, 4, 3, []int64{4, 4, 2}},
+		{12, 4, 3, []int64{4, 4, 4}},
+		{3, 4, 1, []int64{3}},
+		{1, 1, 1, []int64{1}},
+	}
+	for _, test := range tests {
+		session := &UploadSession{FileSize: test.fileSize, ChunkSize: test.chunkSize}
+		if n := session.ChunkCount(); n != test.count {
+			t.Errorf("%d/%d: chunk count is %d, want %d", test.fileSize, test.chunkSize, n, test.count)
+			continue
+		}
+		var total int64
+		for i, want := range test.lengths {
+			if length := session.ChunkLength(i); length != want {
+				t.Errorf("%d/%d: length of chunk %d is %d, want %d", test.fileSize, test.chunkSize, i, length, want)
+			}
+			total += session.ChunkLength(i)
+		}
+		if total != test.fileSize {
+			t.Errorf("%d/%d: total length is %d", test.fileSize, test.chunkSize, total)
+		}
+	}
+}
+
+func TestUploadSessionReceivedRanges(t *testing.T) {
+	session := &UploadSession{FileSize: 10, ChunkSize: 4}
+
+	tests := []struct {
+		indexes []int
+		want    []*UploadRange
+	}{
+		{[]int{}, []*UploadRange{}},
+		{[]int{0}, []*UploadRange{{0, 3}}},
+		{[]int{0, 1, 2}, []*UploadRange{{0, 9}}},
+		{[]int{0, 2}, []*UploadRange{{0, 3}, {8, 9}}},
+		{[]int{1, 2}, []*UploadRange{{4, 9}}},
+	}
+	for _, test := range tests {
+		ranges := session.receivedRanges(test.indexes)
+		if !reflect.DeepEqual(ranges, test.want) {
+			t.Errorf("%v: ranges are %v, want %v", test.indexes, ranges, test.want)
+		}
+	}
+}
+
+func TestUploadSessionWriteChunk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alphawing-uploads-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defaultDir := UploadSessionDir
+	UploadSessionDir = dir
+	defer func() { UploadSessionDir = defaultDir }()
+
+	content := []byte("0123456789")
+	session := &UploadSession{Token: NewToken(), FileSize: int64(len(content)), ChunkSize: 4}
+
+	tests := []struct {
+		name     string
+		index    int
+		data     []byte
+		err      error
+		received []int
+	}{
+		{"out of range", 3, []byte("x"), ErrUploadChunkIndex, []int{}},
+		{"negative index", -1, []byte("x"), ErrUploadChunkIndex, []int{}},
+		{"last chunk", 2, content[8:], nil, []int{2}},
+		{"too short", 0, content[:3], ErrUploadChunkSize, []int{2}},
+		{"too long", 0, content[:5], ErrUploadChunkSize, []int{2}},
+		{"first chunk", 0, content[:4], nil, []int{0, 2}},
+		{"retried chunk", 0, content[:4], nil, []int{0, 2}},
+		{"middle chunk", 1, content[4:8], nil, []int{0, 1, 2}},
+	}
+	for _, test := range tests {
+		if err := session.WriteChunk(test.index, bytes.NewReader(test.data)); err != test.err {
+			t.Errorf("%s: error is %v, want %v", test.name, err, test.err)
+		}
+		received, err := session.ReceivedChunks()
+		if err != nil {
+			t.Fatalf("%s: ReceivedChunks returned an error: %s", test.name, err)
+		}
+		if !reflect.DeepEqual(received, test.received) {
+			t.Errorf("%s: received chunks are %v, want %v", test.name, received, test.received)
+		}
+	}
+
+	// no temporary files are left
+	files, err := ioutil.ReadDir(session.dir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Errorf("%d files are left in the session directory, want 3", len(files))
+	}
+
+	file, err := session.Assemble()
+	if err != nil {
+		t.Fatalf("Assemble returned an error: %s", err)
+	}
+	defer file.Close()
+	assembled, err := ioutil.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(assembled, content) {
+		t.Errorf("assembled file is %q, want %q", assembled, content)
+	}
+
+	session.Sha256 = "0000000000000000000000000000000000000000000000000000000000000000"
+	if _, err := session.Assemble(); err != ErrUploadChecksumMismatch {
+		t.Errorf("error of the wrong checksum is %v, want %v", err, ErrUploadChecksumMismatch)
+	}
+}
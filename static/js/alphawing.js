@@ -195,7 +195,6 @@ $(function () {
 
     // bundle list tab
     (function () {
-        var LABELS = ['Android', 'iOS'];
         var NAV_CLASS_NAME = 'app-detail__bundle-nav';
         var ACTIVE_CLASS_NAME = 'active';
 
@@ -217,9 +216,9 @@ $(function () {
             $nav.children().eq(pos).addClass(ACTIVE_CLASS_NAME);
         };
 
-        $.each(LABELS, function (index, label) {
+        $appBundle.children().each(function (index, el) {
             var $btn = $('<a href="#" />');
-            $btn.text(label);
+            $btn.text($(el).data('label'));
             $btn.on('click', function (e) {
                 e.preventDefault();
                 selectTab(index);